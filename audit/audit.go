@@ -0,0 +1,157 @@
+/*
+Package audit : record every decision of the duplication check to an append-only sink.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+/*
+Record : a decision of the duplication check, which is written as a line of JSON
+	FirstSeen : when the original message was checked (only for duplicate)
+	Reason    : why the duplication could not be checked (only for error)
+*/
+type Record struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Instance  string     `json:"instance"`
+	RequestID string     `json:"requestId,omitempty"`
+	Tenant    string     `json:"tenant"`
+	Topic     string     `json:"topic,omitempty"`
+	KeyHash   string     `json:"keyHash,omitempty"`
+	Verdict   string     `json:"verdict"`
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+var (
+	// stdout : the sink of AUDIT_SINK=stdout
+	stdout io.Writer = os.Stdout
+
+	mutex   sync.RWMutex
+	current *auditor
+)
+
+/*
+Start : start writing the audit records to the sink of AUDIT_SINK in background.
+	The returned function writes the buffered records and closes the sink.
+	Nothing is recorded without AUDIT_SINK.
+*/
+func Start(config *conf.Config) (func() error, error) {
+	var out io.WriteCloser
+	switch config.AuditSink {
+	case conf.AuditStdout:
+		out = nopCloser{stdout}
+	case conf.AuditFile:
+		f, err := newRotatingFile(config.AuditFile, int64(config.AuditMaxSize)*1024*1024, config.AuditMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	default:
+		return func() error { return nil }, nil
+	}
+
+	a := newAuditor(out, config.InstanceID, config.AuditBufferSize)
+	mutex.Lock()
+	current = a
+	mutex.Unlock()
+	go a.run()
+
+	return func() error {
+		mutex.Lock()
+		if current == a {
+			current = nil
+		}
+		mutex.Unlock()
+		return a.close()
+	}, nil
+}
+
+/*
+Write : pass the record to the sink without blocking.
+	The request id attached to ctx is recorded, and the record is dropped if the buffer is full.
+*/
+func Write(ctx context.Context, record Record) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if current == nil {
+		return
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now().UTC()
+	}
+	if len(record.RequestID) == 0 {
+		record.RequestID = utils.FieldFromContext(ctx, utils.FieldRequestID)
+	}
+	current.write(record)
+}
+
+// auditor : write the records received by the channel one by one
+type auditor struct {
+	out      io.WriteCloser
+	instance string
+	records  chan Record
+	done     chan struct{}
+	logger   *utils.Logger
+}
+
+func newAuditor(out io.WriteCloser, instance string, bufferSize int) *auditor {
+	return &auditor{
+		out:      out,
+		instance: instance,
+		records:  make(chan Record, bufferSize),
+		done:     make(chan struct{}),
+		logger:   utils.NewLogger("audit"),
+	}
+}
+
+func (a *auditor) write(record Record) {
+	record.Instance = a.instance
+	select {
+	case a.records <- record:
+	default:
+		metrics.IncAuditDropped()
+	}
+}
+
+func (a *auditor) run() {
+	defer close(a.done)
+	for record := range a.records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			a.logger.Errorf("marshal failed: %s", err.Error())
+			continue
+		}
+		if _, err := a.out.Write(append(line, '\n')); err != nil {
+			a.logger.Errorf("write failed: %s", err.Error())
+		}
+	}
+}
+
+// close must be called after no more records are written.
+func (a *auditor) close() error {
+	close(a.records)
+	<-a.done
+	return a.out.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
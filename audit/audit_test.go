@@ -0,0 +1,109 @@
+/*
+Package audit : record every decision of the duplication check to an append-only sink.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+func TestStartDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	stop, err := Start(conf.NewConfig())
+	assert.NoError(err)
+	Write(context.Background(), Record{Verdict: "new"})
+	assert.NoError(stop())
+}
+
+func TestStartStdout(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	original := stdout
+	stdout = &buf
+	defer func() { stdout = original }()
+
+	config := conf.NewConfig()
+	config.AuditSink = conf.AuditStdout
+	config.InstanceID = "msgfilter-1"
+	stop, err := Start(config)
+	assert.NoError(err)
+
+	firstSeen := time.Date(2018, 12, 31, 18, 0, 0, 0, time.UTC)
+	ctx := utils.ContextWithField(context.Background(), utils.FieldRequestID, "req-1")
+	Write(ctx, Record{
+		Timestamp: time.Date(2018, 12, 31, 18, 0, 17, 0, time.UTC),
+		Tenant:    "t",
+		Topic:     "/a/b",
+		KeyHash:   "0123456789abcdef",
+		Verdict:   "duplicate",
+		FirstSeen: &firstSeen,
+	})
+	Write(context.Background(), Record{Tenant: "t", Verdict: "error", Reason: "etcd down"})
+	assert.NoError(stop())
+
+	// the records written after stop are ignored
+	Write(context.Background(), Record{Verdict: "new"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 2)
+	assert.Equal(`{"timestamp":"2018-12-31T18:00:17Z","instance":"msgfilter-1","requestId":"req-1","tenant":"t","topic":"/a/b","keyHash":"0123456789abcdef","verdict":"duplicate","firstSeen":"2018-12-31T18:00:00Z"}`, lines[0])
+
+	var record Record
+	assert.NoError(json.Unmarshal([]byte(lines[1]), &record))
+	assert.False(record.Timestamp.IsZero())
+	assert.Equal("msgfilter-1", record.Instance)
+	assert.Equal("", record.RequestID)
+	assert.Equal("etcd down", record.Reason)
+	assert.Nil(record.FirstSeen)
+}
+
+func TestStartFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := conf.NewConfig()
+	config.AuditSink = conf.AuditFile
+	config.AuditFile = filepath.Join(dir, "audit.jsonl")
+	stop, err := Start(config)
+	assert.NoError(err)
+	Write(context.Background(), Record{Tenant: "t", Verdict: "new"})
+	assert.NoError(stop())
+
+	b, err := ioutil.ReadFile(config.AuditFile)
+	assert.NoError(err)
+	assert.Contains(string(b), `"verdict":"new"`)
+
+	config.AuditFile = filepath.Join(dir, "none", "audit.jsonl")
+	_, err = Start(config)
+	assert.Error(err)
+}
+
+func TestWriteDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	// the records are not consumed because run is not started
+	a := newAuditor(nopCloser{&bytes.Buffer{}}, "i", 1)
+	a.write(Record{Verdict: "new"})
+	a.write(Record{Verdict: "duplicate"})
+	assert.Len(a.records, 1)
+	assert.Equal("new", (<-a.records).Verdict)
+}
@@ -0,0 +1,109 @@
+/*
+Package audit : record every decision of the duplication check to an append-only sink.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	assert.NoError(ioutil.WriteFile(path, []byte("0\n"), 0640))
+	f, err := newRotatingFile(path, 4, 2)
+	assert.NoError(err)
+	for _, line := range []string{"1\n", "2\n", "3\n", "4\n", "5\n", "6\n", "7\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+
+	// the existing lines are appended, and the oldest backup is overwritten
+	for file, expected := range map[string]string{
+		path:        "6\n7\n",
+		path + ".1": "4\n5\n",
+		path + ".2": "2\n3\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		assert.Equal(expected, string(b), file)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+}
+
+func TestRotatingFileNoBackup(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	f, err := newRotatingFile(path, 4, 0)
+	assert.NoError(err)
+	for _, line := range []string{"1\n", "2\n", "3\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(err)
+	}
+	assert.NoError(f.Close())
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("3\n", string(b))
+	_, err = os.Stat(path + ".1")
+	assert.True(os.IsNotExist(err))
+
+	// the file is never rotated without maxSize
+	f, err = newRotatingFile(path, 0, 0)
+	assert.NoError(err)
+	_, err = f.Write([]byte("4\n5\n"))
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	b, err = ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.Equal("3\n4\n5\n", string(b))
+}
+
+func TestRotatingFileRotateFailed(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// path.1 can not be replaced while it is a directory with a file
+	assert.NoError(os.MkdirAll(filepath.Join(path+".1", "blocker"), 0750))
+	f, err := newRotatingFile(path, 4, 1)
+	assert.NoError(err)
+	_, err = f.Write([]byte("1\n2\n"))
+	assert.NoError(err)
+	_, err = f.Write([]byte("3\n"))
+	assert.Error(err)
+
+	// the current file is still open, and rotated when it becomes possible
+	assert.NoError(os.RemoveAll(path + ".1"))
+	_, err = f.Write([]byte("4\n"))
+	assert.NoError(err)
+	assert.NoError(f.Close())
+	for file, expected := range map[string]string{
+		path:        "4\n",
+		path + ".1": "1\n2\n",
+	} {
+		b, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		assert.Equal(expected, string(b), file)
+	}
+}
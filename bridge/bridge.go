@@ -0,0 +1,247 @@
+/*
+Package bridge : subscribe MQTT messages, check their duplication using Checker and republish unique messages.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	subscribeQoS   = 2
+	timeout        = time.Second * 10
+	quiesce        = 250
+	topicSeparator = ","
+	mapSeparator   = "="
+)
+
+/*
+Bridge : a struct to subscribe MQTT messages and republish the messages which are not duplicated.
+	Bridge subscribes the input topic filters of MQTT_TOPICS,
+	and republishes the unique messages to the mapped output topics preserving QoS and retain flag.
+	The messages whose duplication could not be checked are dropped or republished by MQTT_ON_ERROR.
+*/
+type Bridge struct {
+	client   mqtt.Client
+	checker  *checker.Checker
+	mappings []*mapping
+	onError  string
+	logger   *utils.Logger
+}
+
+/*
+NewBridge : a factory method to create Bridge.
+*/
+func NewBridge(holder *conf.Holder) (*Bridge, error) {
+	config := holder.Get()
+	if len(config.MqttBroker) == 0 {
+		return nil, errors.New("MQTT_BROKER is not given")
+	}
+	mappings, err := parseMappings(config.MqttTopics)
+	if err != nil {
+		return nil, err
+	}
+	c, err := checker.NewChecker(holder)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := &Bridge{
+		checker:  c,
+		mappings: mappings,
+		onError:  config.MqttOnError,
+		logger:   utils.NewLogger("bridge"),
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.MqttBroker).
+		SetClientID(config.MqttClientID).
+		SetUsername(config.MqttUsername).
+		SetPassword(config.MqttPassword).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetDefaultPublishHandler(bridge.handle).
+		SetOnConnectHandler(bridge.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			bridge.logger.Warnf("connection lost: %s", err.Error())
+		})
+	bridge.client = mqtt.NewClient(opts)
+	return bridge, nil
+}
+
+/*
+Start : connect to MQTT Broker and start subscribing.
+*/
+func (b *Bridge) Start() error {
+	token := b.client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return errors.New("connect timeout")
+	}
+	return token.Error()
+}
+
+/*
+Shutdown : stop receiving the messages, wait for the messages in process until ctx is done, and then disconnect from MQTT Broker.
+*/
+func (b *Bridge) Shutdown(ctx context.Context) error {
+	filters := []string{}
+	for _, m := range b.mappings {
+		filters = append(filters, m.input)
+	}
+	token := b.client.Unsubscribe(filters...)
+	if !token.WaitTimeout(timeout) {
+		b.logger.Warnf("unsubscribe timeout: %v", filters)
+	} else if err := token.Error(); err != nil {
+		b.logger.Warnf("unsubscribe failed: %s", err.Error())
+	}
+
+	err := b.checker.Close(ctx)
+	b.client.Disconnect(quiesce)
+	return err
+}
+
+// subscribe is called whenever the client (re)connects to MQTT Broker,
+// because the subscriptions are not kept by a clean session.
+func (b *Bridge) subscribe(client mqtt.Client) {
+	filters := map[string]byte{}
+	for _, m := range b.mappings {
+		filters[m.input] = subscribeQoS
+	}
+	token := client.SubscribeMultiple(filters, nil)
+	if !token.WaitTimeout(timeout) {
+		b.logger.Errorf("subscribe timeout: %v", filters)
+		return
+	}
+	if err := token.Error(); err != nil {
+		b.logger.Errorf("subscribe failed: %s", err.Error())
+		return
+	}
+	b.logger.Infof("subscribed: %v", filters)
+}
+
+func (b *Bridge) handle(client mqtt.Client, msg mqtt.Message) {
+	output, ok := b.outputTopic(msg.Topic())
+	if !ok {
+		b.logger.Warnf("no mapping for topic=%s", msg.Topic())
+		return
+	}
+
+	// MQTT 3.1.1 has no headers to propagate the trace context, so each message starts a new trace
+	ctx, span := tracing.Tracer().Start(context.Background(), "MQTT "+msg.Topic(), trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	message := checker.Message{
+		Topic:   msg.Topic(),
+		Payload: string(msg.Payload()),
+	}
+	isDup, err := b.checker.IsDuplicateContext(ctx, message)
+	switch {
+	case err != nil:
+		metrics.IncBridgeError(b.onError)
+		if b.onError != conf.MqttOnErrorRepublish {
+			b.logger.Errorf("IsDuplicate failed, message dropped: %s, topic=%s", err.Error(), msg.Topic())
+			return
+		}
+		b.logger.Errorf("IsDuplicate failed, message republished: %s, topic=%s", err.Error(), msg.Topic())
+	case isDup:
+		b.logger.Infof("duplicate payload = %s, topic=%s", utils.Payload(message.Payload), msg.Topic())
+		return
+	}
+
+	b.logger.Infof("new payload = %s, topic=%s => %s", utils.Payload(message.Payload), msg.Topic(), output)
+	token := client.Publish(output, msg.Qos(), msg.Retained(), msg.Payload())
+	if !token.WaitTimeout(timeout) {
+		b.logger.Errorf("publish timeout: topic=%s", output)
+		return
+	}
+	if err := token.Error(); err != nil {
+		b.logger.Errorf("publish failed: topic=%s, %s", output, err.Error())
+	}
+}
+
+func (b *Bridge) outputTopic(topic string) (string, bool) {
+	for _, m := range b.mappings {
+		if output, ok := m.outputTopic(topic); ok {
+			return output, true
+		}
+	}
+	return "", false
+}
+
+// mapping : a pair of an input topic filter and an output topic.
+// The wildcards of the output topic are replaced by the topic levels matched with the wildcards of the input filter in order.
+type mapping struct {
+	input  string
+	output string
+}
+
+func parseMappings(topics string) ([]*mapping, error) {
+	mappings := []*mapping{}
+	for _, t := range strings.Split(topics, topicSeparator) {
+		if len(strings.TrimSpace(t)) == 0 {
+			continue
+		}
+		kv := strings.SplitN(t, mapSeparator, 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid MQTT_TOPICS, not input=output format: %s", t)
+		}
+		m := &mapping{
+			input:  strings.TrimSpace(kv[0]),
+			output: strings.TrimSpace(kv[1]),
+		}
+		if !utils.ValidTopicFilter(m.input) {
+			return nil, fmt.Errorf("invalid MQTT_TOPICS, invalid input topic filter: %s", m.input)
+		}
+		if !utils.ValidTopicFilter(m.output) || countWildcards(m.input) < countWildcards(m.output) {
+			return nil, fmt.Errorf("invalid MQTT_TOPICS, invalid output topic: %s", m.output)
+		}
+		mappings = append(mappings, m)
+	}
+	if len(mappings) == 0 {
+		return nil, errors.New("MQTT_TOPICS is not given")
+	}
+	// the republished messages must not be subscribed again, because their topics are changed and they are not duplicated
+	for _, i := range mappings {
+		for _, o := range mappings {
+			if _, ok := utils.MatchTopic(i.input, o.output); ok {
+				return nil, fmt.Errorf("invalid MQTT_TOPICS, output topic %s is matched with input topic filter %s", o.output, i.input)
+			}
+		}
+	}
+	return mappings, nil
+}
+
+func (m *mapping) outputTopic(topic string) (string, bool) {
+	matched, ok := utils.MatchTopic(m.input, topic)
+	if !ok {
+		return "", false
+	}
+	levels := strings.Split(m.output, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			levels[i] = matched[0]
+			matched = matched[1:]
+		}
+	}
+	return strings.Join(levels, "/"), true
+}
+
+func countWildcards(filter string) int {
+	return strings.Count(filter, "+") + strings.Count(filter, "#")
+}
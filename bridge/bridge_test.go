@@ -0,0 +1,273 @@
+/*
+Package bridge : subscribe MQTT messages, check their duplication using Checker and republish unique messages.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package bridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/mock/gomock"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+type received struct {
+	topic   string
+	payload string
+	qos     byte
+}
+
+func setUpBroker(t *testing.T) (*server.Server, string, chan *received, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	broker := server.New(&server.Options{InlineClient: true})
+	assert.NoError(t, broker.AddHook(new(auth.AllowHook), nil))
+	assert.NoError(t, broker.AddListener(listeners.NewTCP("t1", address, nil)))
+	go broker.Serve()
+
+	ch := make(chan *received, 10)
+	err = broker.Subscribe("/filtered/#", 1, func(cl *server.Client, sub packets.Subscription, pk packets.Packet) {
+		ch <- &received{
+			topic:   pk.TopicName,
+			payload: string(pk.Payload),
+			qos:     pk.FixedHeader.Qos,
+		}
+	})
+	assert.NoError(t, err)
+
+	tearDown := func() {
+		broker.Close()
+	}
+	return broker, "tcp://" + address, ch, tearDown
+}
+
+func setUpChecker(t *testing.T) (*mock.MockKeysAPI, func(string, string, bool), func()) {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	kapi := mock.NewMockKeysAPI(ctrl)
+
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+	checker.GetMutexID = func(_ string) string {
+		return "mutexID"
+	}
+
+	config := conf.NewConfig()
+	lockOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.LockTTL),
+	}
+	dataOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.DataTTL),
+	}
+	keyNotFound := client.Error{
+		Code: client.ErrorCodeKeyNotFound,
+	}
+	expect := func(topic string, identity string, isDuplicate bool) {
+		sum := sha256.Sum256([]byte(identity))
+		key := "-/t/" + url.PathEscape(topic) + "/" + hex.EncodeToString(sum[:])
+		if isDuplicate {
+			gomock.InOrder(
+				kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
+				kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, nil),
+				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+			)
+		} else {
+			gomock.InOrder(
+				kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
+				kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, keyNotFound),
+				kapi.EXPECT().Set(context.Background(), "/data/"+key, gomock.Any(), dataOptions).Return(nil, nil),
+				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+			)
+		}
+	}
+	tearDown := func() {
+		ctrl.Finish()
+	}
+	return kapi, expect, tearDown
+}
+
+func TestParseMappings(t *testing.T) {
+	assert := assert.New(t)
+
+	mappings, err := parseMappings(" /ul/+/+/attrs = /filtered/ul/+/+/attrs , /json/#=/filtered/json,")
+	assert.NoError(err)
+	assert.Equal([]*mapping{
+		{input: "/ul/+/+/attrs", output: "/filtered/ul/+/+/attrs"},
+		{input: "/json/#", output: "/filtered/json"},
+	}, mappings)
+
+	for _, topics := range []string{"", " , ", "/ul/#", "/ul/#/attrs=/filtered", "/ul/#=/filtered/#/attrs", "/ul/+=/filtered/+/+", "#=/filtered/#", "/+/+/attrs=/ul/+/attrs,/a=/b"} {
+		mappings, err := parseMappings(topics)
+		assert.Nil(mappings, topics)
+		assert.Error(err, topics)
+	}
+}
+
+func TestOutputTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		m        *mapping
+		topic    string
+		ok       bool
+		expected string
+	}{
+		{m: &mapping{"/ul/+/+/attrs", "/filtered/ul/+/+/attrs"}, topic: "/ul/key/dev1/attrs", ok: true, expected: "/filtered/ul/key/dev1/attrs"},
+		{m: &mapping{"/ul/+/+/attrs", "/filtered/+/attrs"}, topic: "/ul/key/dev1/attrs", ok: true, expected: "/filtered/key/attrs"},
+		{m: &mapping{"/ul/#", "/filtered/ul/#"}, topic: "/ul/key/dev1/attrs", ok: true, expected: "/filtered/ul/key/dev1/attrs"},
+		{m: &mapping{"/ul/#", "/filtered"}, topic: "/ul/key/dev1/attrs", ok: true, expected: "/filtered"},
+		{m: &mapping{"/ul/+/+/attrs", "/filtered/ul/+/+/attrs"}, topic: "/json/key/dev1/attrs", ok: false, expected: ""},
+	}
+	for _, testCase := range testCases {
+		output, ok := testCase.m.outputTopic(testCase.topic)
+		assert.Equal(testCase.ok, ok)
+		assert.Equal(testCase.expected, output)
+	}
+}
+
+func TestNewBridgeError(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []*conf.Config{
+		{MqttBroker: "", MqttTopics: "/ul/#=/filtered/ul/#"},
+		{MqttBroker: "tcp://127.0.0.1:1883", MqttTopics: ""},
+	}
+	for _, config := range testCases {
+		bridge, err := NewBridge(conf.NewHolder(config))
+		assert.Nil(bridge)
+		assert.Error(err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	assert := assert.New(t)
+	broker, address, ch, tearDownBroker := setUpBroker(t)
+	defer tearDownBroker()
+	_, expect, tearDownChecker := setUpChecker(t)
+	defer tearDownChecker()
+
+	// the retained message is delivered with retain flag when the bridge subscribes
+	expect("/ul/key/dev1/attrs", "t|1", false)
+	assert.NoError(broker.Publish("/ul/key/dev1/attrs", []byte("t|1"), true, 1))
+
+	config := conf.NewConfig()
+	config.MqttBroker = address
+	config.MqttTopics = "/ul/+/+/attrs=/filtered/ul/+/+/attrs"
+	bridge, err := NewBridge(conf.NewHolder(config))
+	assert.NoError(err)
+	assert.NoError(bridge.Start())
+	defer bridge.Shutdown(context.Background())
+
+	select {
+	case r := <-ch:
+		assert.Equal(&received{topic: "/filtered/ul/key/dev1/attrs", payload: "t|1", qos: 1}, r)
+	case <-time.After(time.Second * 5):
+		assert.Fail("unique message is not republished")
+	}
+	retained := broker.Topics.Messages("/filtered/#")
+	assert.Len(retained, 1)
+	assert.Equal("t|1", string(retained[0].Payload))
+
+	expect("/ul/key/dev1/attrs", "t|1", true)
+	assert.NoError(broker.Publish("/ul/key/dev1/attrs", []byte("t|1"), false, 1))
+	select {
+	case r := <-ch:
+		assert.Fail("duplicate message is republished", "%v", r)
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	expect("/ul/key/dev2/attrs", "t|2", false)
+	assert.NoError(broker.Publish("/ul/key/dev2/attrs", []byte("t|2"), false, 2))
+	select {
+	case r := <-ch:
+		assert.Equal(&received{topic: "/filtered/ul/key/dev2/attrs", payload: "t|2", qos: 2}, r)
+	case <-time.After(time.Second * 5):
+		assert.Fail("unique message is not republished")
+	}
+}
+
+func TestBridgeOnError(t *testing.T) {
+	assert := assert.New(t)
+	broker, address, ch, tearDownBroker := setUpBroker(t)
+	defer tearDownBroker()
+	kapi, _, tearDownChecker := setUpChecker(t)
+	defer tearDownChecker()
+
+	for _, onError := range []string{conf.MqttOnErrorDrop, conf.MqttOnErrorRepublish} {
+		gomock.InOrder(
+			kapi.EXPECT().Set(gomock.Any(), gomock.Any(), "mutexID", gomock.Any()).Return(nil, nil),
+			kapi.EXPECT().Get(gomock.Any(), gomock.Any(), nil).Return(nil, errors.New("etcd down")),
+			kapi.EXPECT().Delete(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil),
+		)
+		config := conf.NewConfig()
+		config.MqttBroker = address
+		config.MqttTopics = "/ul/+/+/attrs=/filtered/ul/+/+/attrs"
+		config.MqttOnError = onError
+		bridge, err := NewBridge(conf.NewHolder(config))
+		assert.NoError(err)
+		assert.NoError(bridge.Start())
+		for len(broker.Topics.Subscribers("/ul/key/dev1/attrs").Subscriptions) == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		assert.NoError(broker.Publish("/ul/key/dev1/attrs", []byte("t|1"), false, 1))
+		select {
+		case r := <-ch:
+			assert.Equal(conf.MqttOnErrorRepublish, onError, "message is republished on error")
+			assert.Equal(&received{topic: "/filtered/ul/key/dev1/attrs", payload: "t|1", qos: 1}, r)
+		case <-time.After(time.Second * 2):
+			assert.Equal(conf.MqttOnErrorDrop, onError, "message is not republished on error")
+		}
+		assert.NoError(bridge.Shutdown(context.Background()))
+	}
+}
+
+func TestBridgeShutdown(t *testing.T) {
+	assert := assert.New(t)
+	broker, address, ch, tearDownBroker := setUpBroker(t)
+	defer tearDownBroker()
+	_, _, tearDownChecker := setUpChecker(t)
+	defer tearDownChecker()
+
+	config := conf.NewConfig()
+	config.MqttBroker = address
+	config.MqttTopics = "/ul/+/+/attrs=/filtered/ul/+/+/attrs"
+	bridge, err := NewBridge(conf.NewHolder(config))
+	assert.NoError(err)
+	assert.NoError(bridge.Start())
+	assert.NoError(bridge.Shutdown(context.Background()))
+	assert.False(bridge.client.IsConnected())
+
+	// the messages are not checked after shutdown
+	assert.NoError(broker.Publish("/ul/key/dev1/attrs", []byte("t|1"), false, 1))
+	select {
+	case r := <-ch:
+		assert.Fail("message is republished after shutdown", "%v", r)
+	case <-time.After(time.Millisecond * 500):
+	}
+}
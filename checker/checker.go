@@ -8,27 +8,85 @@ package checker
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/coreos/etcd/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/audit"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
 )
 
+// healthKey : the key read by Ping, which does not need to exist
+const healthKey = "/health"
+
+const (
+	// EncodingBase64 : Payload is the standard base64 encoding of the binary payload
+	EncodingBase64 = "base64"
+)
+
+// now : injection point to mock the current time
+var now = time.Now
+
+// ErrClosed : the error of the duplication check requested after Close
+var ErrClosed = errors.New("checker is closed")
+
 /*
 Checker : a struct to check message duplication using etcd
 */
 type Checker struct {
-	client client.Client
-	config *conf.Config
+	client    client.Client
+	transport client.CancelableTransport
+	holder    *conf.Holder
+	settings  *settingsWatcher
+
+	closeMutex sync.RWMutex
+	closed     bool
+	inFlight   sync.WaitGroup
+	heldMutex  sync.Mutex
+	held       map[*mutex]bool
+	live       *instanceKeys
+}
+
+/*
+Message : a struct to hold the message to be checked and its attributes
+	Encoding : how Payload is encoded, which is decoded so that the duplication is checked on the raw bytes (empty means as it is)
+*/
+type Message struct {
+	Service     string
+	Topic       string
+	Payload     string
+	PayloadType string
+	Encoding    string
+}
+
+/*
+ValidEncoding : check whether the argument is a supported encoding of Message.
+*/
+func ValidEncoding(encoding string) bool {
+	return len(encoding) == 0 || encoding == EncodingBase64
 }
 
 /*
 NewChecker : a factory method to create Checker.
 */
-func NewChecker(config *conf.Config) (*Checker, error) {
+func NewChecker(holder *conf.Holder) (*Checker, error) {
+	config := holder.Get()
 	cfg := client.Config{
 		Endpoints:               []string{config.EtcdEndpoint},
 		Transport:               client.DefaultTransport,
@@ -40,8 +98,15 @@ func NewChecker(config *conf.Config) (*Checker, error) {
 	}
 
 	checker := &Checker{
-		client: c,
-		config: config,
+		client:    c,
+		transport: cfg.Transport,
+		holder:    holder,
+		held:      map[*mutex]bool{},
+		live:      newInstanceKeys(),
+	}
+	if len(config.ConfigPrefix) != 0 {
+		checker.settings = newSettingsWatcher(config.ConfigPrefix, c)
+		checker.settings.start()
 	}
 	return checker, nil
 }
@@ -49,13 +114,68 @@ func NewChecker(config *conf.Config) (*Checker, error) {
 /*
 IsDuplicate : check whether the artument message is duplicated.
 */
-func (c *Checker) IsDuplicate(message string) (bool, error) {
-	logger := utils.NewLogger("isDuplicate")
+func (c *Checker) IsDuplicate(message Message) (bool, error) {
+	return c.IsDuplicateContext(context.Background(), message)
+}
+
+/*
+IsDuplicateContext : check whether the artument message is duplicated as a part of the argument context.
+	The spans of the check are the children of the span of ctx.
+*/
+func (c *Checker) IsDuplicateContext(ctx context.Context, message Message) (isDup bool, err error) {
+	start := time.Now()
+	tenant := metrics.Tenant(c.holder.Get(), message.Service)
+	ctx, span := tracing.Tracer().Start(ctx, "IsDuplicate", trace.WithAttributes(
+		attribute.String("fiware.service", message.Service),
+		attribute.String("mqtt.topic", message.Topic),
+		attribute.String("payload.type", message.PayloadType),
+	))
+	var keyHash string
+	var firstSeen *time.Time
+	defer func() {
+		v := Verdict(isDup, err)
+		metrics.ObserveCheck(tenant, v, start)
+		record := audit.Record{
+			Tenant:    message.Service,
+			Topic:     message.Topic,
+			KeyHash:   keyHash,
+			Verdict:   v,
+			FirstSeen: firstSeen,
+		}
+		if err != nil {
+			record.Reason = err.Error()
+		}
+		audit.Write(ctx, record)
+		span.SetAttributes(attribute.String("verdict", v))
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	if !c.begin() {
+		return true, ErrClosed
+	}
+	defer c.inFlight.Done()
+
+	ctx = utils.ContextWithField(ctx, utils.FieldTenant, message.Service)
+	logger := utils.NewLogger("isDuplicate").WithContext(ctx)
+	r, err := c.rule(message)
+	if err != nil {
+		logger.Errorf("rule failed: %s", err.Error())
+		return true, err
+	}
+	if r.skip {
+		logger.Debugf("skip topic = %s", message.Topic)
+		return false, nil
+	}
 
-	lockKey := fmt.Sprintf("/lock/%s", message)
-	logger.Debugf("lockKey = %s", lockKey)
+	// the key is logged as its hash, because it contains the topic
+	keyHash = utils.HashKey(r.key)
+	ctx = utils.ContextWithField(ctx, utils.FieldKeyHash, keyHash)
+	logger = logger.With(utils.FieldKeyHash, keyHash)
+	lockKey := fmt.Sprintf("/lock/%s", r.key)
 
-	m, err := newMutex(lockKey, c.config.LockTTL, c.client)
+	m, err := newMutex(ctx, lockKey, r.lockTTL, c.client)
 	if err != nil {
 		logger.Errorf("newMutex failed: %s", err.Error())
 		return true, err
@@ -65,12 +185,16 @@ func (c *Checker) IsDuplicate(message string) (bool, error) {
 		logger.Errorf("mutex.Lock failed: %s", err.Error())
 		return true, err
 	}
-	defer m.Unlock()
+	// the mutex is held only after it is locked, and unheld before it is unlocked,
+	// so that Close releases only the locks acquired by the checks in process
+	c.hold(m)
+	defer func() {
+		c.unhold(m)
+		m.Unlock()
+	}()
 
-	dataKey := fmt.Sprintf("/data/%s", message)
-	logger.Debugf("dataKey = %s", dataKey)
-
-	_, err = m.kapi.Get(context.Background(), dataKey, nil)
+	dataKey := fmt.Sprintf("/data/%s", r.key)
+	resp, err := m.kapi.Get(context.Background(), dataKey, nil)
 	if err != nil {
 		e, ok := err.(client.Error)
 		if !ok {
@@ -82,16 +206,287 @@ func (c *Checker) IsDuplicate(message string) (bool, error) {
 
 		setOptions := &client.SetOptions{
 			PrevExist: client.PrevNoExist,
-			TTL:       time.Second * time.Duration(c.config.DataTTL),
+			TTL:       time.Second * time.Duration(r.dataTTL),
 		}
-		_, err = m.kapi.Set(context.Background(), dataKey, "duplicate", setOptions)
+		// the value is when the message is checked, which is the first seen of the duplicates
+		_, err = m.kapi.Set(context.Background(), dataKey, now().UTC().Format(time.RFC3339Nano), setOptions)
 		if err != nil {
 			logger.Errorf("etcd set failed: %s", err.Error())
 			return true, err
 		}
-		logger.Debugf("%s is not duplicate", message)
+		// the keys are counted only for the quota, so that they are not kept in memory without the quota
+		if _, quota := c.Limits(message.Service); quota > 0 {
+			c.live.add(message.Service, dataKey, setOptions.TTL)
+		}
+		logger.Debugf("not duplicate")
 		return false, nil
 	}
-	logger.Debugf("%s is duplicate", message)
+	firstSeen = firstSeenOf(resp)
+	logger.Debugf("duplicate")
 	return true, nil
 }
+
+// firstSeenOf reads when the original message was checked from the value of its data key.
+// The data key without the time (written by the older version) has no first seen.
+func firstSeenOf(resp *client.Response) *time.Time {
+	if resp == nil || resp.Node == nil {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, resp.Node.Value)
+	if err != nil {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+/*
+Forget : forget the argument message so that the message is not regarded as duplicate any more.
+	Forget is used when the unique message could not be processed, so that the retried message can pass.
+*/
+func (c *Checker) Forget(message Message) error {
+	r, err := c.rule(message)
+	if err != nil {
+		return err
+	}
+	if r.skip {
+		return nil
+	}
+	logger := utils.NewLogger("forget").With(utils.FieldTenant, message.Service).With(utils.FieldKeyHash, utils.HashKey(r.key))
+
+	dataKey := fmt.Sprintf("/data/%s", r.key)
+	_, err = newKeysAPI(context.Background(), c.client).Delete(context.Background(), dataKey, nil)
+	c.live.remove(message.Service, dataKey)
+	if err != nil {
+		if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeKeyNotFound {
+			return nil
+		}
+		logger.Errorf("etcd delete failed: %s", err.Error())
+		return err
+	}
+	logger.Debugf("forgotten")
+	return nil
+}
+
+/*
+Limits : the rate limit (requests per second) and the quota (live data keys of this instance) applied to the service.
+	The settings stored in etcd take precedence over the Config, and 0 means unlimited.
+*/
+func (c *Checker) Limits(service string) (int, int) {
+	config := c.holder.Get()
+	if c.settings == nil {
+		return config.RateLimit, config.InstanceQuota
+	}
+	s := c.settings.get()
+	return s.get(service, rateLimitKey, config.RateLimit), s.get(service, instanceQuotaKey, config.InstanceQuota)
+}
+
+/*
+InstanceKeys : the number of the data keys of the service created by this instance and not expired yet,
+	and when the oldest of them expires.
+*/
+func (c *Checker) InstanceKeys(service string) (int, time.Time) {
+	return c.live.count(service)
+}
+
+/*
+Ping : check whether etcd responds before the deadline of ctx.
+*/
+func (c *Checker) Ping(ctx context.Context) error {
+	_, err := newKeysAPI(ctx, c.client).Get(ctx, healthKey, nil)
+	if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+/*
+Close : stop accepting the duplication checks and wait for the checks in process until ctx is done.
+	The locks still held after ctx is done are released so that the other instances do not wait for their TTL,
+	and then the watch of the runtime settings is stopped and the idle connections to etcd are closed.
+*/
+func (c *Checker) Close(ctx context.Context) error {
+	c.closeMutex.Lock()
+	c.closed = true
+	c.closeMutex.Unlock()
+	logger := utils.NewLogger("close")
+
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		logger.Infof("all checks finished")
+	case <-ctx.Done():
+		err = ctx.Err()
+		c.heldMutex.Lock()
+		logger.Warnf("checks in process are abandoned: %s, release %d locks", err.Error(), len(c.held))
+		for m := range c.held {
+			if e := m.release(); e != nil {
+				logger.Errorf("release failed: %s", e.Error())
+			}
+		}
+		c.heldMutex.Unlock()
+	}
+
+	if c.settings != nil {
+		c.settings.stop()
+	}
+	if t, ok := c.transport.(*http.Transport); ok {
+		t.CloseIdleConnections()
+	}
+	return err
+}
+
+// begin counts the check in process unless the Checker is closed.
+func (c *Checker) begin() bool {
+	c.closeMutex.RLock()
+	defer c.closeMutex.RUnlock()
+	if c.closed {
+		return false
+	}
+	c.inFlight.Add(1)
+	return true
+}
+
+func (c *Checker) hold(m *mutex) {
+	c.heldMutex.Lock()
+	defer c.heldMutex.Unlock()
+	c.held[m] = true
+}
+
+func (c *Checker) unhold(m *mutex) {
+	c.heldMutex.Lock()
+	defer c.heldMutex.Unlock()
+	delete(c.held, m)
+}
+
+/*
+Verdict : the verdict of the duplication check for logs and metrics.
+*/
+func Verdict(isDup bool, err error) string {
+	switch {
+	case err != nil:
+		return metrics.VerdictError
+	case isDup:
+		return metrics.VerdictDuplicate
+	}
+	return metrics.VerdictNew
+}
+
+// rule : how to check the duplication of a message
+type rule struct {
+	key     string
+	lockTTL int
+	dataTTL int
+	skip    bool
+}
+
+// rule resolves how to check the duplication of the message.
+// When the message has its topic, the first TopicPolicy matched with the topic is applied.
+// If no TopicPolicy is matched, the topic is a part of the key.
+// The payload type of the message takes precedence over the one of TopicPolicy.
+func (c *Checker) rule(message Message) (*rule, error) {
+	raw, err := decodePayload(message)
+	if err != nil {
+		return nil, err
+	}
+	config := c.holder.Get()
+	r := &rule{}
+	r.lockTTL, r.dataTTL = c.ttl(config, message.Service)
+
+	payloadType := message.PayloadType
+	scopeTopic := len(message.Topic) != 0
+	if policy, ok := c.topicPolicy(config, message.Topic); ok {
+		r.skip = policy.Skip
+		if policy.DataTTL != nil {
+			r.dataTTL = *policy.DataTTL
+		}
+		if policy.ScopeTopic != nil {
+			scopeTopic = *policy.ScopeTopic
+		}
+		if len(payloadType) == 0 {
+			payloadType = policy.PayloadType
+		}
+	}
+	if r.skip {
+		return r, nil
+	}
+
+	identity, err := payload.Identity(payloadType, raw, payload.Options{
+		ExcludeTimestamp: config.ExcludeTimestamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.key = "n/" + identityKey(identity)
+	if scopeTopic {
+		r.key = topicKey(message.Topic, identityKey(identity))
+	}
+	// the key is scoped by the service, so that the services never share their messages
+	r.key = serviceKey(message.Service) + "/" + r.key
+	return r, nil
+}
+
+// decodePayload returns the raw bytes of the payload, which may contain any bytes and are hashed by identityKey.
+// The payload which can not be decoded is reported as payload.Error, as well as the payload which can not be parsed.
+func decodePayload(message Message) (string, error) {
+	switch message.Encoding {
+	case "":
+		return message.Payload, nil
+	case EncodingBase64:
+		raw, err := base64.StdEncoding.DecodeString(message.Payload)
+		if err != nil {
+			return "", &payload.Error{PayloadType: EncodingBase64, Reason: err.Error()}
+		}
+		return string(raw), nil
+	}
+	return "", &payload.Error{PayloadType: message.Encoding, Reason: "unknown encoding"}
+}
+
+func (c *Checker) topicPolicy(config *conf.Config, topic string) (*conf.TopicPolicy, bool) {
+	if len(topic) == 0 {
+		return nil, false
+	}
+	return config.MatchTopicPolicy(topic)
+}
+
+// topicKey escapes the topic so that the topic becomes a single level of the key.
+// The keys with and without topic are in the different levels ("t/<topic>/" and "n/"), so that they never collide.
+func topicKey(topic string, identity string) string {
+	return "t/" + keySegment(topic) + "/" + identity
+}
+
+// identityKey hashes the identity of the payload, so that any bytes of the payload (e.g. "//" and "../" of binary frames)
+// become a single level of the key, which etcd does not clean.
+func identityKey(identity string) string {
+	sum := sha256.Sum256([]byte(identity))
+	return hex.EncodeToString(sum[:])
+}
+
+// serviceKey escapes the service so that the service becomes a single level of the key.
+// The default service (empty) is "-", and "-" of the other services is escaped not to collide with it.
+func serviceKey(service string) string {
+	if len(service) == 0 {
+		return "-"
+	}
+	return strings.Replace(keySegment(service), "-", "%2D", -1)
+}
+
+// keySegment escapes '/' and '.' of s, because etcd cleans "." and ".." levels of the key path.
+func keySegment(s string) string {
+	return strings.Replace(url.PathEscape(s), ".", "%2E", -1)
+}
+
+// ttl returns LOCK_TTL and DATA_TTL applied to the service.
+// The settings stored in etcd take precedence over the Config.
+func (c *Checker) ttl(config *conf.Config, service string) (int, int) {
+	if c.settings == nil {
+		return config.LockTTL, config.DataTTL
+	}
+	s := c.settings.get()
+	return s.get(service, lockTTLKey, config.LockTTL), s.get(service, dataTTLKey, config.DataTTL)
+}
@@ -9,6 +9,8 @@ package checker
 import (
 	"context"
 	"errors"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +20,7 @@ import (
 
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
 )
 
 func setUpChecker(t *testing.T) (*mock.MockKeysAPI, func()) {
@@ -44,7 +47,7 @@ func TestDuplicate(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -55,11 +58,11 @@ func TestDuplicate(t *testing.T) {
 	}
 
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", options).Return(nil, nil),
-		kapi.EXPECT().Get(context.Background(), "/data/test", nil).Return(nil, nil),
-		kapi.EXPECT().Delete(context.TODO(), "/lock/test", nil).Return(nil, nil),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", options).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 	)
-	result, err := checker.IsDuplicate("test")
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
 	assert.True(result)
 	assert.NoError(err)
 }
@@ -70,7 +73,8 @@ func TestNotDuplicate(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	config.InstanceQuota = 10
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -90,15 +94,36 @@ func TestNotDuplicate(t *testing.T) {
 		Index:   0,
 	}
 
+	original := now
+	now = func() time.Time { return time.Date(2018, 12, 31, 18, 0, 0, 123000000, time.Local) }
+	defer func() { now = original }()
+
+	// the data key has the time of the check
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/-/n/"+identityKey("test"), now().UTC().Format(time.RFC3339Nano), dataOptions).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+	)
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
+	assert.False(result)
+	assert.NoError(err)
+	count, _ := checker.InstanceKeys("")
+	assert.Equal(1, count)
+
+	// the keys are not counted without the quota
+	config.InstanceQuota = 0
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", lockOptions).Return(nil, nil),
-		kapi.EXPECT().Get(context.Background(), "/data/test", nil).Return(nil, keyNotFound),
-		kapi.EXPECT().Set(context.Background(), "/data/test", "duplicate", dataOptions).Return(nil, nil),
-		kapi.EXPECT().Delete(context.TODO(), "/lock/test", nil).Return(nil, nil),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("other"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("other"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/-/n/"+identityKey("other"), now().UTC().Format(time.RFC3339Nano), dataOptions).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("other"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 	)
-	result, err := checker.IsDuplicate("test")
+	result, err = checker.IsDuplicate(Message{Payload: "other"})
 	assert.False(result)
 	assert.NoError(err)
+	count, _ = checker.InstanceKeys("")
+	assert.Equal(1, count)
 }
 
 func TestRaiseError1(t *testing.T) {
@@ -107,7 +132,7 @@ func TestRaiseError1(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -119,9 +144,9 @@ func TestRaiseError1(t *testing.T) {
 	raisedError := errors.New("error")
 
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", lockOptions).Return(nil, raisedError).AnyTimes(),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, raisedError).AnyTimes(),
 	)
-	result, err := checker.IsDuplicate("test")
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
 	assert.True(result)
 	assert.Equal(raisedError, err)
 }
@@ -132,7 +157,7 @@ func TestRaiseError2(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -144,11 +169,11 @@ func TestRaiseError2(t *testing.T) {
 	raisedError := errors.New("error")
 
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", lockOptions).Return(nil, nil),
-		kapi.EXPECT().Get(context.Background(), "/data/test", nil).Return(nil, raisedError),
-		kapi.EXPECT().Delete(context.TODO(), "/lock/test", nil).Return(nil, nil),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, raisedError),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 	)
-	result, err := checker.IsDuplicate("test")
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
 	assert.True(result)
 	assert.Equal(raisedError, err)
 }
@@ -159,7 +184,7 @@ func TestRaiseError3(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -181,12 +206,12 @@ func TestRaiseError3(t *testing.T) {
 	raisedError := errors.New("error")
 
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", lockOptions).Return(nil, nil),
-		kapi.EXPECT().Get(context.Background(), "/data/test", nil).Return(nil, keyNotFound),
-		kapi.EXPECT().Set(context.Background(), "/data/test", "duplicate", dataOptions).Return(nil, raisedError),
-		kapi.EXPECT().Delete(context.TODO(), "/lock/test", nil).Return(nil, nil),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/-/n/"+identityKey("test"), gomock.Any(), dataOptions).Return(nil, raisedError),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 	)
-	result, err := checker.IsDuplicate("test")
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
 	assert.True(result)
 	assert.Equal(raisedError, err)
 }
@@ -197,7 +222,7 @@ func TestRaiseError4(t *testing.T) {
 	defer tearDown()
 
 	config := conf.NewConfig()
-	checker, err := NewChecker(config)
+	checker, err := NewChecker(conf.NewHolder(config))
 
 	assert.NotNil(checker)
 	assert.NoError(err)
@@ -209,11 +234,410 @@ func TestRaiseError4(t *testing.T) {
 	raisedError := errors.New("error")
 
 	gomock.InOrder(
-		kapi.EXPECT().Set(context.TODO(), "/lock/test", "mutexID", lockOptions).Return(nil, nil),
-		kapi.EXPECT().Get(context.Background(), "/data/test", nil).Return(nil, nil),
-		kapi.EXPECT().Delete(context.TODO(), "/lock/test", nil).Return(nil, raisedError).AnyTimes(),
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, raisedError).AnyTimes(),
+	)
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
+	assert.True(result)
+	assert.NoError(err)
+}
+
+func TestTopicRule(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	f := false
+	ttl := 30
+	config := conf.NewConfig()
+	config.TopicPolicies = []conf.TopicPolicy{
+		{Filter: "/ul/+/+/cmd", Skip: true},
+		{Filter: "/ul/+/dev1/attrs", ScopeTopic: &f},
+		{Filter: "/ul/#", DataTTL: &ttl},
+	}
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	testCases := []struct {
+		topic    string
+		expected *rule
+	}{
+		{topic: "", expected: &rule{key: "-/n/" + identityKey("test"), lockTTL: config.LockTTL, dataTTL: config.DataTTL}},
+		{topic: "/json/key/dev1/attrs", expected: &rule{key: "-/t/%2Fjson%2Fkey%2Fdev1%2Fattrs/" + identityKey("test"), lockTTL: config.LockTTL, dataTTL: config.DataTTL}},
+		{topic: "/ul/key/dev1/cmd", expected: &rule{key: "", lockTTL: config.LockTTL, dataTTL: config.DataTTL, skip: true}},
+		{topic: "/ul/key/dev1/attrs", expected: &rule{key: "-/n/" + identityKey("test"), lockTTL: config.LockTTL, dataTTL: config.DataTTL}},
+		{topic: "/ul/key/dev2/attrs", expected: &rule{key: "-/t/%2Ful%2Fkey%2Fdev2%2Fattrs/" + identityKey("test"), lockTTL: config.LockTTL, dataTTL: 30}},
+		{topic: "..", expected: &rule{key: "-/t/%2E%2E/" + identityKey("test"), lockTTL: config.LockTTL, dataTTL: config.DataTTL}},
+	}
+	for _, testCase := range testCases {
+		r, err := checker.rule(Message{Topic: testCase.topic, Payload: "test"})
+		assert.NoError(err)
+		assert.Equal(testCase.expected, r, testCase.topic)
+	}
+
+	// the payload with '/' and no topic does not collide with the payload on the topic
+	withoutTopic, err := checker.rule(Message{Payload: "a/b"})
+	assert.NoError(err)
+	withTopic, err := checker.rule(Message{Topic: "a", Payload: "b"})
+	assert.NoError(err)
+	assert.NotEqual(withoutTopic.key, withTopic.key)
+}
+
+func TestBinaryRule(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	checker, err := NewChecker(conf.NewHolder(conf.NewConfig()))
+	assert.NoError(err)
+
+	// etcd cleans "//" and "../" of the key path, so the payloads differing only by them must be distinct levels
+	keys := map[string]string{}
+	for _, raw := range []string{"\x01//\x02", "\x01/\x02", "\x01/../\x02", "\x02"} {
+		r, err := checker.rule(Message{Payload: raw})
+		assert.NoError(err)
+		assert.Equal(r.key, path.Clean(r.key), raw)
+		assert.True(strings.HasPrefix(r.key, "-/n/"), raw)
+		assert.NotContains(keys, r.key, raw)
+		keys[r.key] = raw
+	}
+}
+
+func TestServiceRule(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NoError(err)
+
+	testCases := []struct {
+		service  string
+		expected string
+	}{
+		{service: "", expected: "-/n/" + identityKey("test")},
+		{service: "smartcity", expected: "smartcity/n/" + identityKey("test")},
+		{service: "-", expected: "%2D/n/" + identityKey("test")},
+		{service: "..", expected: "%2E%2E/n/" + identityKey("test")},
+		{service: "a/n", expected: "a%2Fn/n/" + identityKey("test")},
+	}
+	for _, testCase := range testCases {
+		r, err := checker.rule(Message{Service: testCase.service, Payload: "test"})
+		assert.NoError(err)
+		assert.Equal(testCase.expected, r.key, testCase.service)
+	}
+
+	// the same message of another service is not a duplicate
+	keyNotFound := client.Error{Code: client.ErrorCodeKeyNotFound}
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/tenant1/n/"+identityKey("test"), "mutexID", gomock.Any()).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/tenant1/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/tenant1/n/"+identityKey("test"), gomock.Any(), gomock.Any()).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/tenant1/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+		kapi.EXPECT().Set(context.TODO(), "/lock/tenant2/n/"+identityKey("test"), "mutexID", gomock.Any()).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/tenant2/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/tenant2/n/"+identityKey("test"), gomock.Any(), gomock.Any()).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/tenant2/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+	)
+	for _, service := range []string{"tenant1", "tenant2"} {
+		result, err := checker.IsDuplicate(Message{Service: service, Payload: "test"})
+		assert.False(result, service)
+		assert.NoError(err)
+	}
+}
+
+func TestSkipTopic(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	config.TopicPolicies = []conf.TopicPolicy{
+		{Filter: "/ul/+/+/cmd", Skip: true},
+	}
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	// etcd is not accessed
+	result, err := checker.IsDuplicate(Message{Topic: "/ul/key/dev1/cmd", Payload: "test"})
+	assert.False(result)
+	assert.NoError(err)
+}
+
+func TestDuplicateWithTopic(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	options := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.LockTTL),
+	}
+
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/t/%2Ful%2Fkey%2Fdev1%2Fattrs/"+identityKey("test"), "mutexID", options).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/t/%2Ful%2Fkey%2Fdev1%2Fattrs/"+identityKey("test"), nil).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/t/%2Ful%2Fkey%2Fdev1%2Fattrs/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+	)
+	result, err := checker.IsDuplicate(Message{Topic: "/ul/key/dev1/attrs", Payload: "test"})
+	assert.True(result)
+	assert.NoError(err)
+}
+
+func TestPayloadTypeRule(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	config.TopicPolicies = []conf.TopicPolicy{
+		{Filter: "/ul/#", PayloadType: payload.UltraLight},
+	}
+	holder := conf.NewHolder(config)
+	checker, err := NewChecker(holder)
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	testCases := []struct {
+		message  Message
+		expected string
+	}{
+		{message: Message{Payload: "t|25.3|h|40"}, expected: "-/n/" + identityKey("t|25.3|h|40")},
+		{message: Message{Payload: "t|25.3|h|40", PayloadType: payload.UltraLight}, expected: "-/n/" + identityKey("h|40|t|25.3")},
+		{message: Message{Topic: "/ul/key/dev1/attrs", Payload: "t|25.3|h|40"}, expected: "-/t/%2Ful%2Fkey%2Fdev1%2Fattrs/" + identityKey("h|40|t|25.3")},
+		{message: Message{Topic: "/ul/key/dev1/attrs", Payload: "t|25.3|h|40", PayloadType: payload.Raw}, expected: "-/t/%2Ful%2Fkey%2Fdev1%2Fattrs/" + identityKey("t|25.3|h|40")},
+	}
+	for _, testCase := range testCases {
+		r, err := checker.rule(testCase.message)
+		assert.NoError(err)
+		assert.Equal(testCase.expected, r.key)
+	}
+
+	ts := *config
+	ts.ExcludeTimestamp = true
+	holder.Set(&ts)
+	r, err := checker.rule(Message{Payload: "t|25.3|TimeInstant|2018-06-01T00:00:00Z", PayloadType: payload.UltraLight})
+	assert.NoError(err)
+	assert.Equal("-/n/"+identityKey("t|25.3"), r.key)
+
+	for _, message := range []Message{
+		{Payload: "t|25.3", PayloadType: "unknown"},
+		{Payload: "|25.3", PayloadType: payload.UltraLight},
+	} {
+		result, err := checker.IsDuplicate(message)
+		assert.True(result)
+		assert.IsType(&payload.Error{}, err)
+	}
+}
+
+func TestEncodingRule(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	checker, err := NewChecker(conf.NewHolder(conf.NewConfig()))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	testCases := []struct {
+		message  Message
+		expected string
+	}{
+		{message: Message{Payload: "AP8=", Encoding: EncodingBase64}, expected: "-/n/" + identityKey("\x00\xff")},
+		{message: Message{Payload: "dHwyNS4zfGh8NDA=", PayloadType: payload.UltraLight, Encoding: EncodingBase64}, expected: "-/n/" + identityKey("h|40|t|25.3")},
+		{message: Message{Topic: "/lora/dev1", Payload: "AP8=", Encoding: EncodingBase64}, expected: "-/t/%2Flora%2Fdev1/" + identityKey("\x00\xff")},
+		{message: Message{Payload: "AP8="}, expected: "-/n/" + identityKey("AP8=")},
+	}
+	for _, testCase := range testCases {
+		r, err := checker.rule(testCase.message)
+		assert.NoError(err)
+		assert.Equal(testCase.expected, r.key)
+	}
+
+	// the decoded frames differing only by "//" or "../" have their own keys
+	keys := map[string]string{}
+	for _, encoded := range []string{"AS8vAg==", "AS8C", "AS8uLi8C"} {
+		r, err := checker.rule(Message{Topic: "/lora/dev1", Payload: encoded, Encoding: EncodingBase64})
+		assert.NoError(err)
+		assert.Equal(r.key, path.Clean(r.key), encoded)
+		assert.NotContains(keys, r.key, encoded)
+		keys[r.key] = encoded
+	}
+
+	for _, message := range []Message{
+		{Payload: "AP8", Encoding: EncodingBase64},
+		{Payload: "AP8=", Encoding: "unknown"},
+	} {
+		result, err := checker.IsDuplicate(message)
+		assert.True(result)
+		assert.IsType(&payload.Error{}, err)
+	}
+	assert.True(ValidEncoding(""))
+	assert.True(ValidEncoding(EncodingBase64))
+	assert.False(ValidEncoding("unknown"))
+}
+
+func TestForget(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	keyNotFound := client.Error{
+		Code: client.ErrorCodeKeyNotFound,
+	}
+	raisedError := errors.New("error")
+
+	gomock.InOrder(
+		kapi.EXPECT().Delete(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, nil),
+		kapi.EXPECT().Delete(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Delete(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, raisedError),
 	)
-	result, err := checker.IsDuplicate("test")
+	assert.NoError(checker.Forget(Message{Payload: "test"}))
+	assert.NoError(checker.Forget(Message{Payload: "test"}))
+	assert.Equal(raisedError, checker.Forget(Message{Payload: "test"}))
+}
+
+func TestLimits(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	config.RateLimit = 100
+	config.InstanceQuota = 1000
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NoError(err)
+	rateLimit, quota := checker.Limits("smartcity")
+	assert.Equal(100, rateLimit)
+	assert.Equal(1000, quota)
+
+	// the settings stored in etcd take precedence over the Config
+	checker.settings = newSettingsWatcher("/config", nil)
+	s := newSettings()
+	s.global[rateLimitKey] = 10
+	s.services["smartcity"] = map[string]int{instanceQuotaKey: 0}
+	checker.settings.value.Store(s)
+	rateLimit, quota = checker.Limits("smartcity")
+	assert.Equal(10, rateLimit)
+	assert.Equal(0, quota)
+	rateLimit, quota = checker.Limits("other")
+	assert.Equal(10, rateLimit)
+	assert.Equal(1000, quota)
+}
+
+func TestFirstSeenOf(t *testing.T) {
+	assert := assert.New(t)
+
+	firstSeen := firstSeenOf(&client.Response{Node: &client.Node{Value: "2018-12-31T09:00:00.123+09:00"}})
+	assert.Equal(time.Date(2018, 12, 31, 0, 0, 0, 123000000, time.UTC), *firstSeen)
+
+	assert.Nil(firstSeenOf(nil))
+	assert.Nil(firstSeenOf(&client.Response{}))
+	// the data key written by the older version
+	assert.Nil(firstSeenOf(&client.Response{Node: &client.Node{Value: "duplicate"}}))
+}
+
+func TestPing(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	checker, err := NewChecker(conf.NewHolder(conf.NewConfig()))
+	assert.NoError(err)
+
+	raisedError := errors.New("error")
+	gomock.InOrder(
+		kapi.EXPECT().Get(context.Background(), "/health", nil).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/health", nil).Return(nil, client.Error{Code: client.ErrorCodeKeyNotFound}),
+		kapi.EXPECT().Get(context.Background(), "/health", nil).Return(nil, raisedError),
+	)
+	assert.NoError(checker.Ping(context.Background()))
+	assert.NoError(checker.Ping(context.Background()))
+	assert.Equal(raisedError, checker.Ping(context.Background()))
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NoError(err)
+
+	lockOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.LockTTL),
+	}
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+	)
+	result, err := checker.IsDuplicate(Message{Payload: "test"})
 	assert.True(result)
 	assert.NoError(err)
+
+	// no check is in process
+	assert.NoError(checker.Close(context.Background()))
+
+	result, err = checker.IsDuplicate(Message{Payload: "test"})
+	assert.True(result)
+	assert.Equal(ErrClosed, err)
+}
+
+func TestCloseReleasesLock(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NoError(err)
+
+	lockOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.LockTTL),
+	}
+	keyNotFound := client.Error{Code: client.ErrorCodeKeyNotFound}
+	locked := make(chan struct{})
+	blocked := make(chan struct{})
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/-/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/-/n/"+identityKey("test"), nil).DoAndReturn(
+			func(_ context.Context, _ string, _ *client.GetOptions) (*client.Response, error) {
+				close(locked)
+				<-blocked
+				return nil, nil
+			}),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/-/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, keyNotFound),
+	)
+	finished := make(chan error)
+	go func() {
+		_, err := checker.IsDuplicate(Message{Payload: "test"})
+		finished <- err
+	}()
+	<-locked
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, checker.Close(ctx))
+
+	close(blocked)
+	assert.NoError(<-finished)
 }
@@ -0,0 +1,120 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+// keysAPI : client.KeysAPI observing the latency and the errors of each etcd request.
+// The etcd requests keep their own contexts, and their spans are the children of parent.
+type keysAPI struct {
+	client.KeysAPI
+	parent context.Context
+}
+
+func newKeysAPI(parent context.Context, c client.Client) client.KeysAPI {
+	return &keysAPI{
+		KeysAPI: GetNewKeysAPI(c),
+		parent:  parent,
+	}
+}
+
+// withParent makes the spans of the etcd requests the children of parent.
+func withParent(kapi client.KeysAPI, parent context.Context) client.KeysAPI {
+	k, ok := kapi.(*keysAPI)
+	if !ok {
+		return kapi
+	}
+	return &keysAPI{
+		KeysAPI: k.KeysAPI,
+		parent:  parent,
+	}
+}
+
+func (k *keysAPI) Get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	start := time.Now()
+	span := k.startSpan("get", key)
+	resp, err := k.KeysAPI.Get(ctx, key, opts)
+	endSpan(span, err)
+	metrics.ObserveEtcd("get", start, err)
+	return resp, err
+}
+
+func (k *keysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	start := time.Now()
+	span := k.startSpan("set", key)
+	resp, err := k.KeysAPI.Set(ctx, key, value, opts)
+	endSpan(span, err)
+	metrics.ObserveEtcd("set", start, err)
+	return resp, err
+}
+
+func (k *keysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	start := time.Now()
+	span := k.startSpan("delete", key)
+	resp, err := k.KeysAPI.Delete(ctx, key, opts)
+	endSpan(span, err)
+	metrics.ObserveEtcd("delete", start, err)
+	return resp, err
+}
+
+func (k *keysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher {
+	return &watcher{
+		Watcher: k.KeysAPI.Watcher(key, opts),
+		kapi:    k,
+		key:     key,
+	}
+}
+
+func (k *keysAPI) startSpan(operation string, key string) trace.Span {
+	_, span := tracing.Tracer().Start(k.parent, "etcd."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", "etcd"),
+		attribute.String("db.operation", operation),
+		// the key is recorded as its hash like the logs, because it contains the service, the topic and the sha256 of the identity
+		attribute.String("etcd.key_hash", utils.HashKey(key)),
+	))
+	return span
+}
+
+// watcher : client.Watcher tracing the time to wait for each event.
+// The waiting time is not observed as the latency of etcd requests, because it is the lock contention.
+type watcher struct {
+	client.Watcher
+	kapi *keysAPI
+	key  string
+}
+
+func (w *watcher) Next(ctx context.Context) (*client.Response, error) {
+	span := w.kapi.startSpan("watch", w.key)
+	resp, err := w.Watcher.Next(ctx)
+	if resp != nil {
+		span.SetAttributes(attribute.String("etcd.action", resp.Action))
+	}
+	endSpan(span, err)
+	return resp, err
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		if e, ok := err.(client.Error); !ok || (e.Code != client.ErrorCodeKeyNotFound && e.Code != client.ErrorCodeNodeExist) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.RecordError(err)
+	}
+	span.End()
+}
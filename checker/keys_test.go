@@ -0,0 +1,42 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeysAPI(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	resp := &client.Response{Index: 1}
+	raisedError := errors.New("error")
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.Background(), "/key", "value", nil).Return(resp, nil),
+		kapi.EXPECT().Get(context.Background(), "/key", nil).Return(resp, nil),
+		kapi.EXPECT().Delete(context.Background(), "/key", nil).Return(nil, raisedError),
+	)
+
+	k := newKeysAPI(context.Background(), nil)
+	r, err := k.Set(context.Background(), "/key", "value", nil)
+	assert.Equal(resp, r)
+	assert.NoError(err)
+	r, err = k.Get(context.Background(), "/key", nil)
+	assert.Equal(resp, r)
+	assert.NoError(err)
+	r, err = k.Delete(context.Background(), "/key", nil)
+	assert.Nil(r)
+	assert.Equal(raisedError, err)
+}
@@ -15,7 +15,12 @@ import (
 	"time"
 
 	"github.com/coreos/etcd/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
 )
 
@@ -42,6 +47,7 @@ type mutex struct {
 	client client.Client
 	kapi   client.KeysAPI
 	ctx    context.Context
+	parent context.Context // The context of the caller, which is the parent of the spans
 	ttl    time.Duration
 	mutex  *sync.Mutex
 	logger *utils.Logger
@@ -50,7 +56,7 @@ type mutex struct {
 // newMutex creates a Mutex with the given key which must be the same
 // across the cluster nodes.
 // machines are the ectd cluster addresses
-func newMutex(key string, ttl int, c client.Client) (*mutex, error) {
+func newMutex(parent context.Context, key string, ttl int, c client.Client) (*mutex, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return nil, err
@@ -72,11 +78,12 @@ func newMutex(key string, ttl int, c client.Client) (*mutex, error) {
 		key:    key,
 		id:     GetMutexID(hostname),
 		client: c,
-		kapi:   GetNewKeysAPI(c),
+		kapi:   newKeysAPI(parent, c),
 		ctx:    context.TODO(),
+		parent: parent,
 		ttl:    time.Second * time.Duration(ttl),
 		mutex:  new(sync.Mutex),
-		logger: utils.NewLogger("mutex"),
+		logger: utils.NewLogger("mutex").WithContext(parent),
 	}, nil
 }
 
@@ -85,33 +92,57 @@ func newMutex(key string, ttl int, c client.Client) (*mutex, error) {
 // blocks until the mutex is available.
 func (m *mutex) Lock() (err error) {
 	m.mutex.Lock()
+	start := time.Now()
+	attempts := 0
+	ctx, span := tracing.Tracer().Start(m.parent, "mutex.Lock", trace.WithAttributes(attribute.String("lock.key_hash", utils.HashKey(m.key))))
+	defer func() {
+		// every attempt to create the node but the first is a retry
+		retries := 0
+		if attempts > 1 {
+			retries = attempts - 1
+		}
+		metrics.ObserveLock(start, retries)
+		span.SetAttributes(attribute.Int("lock.retries", retries))
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
 	for try := 1; try <= defaultTry; try++ {
-		err = m.lock()
+		tryCtx, trySpan := tracing.Tracer().Start(ctx, "mutex.lock", trace.WithAttributes(attribute.Int("lock.try", try)))
+		err = m.lock(withParent(m.kapi, tryCtx), &attempts)
+		if err != nil {
+			trySpan.RecordError(err)
+		}
+		trySpan.End()
 		if err == nil {
 			return nil
 		}
 
-		m.logger.Debugf("Lock node %v ERROR %v", m.key, err)
+		m.logger.Debugf("Lock node ERROR %v", err)
 		if try < defaultTry {
-			m.logger.Debugf("Try to lock node %v again", m.key, err)
+			m.logger.Debugf("Try to lock node again")
 		}
 	}
 	return err
 }
 
-func (m *mutex) lock() (err error) {
-	m.logger.Debugf("Trying to create a node : key=%v", m.key)
+// lock creates the node, and waits for the node deleted or expired while it exists.
+// attempts counts the attempts to create the node, including the ones again after waiting.
+func (m *mutex) lock(kapi client.KeysAPI, attempts *int) (err error) {
+	m.logger.Debugf("Trying to create a node")
 	setOptions := &client.SetOptions{
 		PrevExist: client.PrevNoExist,
 		TTL:       m.ttl,
 	}
 	for {
-		resp, err := m.kapi.Set(m.ctx, m.key, m.id, setOptions)
+		*attempts++
+		_, err := kapi.Set(m.ctx, m.key, m.id, setOptions)
 		if err == nil {
-			m.logger.Debugf("Create node %v (%v) OK [%q]", m.key, m.id, resp)
+			m.logger.Debugf("Create node (%v) OK", m.id)
 			return nil
 		}
-		m.logger.Debugf("Create node %v failed [%v]", m.key, err)
+		m.logger.Debugf("Create node failed [%v]", err)
 		e, ok := err.(client.Error)
 		if !ok {
 			return err
@@ -122,24 +153,24 @@ func (m *mutex) lock() (err error) {
 		}
 
 		// Get the already node's value.
-		resp, err = m.kapi.Get(m.ctx, m.key, nil)
+		resp, err := kapi.Get(m.ctx, m.key, nil)
 		if err != nil {
 			return err
 		}
-		m.logger.Debugf("Get node %v OK", m.key)
+		m.logger.Debugf("Get node OK")
 		watcherOptions := &client.WatcherOptions{
 			AfterIndex: resp.Index,
 			Recursive:  false,
 		}
-		watcher := m.kapi.Watcher(m.key, watcherOptions)
+		watcher := kapi.Watcher(m.key, watcherOptions)
 		for {
-			m.logger.Debugf("Watching %v ...", m.key)
+			m.logger.Debugf("Watching ...")
 			resp, err = watcher.Next(m.ctx)
 			if err != nil {
 				return err
 			}
 
-			m.logger.Debugf("Received an event : %q", resp)
+			m.logger.Debugf("Received an event : action=%v", resp.Action)
 			if resp.Action == deleteAction || resp.Action == expireAction {
 				// break this for-loop, and try to create the node again.
 				break
@@ -148,6 +179,20 @@ func (m *mutex) lock() (err error) {
 	}
 }
 
+// release deletes the lock key on behalf of the goroutine which locked m, without unlocking m.
+// The key is deleted only if it is still held by m, so the later Unlock does not delete the key locked by another instance.
+func (m *mutex) release() error {
+	_, err := m.kapi.Delete(m.ctx, m.key, &client.DeleteOptions{PrevValue: m.id})
+	if err != nil {
+		if notHeld(err) {
+			return nil
+		}
+		return err
+	}
+	m.logger.Infof("Released")
+	return nil
+}
+
 // Unlock unlocks m.
 // It is a run-time error if m is not locked on entry to Unlock.
 //
@@ -157,17 +202,22 @@ func (m *mutex) lock() (err error) {
 func (m *mutex) Unlock() (err error) {
 	defer m.mutex.Unlock()
 	for i := 1; i <= defaultTry; i++ {
-		var resp *client.Response
-		resp, err = m.kapi.Delete(m.ctx, m.key, nil)
+		// the key is deleted only if it is still held by m, because it may have been released and locked by another instance
+		_, err = m.kapi.Delete(m.ctx, m.key, &client.DeleteOptions{PrevValue: m.id})
 		if err == nil {
-			m.logger.Debugf("Delete %v OK", m.key)
+			m.logger.Debugf("Delete OK")
 			return nil
 		}
-		m.logger.Debugf("Delete %v falied: %q", m.key, resp)
-		e, ok := err.(client.Error)
-		if ok && e.Code == client.ErrorCodeKeyNotFound {
+		m.logger.Debugf("Delete falied: %v", err)
+		if notHeld(err) {
 			return nil
 		}
 	}
 	return err
 }
+
+// notHeld reports whether err means the key is already deleted or held by another mutex.
+func notHeld(err error) bool {
+	e, ok := err.(client.Error)
+	return ok && (e.Code == client.ErrorCodeKeyNotFound || e.Code == client.ErrorCodeTestFailed)
+}
@@ -7,6 +7,7 @@ Package checker : authorize and authenticate HTTP Request using HTTP Header.
 package checker
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -14,6 +15,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
 )
 
@@ -52,12 +54,25 @@ func setUpMutex(t *testing.T) (*setUpObj, func()) {
 	return obj, tearDown
 }
 
+// lockRetries returns msgfilter_lock_retries_total.
+func lockRetries(t *testing.T) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == "msgfilter_lock_retries_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
 func TestMutexLockSuccess(t *testing.T) {
 	assert := assert.New(t)
 	obj, tearDown := setUpMutex(t)
 	defer tearDown()
 
-	mutex, err := newMutex("key", 60, obj.client)
+	mutex, err := newMutex(context.Background(), "key", 60, obj.client)
 	assert.NotNil(mutex)
 	assert.NoError(err)
 
@@ -69,7 +84,7 @@ func TestMutexLockSuccess(t *testing.T) {
 	err = mutex.Lock()
 	assert.NoError(err)
 
-	obj.kapi.EXPECT().Delete(mutex.ctx, "/key", nil).Return(nil, nil)
+	obj.kapi.EXPECT().Delete(mutex.ctx, "/key", &client.DeleteOptions{PrevValue: mutex.id}).Return(nil, nil)
 	err = mutex.Unlock()
 	assert.NoError(err)
 }
@@ -79,7 +94,7 @@ func TestMutexLockSuccessAfterExpire(t *testing.T) {
 	obj, tearDown := setUpMutex(t)
 	defer tearDown()
 
-	mutex, err := newMutex("key", 60, obj.client)
+	mutex, err := newMutex(context.Background(), "key", 60, obj.client)
 	assert.NotNil(mutex)
 	assert.NoError(err)
 
@@ -109,10 +124,38 @@ func TestMutexLockSuccessAfterExpire(t *testing.T) {
 		watcher.EXPECT().Next(mutex.ctx).Return(resp, nil),
 		obj.kapi.EXPECT().Set(mutex.ctx, "/key", mutex.id, options).Return(nil, nil),
 	)
+	before := lockRetries(t)
 	err = mutex.Lock()
 	assert.NoError(err)
+	// waiting for the node expired is counted as a retry
+	assert.Equal(before+1, lockRetries(t))
 
-	obj.kapi.EXPECT().Delete(mutex.ctx, "/key", nil).Return(nil, nil)
+	obj.kapi.EXPECT().Delete(mutex.ctx, "/key", &client.DeleteOptions{PrevValue: mutex.id}).Return(nil, nil)
 	err = mutex.Unlock()
 	assert.NoError(err)
 }
+
+func TestMutexUnlockNotHeld(t *testing.T) {
+	assert := assert.New(t)
+	obj, tearDown := setUpMutex(t)
+	defer tearDown()
+
+	mutex, err := newMutex(context.Background(), "key", 60, obj.client)
+	assert.NotNil(mutex)
+	assert.NoError(err)
+
+	options := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(60),
+	}
+	for _, code := range []int{client.ErrorCodeTestFailed, client.ErrorCodeKeyNotFound} {
+		obj.kapi.EXPECT().Set(mutex.ctx, "/key", mutex.id, options).Return(nil, nil)
+		err = mutex.Lock()
+		assert.NoError(err)
+
+		// the key released and locked by another instance is not deleted
+		obj.kapi.EXPECT().Delete(mutex.ctx, "/key", &client.DeleteOptions{PrevValue: mutex.id}).Return(nil, client.Error{Code: code})
+		err = mutex.Unlock()
+		assert.NoError(err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// expiration : a data key and when it expires
+type expiration struct {
+	key     string
+	expires time.Time
+}
+
+// expirations : a min-heap of expiration ordered by the time to expire
+type expirations []expiration
+
+func (e expirations) Len() int            { return len(e) }
+func (e expirations) Less(i, j int) bool  { return e[i].expires.Before(e[j].expires) }
+func (e expirations) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *expirations) Push(x interface{}) { *e = append(*e, x.(expiration)) }
+func (e *expirations) Pop() interface{} {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+// tenantKeys : the live data keys of a Fiware-Service.
+// The keys without TTL never expire, so they have the zero time and are not pushed to the heap.
+// The heap may have the stale entries of the keys forgotten or created again, which are skipped when popped.
+type tenantKeys struct {
+	keys map[string]time.Time
+	heap expirations
+}
+
+// prune forgets the keys expired at current.
+func (t *tenantKeys) prune(current time.Time) {
+	for t.heap.Len() != 0 {
+		oldest := t.heap[0]
+		expires, live := t.keys[oldest.key]
+		if live && expires.Equal(oldest.expires) && current.Before(expires) {
+			break
+		}
+		heap.Pop(&t.heap)
+		if live && expires.Equal(oldest.expires) {
+			delete(t.keys, oldest.key)
+		}
+	}
+}
+
+// instanceKeys : the data keys created by this instance and not expired yet, for each Fiware-Service.
+// They are neither shared with the other instances nor kept over restart, so INSTANCE_QUOTA is an admission limit of each instance.
+type instanceKeys struct {
+	mutex   sync.Mutex
+	tenants map[string]*tenantKeys
+}
+
+func newInstanceKeys() *instanceKeys {
+	return &instanceKeys{
+		tenants: map[string]*tenantKeys{},
+	}
+}
+
+// add counts the key which expires after ttl (0 means never), and forgets the keys already expired.
+func (l *instanceKeys) add(service string, key string, ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t, ok := l.tenants[service]
+	if !ok {
+		t = &tenantKeys{keys: map[string]time.Time{}}
+		l.tenants[service] = t
+	}
+	current := now()
+	t.prune(current)
+	if ttl == 0 {
+		t.keys[key] = time.Time{}
+		return
+	}
+	expires := current.Add(ttl)
+	t.keys[key] = expires
+	heap.Push(&t.heap, expiration{key: key, expires: expires})
+}
+
+func (l *instanceKeys) remove(service string, key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if t, ok := l.tenants[service]; ok {
+		delete(t.keys, key)
+	}
+}
+
+// count returns the number of the live keys of the service, and when the oldest of them expires.
+// The time is zero when none of them expires.
+func (l *instanceKeys) count(service string) (int, time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	t, ok := l.tenants[service]
+	if !ok {
+		return 0, time.Time{}
+	}
+	t.prune(now())
+	if len(t.keys) == 0 {
+		delete(l.tenants, service)
+		return 0, time.Time{}
+	}
+	if t.heap.Len() == 0 {
+		return len(t.keys), time.Time{}
+	}
+	return len(t.keys), t.heap[0].expires
+}
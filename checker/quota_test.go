@@ -0,0 +1,86 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceKeys(t *testing.T) {
+	assert := assert.New(t)
+	current := time.Date(2018, 12, 31, 18, 0, 0, 0, time.UTC)
+	original := now
+	now = func() time.Time { return current }
+	defer func() { now = original }()
+
+	l := newInstanceKeys()
+	count, _ := l.count("smartcity")
+	assert.Equal(0, count)
+
+	l.add("smartcity", "/data/a", time.Second*30)
+	l.add("smartcity", "/data/b", time.Second*10)
+	l.add("smartcity", "/data/c", time.Second*20)
+	l.add("other", "/data/a", time.Second*5)
+	count, oldest := l.count("smartcity")
+	assert.Equal(3, count)
+	assert.Equal(current.Add(time.Second*10), oldest)
+
+	// the forgotten key is not counted, and the next oldest expires next
+	l.remove("smartcity", "/data/b")
+	count, oldest = l.count("smartcity")
+	assert.Equal(2, count)
+	assert.Equal(current.Add(time.Second*20), oldest)
+
+	// the key created again after forgotten expires by the new TTL
+	l.add("smartcity", "/data/b", time.Second*40)
+	current = current.Add(time.Second * 20)
+	count, oldest = l.count("smartcity")
+	assert.Equal(2, count)
+	assert.Equal(current.Add(time.Second*10), oldest)
+
+	current = current.Add(time.Second * 20)
+	count, _ = l.count("smartcity")
+	assert.Equal(0, count)
+	count, _ = l.count("other")
+	assert.Equal(0, count)
+	assert.Len(l.tenants, 0)
+}
+
+func TestInstanceKeysPrune(t *testing.T) {
+	assert := assert.New(t)
+	current := time.Date(2018, 12, 31, 18, 0, 0, 0, time.UTC)
+	original := now
+	now = func() time.Time { return current }
+	defer func() { now = original }()
+
+	// the expired keys are forgotten on add without count
+	l := newInstanceKeys()
+	for i := 0; i < 100; i++ {
+		l.add("smartcity", fmt.Sprintf("/data/%d", i), time.Second)
+		current = current.Add(time.Second)
+	}
+	assert.Len(l.tenants["smartcity"].keys, 1)
+	assert.Len(l.tenants["smartcity"].heap, 1)
+
+	// the keys without TTL never expire
+	l.add("smartcity", "/data/forever", 0)
+	current = current.Add(time.Hour)
+	count, oldest := l.count("smartcity")
+	assert.Equal(1, count)
+	assert.True(oldest.IsZero())
+	l.add("smartcity", "/data/a", time.Second*10)
+	count, oldest = l.count("smartcity")
+	assert.Equal(2, count)
+	assert.Equal(current.Add(time.Second*10), oldest)
+	l.remove("smartcity", "/data/forever")
+	count, _ = l.count("smartcity")
+	assert.Equal(1, count)
+}
@@ -0,0 +1,204 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/etcd/client"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	lockTTLKey       = "LOCK_TTL"
+	dataTTLKey       = "DATA_TTL"
+	rateLimitKey     = "RATE_LIMIT"
+	instanceQuotaKey = "INSTANCE_QUOTA"
+	servicesDir      = "services"
+	retryInterval    = time.Second * 5
+)
+
+// settingKeys : the keys of the settings which can be stored in etcd
+var settingKeys = map[string]bool{
+	lockTTLKey:       true,
+	dataTTLKey:       true,
+	rateLimitKey:     true,
+	instanceQuotaKey: true,
+}
+
+// settings : runtime settings stored under CONFIG_PREFIX of etcd.
+// global holds the settings applied to all Fiware-Services,
+// and services holds the overrides of each Fiware-Service.
+type settings struct {
+	global   map[string]int
+	services map[string]map[string]int
+}
+
+func newSettings() *settings {
+	return &settings{
+		global:   map[string]int{},
+		services: map[string]map[string]int{},
+	}
+}
+
+// get returns the setting of key for service.
+// The override of the service takes precedence over the global setting,
+// and def is returned when neither of them is stored.
+func (s *settings) get(service string, key string, def int) int {
+	if v, ok := s.services[service][key]; ok {
+		return v
+	}
+	if v, ok := s.global[key]; ok {
+		return v
+	}
+	return def
+}
+
+// settingsWatcher keeps the settings up to date by watching CONFIG_PREFIX of etcd.
+type settingsWatcher struct {
+	prefix string
+	kapi   client.KeysAPI
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	value  atomic.Value
+	logger *utils.Logger
+}
+
+func newSettingsWatcher(prefix string, c client.Client) *settingsWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &settingsWatcher{
+		prefix: prefix,
+		kapi:   GetNewKeysAPI(c),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		logger: utils.NewLogger("settings"),
+	}
+	w.value.Store(newSettings())
+	return w
+}
+
+func (w *settingsWatcher) get() *settings {
+	return w.value.Load().(*settings)
+}
+
+// start loads the settings and watches the changes of them in background until stop is called.
+func (w *settingsWatcher) start() {
+	index, err := w.load()
+	if err != nil {
+		w.logger.Errorf("load settings failed: %s", err.Error())
+	}
+	go func() {
+		defer close(w.done)
+		for {
+			index, err = w.watch(index)
+			if w.ctx.Err() != nil {
+				return
+			}
+			w.logger.Errorf("watch %v failed: %s", w.prefix, err.Error())
+			select {
+			case <-time.After(retryInterval):
+			case <-w.ctx.Done():
+				return
+			}
+			index, err = w.load()
+			if err != nil {
+				w.logger.Errorf("load settings failed: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// stop cancels the watch started by start, and waits for it to finish.
+func (w *settingsWatcher) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// load reads all settings under the prefix, and returns the etcd index to start watching from.
+func (w *settingsWatcher) load() (uint64, error) {
+	resp, err := w.kapi.Get(w.ctx, w.prefix, &client.GetOptions{Recursive: true})
+	if err != nil {
+		e, ok := err.(client.Error)
+		if !ok || e.Code != client.ErrorCodeKeyNotFound {
+			return 0, err
+		}
+		w.value.Store(newSettings())
+		w.logger.Infof("no settings under %v", w.prefix)
+		return e.Index, nil
+	}
+
+	s := newSettings()
+	w.parse(s, resp.Node)
+	w.value.Store(s)
+	w.logger.Infof("settings loaded: global=%v, services=%v", s.global, s.services)
+	return resp.Index, nil
+}
+
+func (w *settingsWatcher) parse(s *settings, node *client.Node) {
+	if node == nil {
+		return
+	}
+	if node.Dir {
+		for _, n := range node.Nodes {
+			w.parse(s, n)
+		}
+		return
+	}
+
+	path := strings.Split(strings.TrimPrefix(node.Key, w.prefix+"/"), "/")
+	key := path[len(path)-1]
+	if !settingKeys[key] {
+		w.logger.Warnf("unknown setting ignored: %v", node.Key)
+		return
+	}
+	v, err := strconv.Atoi(node.Value)
+	if err != nil || v < 0 {
+		w.logger.Warnf("invalid setting ignored: %v=%q", node.Key, node.Value)
+		return
+	}
+
+	switch {
+	case len(path) == 1:
+		s.global[key] = v
+	case len(path) == 3 && path[0] == servicesDir:
+		service := path[1]
+		if _, ok := s.services[service]; !ok {
+			s.services[service] = map[string]int{}
+		}
+		s.services[service][key] = v
+	default:
+		w.logger.Warnf("unknown setting ignored: %v", node.Key)
+	}
+}
+
+// watch blocks until an error is raised, reloading the settings whenever a key under the prefix is changed.
+func (w *settingsWatcher) watch(index uint64) (uint64, error) {
+	for {
+		watcherOptions := &client.WatcherOptions{
+			AfterIndex: index,
+			Recursive:  true,
+		}
+		watcher := w.kapi.Watcher(w.prefix, watcherOptions)
+		w.logger.Debugf("Watching %v ...", w.prefix)
+		resp, err := watcher.Next(w.ctx)
+		if err != nil {
+			return index, err
+		}
+		w.logger.Debugf("Received an event : %q", resp)
+		index, err = w.load()
+		if err != nil {
+			return index, err
+		}
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Package checker : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package checker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+func settingsResponse(index uint64) *client.Response {
+	return &client.Response{
+		Action: "get",
+		Index:  index,
+		Node: &client.Node{
+			Key: "/config",
+			Dir: true,
+			Nodes: client.Nodes{
+				{Key: "/config/LOCK_TTL", Value: "5"},
+				{Key: "/config/DATA_TTL", Value: "invalid"},
+				{Key: "/config/UNKNOWN", Value: "1"},
+				{
+					Key: "/config/services",
+					Dir: true,
+					Nodes: client.Nodes{
+						{
+							Key: "/config/services/smartcity",
+							Dir: true,
+							Nodes: client.Nodes{
+								{Key: "/config/services/smartcity/DATA_TTL", Value: "30"},
+								{Key: "/config/services/smartcity/INSTANCE_QUOTA", Value: "100"},
+							},
+						},
+						{Key: "/config/services/LOCK_TTL", Value: "1"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestSettingsGet(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSettings()
+	assert.Equal(10, s.get("smartcity", lockTTLKey, 10))
+
+	s.global[lockTTLKey] = 5
+	s.services["smartcity"] = map[string]int{dataTTLKey: 30}
+	assert.Equal(5, s.get("smartcity", lockTTLKey, 10))
+	assert.Equal(30, s.get("smartcity", dataTTLKey, 600))
+	assert.Equal(600, s.get("other", dataTTLKey, 600))
+	assert.Equal(5, s.get("", lockTTLKey, 10))
+}
+
+func TestSettingsLoad(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	w := newSettingsWatcher("/config", nil)
+	options := &client.GetOptions{Recursive: true}
+
+	kapi.EXPECT().Get(w.ctx, "/config", options).Return(settingsResponse(7), nil)
+	index, err := w.load()
+	assert.NoError(err)
+	assert.Equal(uint64(7), index)
+	assert.Equal(map[string]int{lockTTLKey: 5}, w.get().global)
+	assert.Equal(map[string]map[string]int{"smartcity": {dataTTLKey: 30, instanceQuotaKey: 100}}, w.get().services)
+
+	keyNotFound := client.Error{
+		Code:  client.ErrorCodeKeyNotFound,
+		Index: 8,
+	}
+	kapi.EXPECT().Get(w.ctx, "/config", options).Return(nil, keyNotFound)
+	index, err = w.load()
+	assert.NoError(err)
+	assert.Equal(uint64(8), index)
+	assert.Equal(newSettings(), w.get())
+
+	raisedError := errors.New("error")
+	kapi.EXPECT().Get(w.ctx, "/config", options).Return(nil, raisedError)
+	_, err = w.load()
+	assert.Equal(raisedError, err)
+	assert.Equal(newSettings(), w.get())
+}
+
+func TestSettingsWatch(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	w := newSettingsWatcher("/config", nil)
+	options := &client.GetOptions{Recursive: true}
+	watcher := mock.NewMockWatcher(gomock.NewController(t))
+	raisedError := errors.New("error")
+
+	gomock.InOrder(
+		kapi.EXPECT().Watcher("/config", &client.WatcherOptions{AfterIndex: 1, Recursive: true}).Return(watcher),
+		watcher.EXPECT().Next(w.ctx).Return(&client.Response{Action: "set"}, nil),
+		kapi.EXPECT().Get(w.ctx, "/config", options).Return(settingsResponse(2), nil),
+		kapi.EXPECT().Watcher("/config", &client.WatcherOptions{AfterIndex: 2, Recursive: true}).Return(watcher),
+		watcher.EXPECT().Next(w.ctx).Return(nil, raisedError),
+	)
+	index, err := w.watch(1)
+	assert.Equal(uint64(2), index)
+	assert.Equal(raisedError, err)
+	assert.Equal(map[string]int{lockTTLKey: 5}, w.get().global)
+}
+
+func TestDuplicateWithSettings(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	config.ConfigPrefix = "/config"
+	watcher := mock.NewMockWatcher(gomock.NewController(t))
+	blocked := make(chan struct{})
+	defer close(blocked)
+
+	kapi.EXPECT().Get(gomock.Any(), "/config", &client.GetOptions{Recursive: true}).Return(settingsResponse(1), nil)
+	kapi.EXPECT().Watcher("/config", &client.WatcherOptions{AfterIndex: 1, Recursive: true}).Return(watcher).AnyTimes()
+	watcher.EXPECT().Next(gomock.Any()).DoAndReturn(func(_ context.Context) (*client.Response, error) {
+		<-blocked
+		return nil, errors.New("closed")
+	}).AnyTimes()
+
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NotNil(checker)
+	assert.NoError(err)
+
+	lockOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(5),
+	}
+	dataOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(30),
+	}
+	keyNotFound := client.Error{
+		Code: client.ErrorCodeKeyNotFound,
+	}
+
+	gomock.InOrder(
+		kapi.EXPECT().Set(context.TODO(), "/lock/smartcity/n/"+identityKey("test"), "mutexID", lockOptions).Return(nil, nil),
+		kapi.EXPECT().Get(context.Background(), "/data/smartcity/n/"+identityKey("test"), nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Set(context.Background(), "/data/smartcity/n/"+identityKey("test"), gomock.Any(), dataOptions).Return(nil, nil),
+		kapi.EXPECT().Delete(context.TODO(), "/lock/smartcity/n/"+identityKey("test"), &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+	)
+	result, err := checker.IsDuplicate(Message{Service: "smartcity", Payload: "test"})
+	assert.False(result)
+	assert.NoError(err)
+}
+
+func TestCloseStopsSettingsWatcher(t *testing.T) {
+	assert := assert.New(t)
+	kapi, tearDown := setUpChecker(t)
+	defer tearDown()
+
+	config := conf.NewConfig()
+	config.ConfigPrefix = "/config"
+	watcher := mock.NewMockWatcher(gomock.NewController(t))
+
+	kapi.EXPECT().Get(gomock.Any(), "/config", &client.GetOptions{Recursive: true}).Return(settingsResponse(1), nil)
+	kapi.EXPECT().Watcher("/config", &client.WatcherOptions{AfterIndex: 1, Recursive: true}).Return(watcher)
+	watcher.EXPECT().Next(gomock.Any()).DoAndReturn(func(ctx context.Context) (*client.Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	checker, err := NewChecker(conf.NewHolder(config))
+	assert.NoError(err)
+
+	assert.NoError(checker.Close(context.Background()))
+	select {
+	case <-checker.settings.done:
+	default:
+		assert.Fail("the settings watcher is still running")
+	}
+}
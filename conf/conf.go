@@ -7,63 +7,650 @@ Package conf : configuration variables
 package conf
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	listenPort                  = "LISTEN_PORT"
+	defaultListenPort           = "5001"
+	etcdEndpoint                = "ETCD_ENDPOINT"
+	defaultEtcdEndpoint         = "http://127.0.0.1:2379"
+	etcdEndpointRe              = `http://.+:(\d+)`
+	lockTTL                     = "LOCK_TTL"
+	defaultLockTTL              = "10"
+	dataTTL                     = "DATA_TTL"
+	defaultDataTTL              = "600"
+	configFile                  = "CONFIG_FILE"
+	defaultConfigFile           = ""
+	configWatchInterval         = "CONFIG_WATCH_INTERVAL"
+	defaultConfigWatchInterval  = "5"
+	configPrefix                = "CONFIG_PREFIX"
+	defaultConfigPrefix         = ""
+	mqttBroker                  = "MQTT_BROKER"
+	defaultMqttBroker           = ""
+	mqttClientID                = "MQTT_CLIENT_ID"
+	defaultMqttClientID         = "fiware-mqtt-msgfilter"
+	mqttUsername                = "MQTT_USERNAME"
+	mqttPassword                = "MQTT_PASSWORD"
+	mqttTopics                  = "MQTT_TOPICS"
+	defaultMqttTopics           = ""
+	mqttOnError                 = "MQTT_ON_ERROR"
+	defaultMqttOnError          = MqttOnErrorDrop
+	topicPolicies               = "TOPIC_POLICIES"
+	excludeTimestamp            = "EXCLUDE_TIMESTAMP"
+	defaultExcludeTimestamp     = "false"
+	orionURL                    = "ORION_URL"
+	defaultOrionURL             = ""
+	orionDuplicateStatus        = "ORION_DUPLICATE_STATUS"
+	defaultOrionDuplicateStatus = "204"
+	orionDuplicateBody          = "ORION_DUPLICATE_BODY"
+	defaultOrionDuplicateBody   = ""
+	metricsTenantLabel          = "METRICS_TENANT_LABEL"
+	defaultMetricsTenantLabel   = "false"
+	metricsTenantLimit          = "METRICS_TENANT_LIMIT"
+	defaultMetricsTenantLimit   = "100"
+	tracingExporter             = "TRACING_EXPORTER"
+	defaultTracingExporter      = ""
+	tracingEndpoint             = "TRACING_ENDPOINT"
+	defaultTracingEndpoint      = ""
+	tracingServiceName          = "TRACING_SERVICE_NAME"
+	defaultTracingServiceName   = "fiware-mqtt-msgfilter"
+	logFormat                   = "LOG_FORMAT"
+	defaultLogFormat            = utils.LogFormatText
+	logLevel                    = "LOG_LEVEL"
+	defaultLogLevel             = utils.LogLevelDebug
+	logPayload                  = "LOG_PAYLOAD"
+	defaultLogPayload           = utils.PayloadRedact
+	logPayloadMaxLength         = "LOG_PAYLOAD_MAX_LENGTH"
+	defaultLogPayloadMaxLength  = "32"
+	accessLogSampleRate         = "ACCESS_LOG_SAMPLE_RATE"
+	defaultAccessLogSampleRate  = "1"
+	accessLogSkipPaths          = "ACCESS_LOG_SKIP_PATHS"
+	defaultAccessLogSkipPaths   = "/healthz,/readyz,/metrics"
+	instanceID                  = "INSTANCE_ID"
+	auditSink                   = "AUDIT_SINK"
+	defaultAuditSink            = ""
+	auditFile                   = "AUDIT_FILE"
+	defaultAuditFile            = "audit.jsonl"
+	auditMaxSize                = "AUDIT_MAX_SIZE"
+	defaultAuditMaxSize         = "100"
+	auditMaxBackups             = "AUDIT_MAX_BACKUPS"
+	defaultAuditMaxBackups      = "5"
+	auditBufferSize             = "AUDIT_BUFFER_SIZE"
+	defaultAuditBufferSize      = "1024"
+	readinessTimeout            = "READINESS_TIMEOUT"
+	defaultReadinessTimeout     = "1000"
+	shutdownGracePeriod         = "SHUTDOWN_GRACE_PERIOD"
+	defaultShutdownGracePeriod  = "20"
+	tlsCertFile                 = "TLS_CERT_FILE"
+	tlsKeyFile                  = "TLS_KEY_FILE"
+	tlsClientCAFile             = "TLS_CLIENT_CA_FILE"
+	tlsClientAuth               = "TLS_CLIENT_AUTH"
+	defaultTLSClientAuth        = TLSClientAuthRequire
+	authFile                    = "AUTH_FILE"
+	authHMACMaxSkew             = "AUTH_HMAC_MAX_SKEW"
+	defaultAuthHMACMaxSkew      = "300"
+	pepIdMURL                   = "PEP_IDM_URL"
+	defaultPepIdMURL            = ""
+	pepIdMType                  = "PEP_IDM_TYPE"
+	defaultPepIdMType           = PepKeystone
+	pepCacheTTL                 = "PEP_CACHE_TTL"
+	defaultPepCacheTTL          = "60"
+	rateLimit                   = "RATE_LIMIT"
+	defaultRateLimit            = "0"
+	rateLimitBurst              = "RATE_LIMIT_BURST"
+	defaultRateLimitBurst       = "0"
+	trustedProxies              = "TRUSTED_PROXIES"
+	instanceQuota               = "INSTANCE_QUOTA"
+	defaultInstanceQuota        = "0"
+	maxBodySize                 = "MAX_BODY_SIZE"
+	defaultMaxBodySize          = "1048576"
+	maxPayloadLength            = "MAX_PAYLOAD_LENGTH"
+	defaultMaxPayloadLength     = "65536"
+	validateUTF8                = "VALIDATE_UTF8"
+	defaultValidateUTF8         = "false"
+	grpcPort                    = "GRPC_PORT"
+	defaultGRPCPort             = ""
+	streamConcurrency           = "STREAM_CONCURRENCY"
+	defaultStreamConcurrency    = "8"
 )
 
 const (
-	listenPort          = "LISTEN_PORT"
-	defaultListenPort   = "5001"
-	etcdEndpoint        = "ETCD_ENDPOINT"
-	defaultEtcdEndpoint = "http://127.0.0.1:2379"
-	etcdEndpointRe      = `http://.+:(\d+)`
-	lockTTL             = "LOCK_TTL"
-	defaultLockTTL      = "10"
-	dataTTL             = "DATA_TTL"
-	defaultDataTTL      = "600"
+	// TracingOTLP : export the spans to OpenTelemetry Collector by OTLP/HTTP
+	TracingOTLP = "otlp"
+	// TracingStdout : write the spans to stdout for local testing
+	TracingStdout = "stdout"
+	// AuditFile : write the audit records to the rotating file
+	AuditFile = "file"
+	// AuditStdout : write the audit records to stdout
+	AuditStdout = "stdout"
+	// TLSClientAuthRequire : reject the clients without a certificate signed by TLS_CLIENT_CA_FILE
+	TLSClientAuthRequire = "require"
+	// TLSClientAuthOptional : verify the client certificate only if given
+	TLSClientAuthOptional = "optional"
+	// PepKeystone : validate X-Auth-Token by Keystone identity API v3
+	PepKeystone = "keystone"
+	// PepKeyrock : validate X-Auth-Token by Keyrock OAuth2 user info
+	PepKeyrock = "keyrock"
+	// MqttOnErrorDrop : drop the message whose duplication could not be checked
+	MqttOnErrorDrop = "drop"
+	// MqttOnErrorRepublish : republish the message whose duplication could not be checked
+	MqttOnErrorRepublish = "republish"
 )
 
 /*
 Config : a struct to hold configuration variables
 */
 type Config struct {
-	ListenPort   string
-	EtcdEndpoint string
-	LockTTL      int
-	DataTTL      int
+	ListenPort           string
+	EtcdEndpoint         string
+	LockTTL              int
+	DataTTL              int
+	ConfigFile           string
+	ConfigWatchInterval  int
+	ConfigPrefix         string
+	MqttBroker           string
+	MqttClientID         string
+	MqttUsername         string
+	MqttPassword         string
+	MqttTopics           string
+	MqttOnError          string
+	TopicPolicies        []TopicPolicy
+	ExcludeTimestamp     bool
+	OrionURL             string
+	OrionDuplicateStatus int
+	OrionDuplicateBody   string
+	MetricsTenantLabel   bool
+	MetricsTenantLimit   int
+	TracingExporter      string
+	TracingEndpoint      string
+	TracingServiceName   string
+	LogFormat            string
+	LogLevel             string
+	LogPayload           string
+	LogPayloadMaxLength  int
+	AccessLogSampleRate  float64
+	AccessLogSkipPaths   []string
+	InstanceID           string
+	AuditSink            string
+	AuditFile            string
+	AuditMaxSize         int
+	AuditMaxBackups      int
+	AuditBufferSize      int
+	ReadinessTimeout     int
+	ShutdownGracePeriod  int
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSClientCAFile      string
+	TLSClientAuth        string
+	AuthFile             string
+	AuthHMACMaxSkew      int // the signed request can be replayed within this window, because the nonces are not kept
+	PepIdMURL            string
+	PepIdMType           string
+	PepCacheTTL          int
+	RateLimit            int
+	RateLimitBurst       int
+	TrustedProxies       []string
+	InstanceQuota        int
+	MaxBodySize          int
+	MaxPayloadLength     int
+	ValidateUTF8         bool
+	GRPCPort             string
+	StreamConcurrency    int
+}
+
+/*
+TopicPolicy : a struct to hold the duplication check policy of the MQTT topics matched with Filter
+	ScopeTopic  : whether the topic is a part of the duplication key (nil means true)
+	DataTTL     : expire second(s) for data of the topic (nil means not overridden)
+	Skip        : whether the duplication check is skipped for the topic
+	PayloadType : how to compute the identity of the payload (empty means raw)
+*/
+type TopicPolicy struct {
+	Filter      string `json:"filter"`
+	ScopeTopic  *bool  `json:"scopeTopic,omitempty"`
+	DataTTL     *int   `json:"dataTTL,omitempty"`
+	Skip        bool   `json:"skip,omitempty"`
+	PayloadType string `json:"payloadType,omitempty"`
 }
 
 /*
 NewConfig : a factory method to create Config.
 */
 func NewConfig() *Config {
-	port := os.Getenv(listenPort)
+	port, err := toListenPort(os.Getenv(listenPort))
+	if err != nil {
+		port = ":" + defaultListenPort
+	}
+
+	etcdEndpoint, err := toEtcdEndpoint(os.Getenv(etcdEndpoint))
+	if err != nil {
+		etcdEndpoint = defaultEtcdEndpoint
+	}
+
+	configFile := os.Getenv(configFile)
+	if len(configFile) == 0 {
+		configFile = defaultConfigFile
+	}
+
+	policies, err := toTopicPolicies(os.Getenv(topicPolicies))
+	if err != nil {
+		policies = nil
+	}
+
+	orionURL, err := toHTTPURL(os.Getenv(orionURL))
+	if err != nil {
+		orionURL = defaultOrionURL
+	}
+
+	duplicateStatus, err := toStatusCode(os.Getenv(orionDuplicateStatus))
+	if err != nil {
+		duplicateStatus, _ = toStatusCode(defaultOrionDuplicateStatus)
+	}
+
+	tracingEndpoint, err := toHTTPURL(os.Getenv(tracingEndpoint))
+	if err != nil {
+		tracingEndpoint = defaultTracingEndpoint
+	}
+
+	grpcPort, err := toGRPCPort(os.Getenv(grpcPort))
+	if err != nil {
+		grpcPort = defaultGRPCPort
+	}
+
+	pepIdMURL, err := toHTTPURL(os.Getenv(pepIdMURL))
+	if err != nil {
+		pepIdMURL = defaultPepIdMURL
+	}
+
+	trustedProxies, err := toAddresses(os.Getenv(trustedProxies))
+	if err != nil {
+		trustedProxies = []string{}
+	}
+
+	instanceID := envToString(instanceID, "")
+	if len(instanceID) == 0 {
+		instanceID, _ = os.Hostname()
+	}
+
+	configPrefix := strings.TrimRight(os.Getenv(configPrefix), "/")
+	if len(configPrefix) == 0 {
+		configPrefix = defaultConfigPrefix
+	} else if configPrefix[0] != '/' {
+		configPrefix = "/" + configPrefix
+	}
+
+	return &Config{
+		ListenPort:           port,
+		EtcdEndpoint:         etcdEndpoint,
+		LockTTL:              envToPositiveInt(lockTTL, defaultLockTTL),
+		DataTTL:              envToPositiveInt(dataTTL, defaultDataTTL),
+		ConfigFile:           configFile,
+		ConfigWatchInterval:  envToPositiveInt(configWatchInterval, defaultConfigWatchInterval),
+		ConfigPrefix:         configPrefix,
+		MqttBroker:           envToString(mqttBroker, defaultMqttBroker),
+		MqttClientID:         envToString(mqttClientID, defaultMqttClientID),
+		MqttUsername:         os.Getenv(mqttUsername),
+		MqttPassword:         os.Getenv(mqttPassword),
+		MqttTopics:           envToString(mqttTopics, defaultMqttTopics),
+		MqttOnError:          envToChoice(mqttOnError, defaultMqttOnError, MqttOnErrorDrop, MqttOnErrorRepublish),
+		TopicPolicies:        policies,
+		ExcludeTimestamp:     envToBool(excludeTimestamp, defaultExcludeTimestamp),
+		OrionURL:             orionURL,
+		OrionDuplicateStatus: duplicateStatus,
+		OrionDuplicateBody:   envToString(orionDuplicateBody, defaultOrionDuplicateBody),
+		MetricsTenantLabel:   envToBool(metricsTenantLabel, defaultMetricsTenantLabel),
+		MetricsTenantLimit:   envToPositiveInt(metricsTenantLimit, defaultMetricsTenantLimit),
+		TracingExporter:      envToChoice(tracingExporter, defaultTracingExporter, TracingOTLP, TracingStdout),
+		TracingEndpoint:      tracingEndpoint,
+		TracingServiceName:   envToString(tracingServiceName, defaultTracingServiceName),
+		LogFormat:            envToChoice(logFormat, defaultLogFormat, utils.LogFormatText, utils.LogFormatJSON),
+		LogLevel:             envToChoice(logLevel, defaultLogLevel, utils.LogLevelDebug, utils.LogLevelInfo, utils.LogLevelWarn, utils.LogLevelError),
+		LogPayload:           envToChoice(logPayload, defaultLogPayload, utils.PayloadFull, utils.PayloadTruncate, utils.PayloadRedact),
+		LogPayloadMaxLength:  envToPositiveInt(logPayloadMaxLength, defaultLogPayloadMaxLength),
+		AccessLogSampleRate:  envToRate(accessLogSampleRate, defaultAccessLogSampleRate),
+		AccessLogSkipPaths:   toList(envToString(accessLogSkipPaths, defaultAccessLogSkipPaths)),
+		InstanceID:           instanceID,
+		AuditSink:            envToChoice(auditSink, defaultAuditSink, AuditFile, AuditStdout),
+		AuditFile:            envToString(auditFile, defaultAuditFile),
+		AuditMaxSize:         envToPositiveInt(auditMaxSize, defaultAuditMaxSize),
+		AuditMaxBackups:      envToPositiveInt(auditMaxBackups, defaultAuditMaxBackups),
+		AuditBufferSize:      envToPositiveInt(auditBufferSize, defaultAuditBufferSize),
+		ReadinessTimeout:     envToPositiveInt(readinessTimeout, defaultReadinessTimeout),
+		ShutdownGracePeriod:  envToPositiveInt(shutdownGracePeriod, defaultShutdownGracePeriod),
+		TLSCertFile:          os.Getenv(tlsCertFile),
+		TLSKeyFile:           os.Getenv(tlsKeyFile),
+		TLSClientCAFile:      os.Getenv(tlsClientCAFile),
+		TLSClientAuth:        envToChoice(tlsClientAuth, defaultTLSClientAuth, TLSClientAuthRequire, TLSClientAuthOptional),
+		AuthFile:             os.Getenv(authFile),
+		AuthHMACMaxSkew:      envToPositiveInt(authHMACMaxSkew, defaultAuthHMACMaxSkew),
+		PepIdMURL:            pepIdMURL,
+		PepIdMType:           envToChoice(pepIdMType, defaultPepIdMType, PepKeystone, PepKeyrock),
+		PepCacheTTL:          envToPositiveInt(pepCacheTTL, defaultPepCacheTTL),
+		RateLimit:            envToPositiveInt(rateLimit, defaultRateLimit),
+		RateLimitBurst:       envToPositiveInt(rateLimitBurst, defaultRateLimitBurst),
+		TrustedProxies:       trustedProxies,
+		InstanceQuota:        envToPositiveInt(instanceQuota, defaultInstanceQuota),
+		MaxBodySize:          envToPositiveInt(maxBodySize, defaultMaxBodySize),
+		MaxPayloadLength:     envToPositiveInt(maxPayloadLength, defaultMaxPayloadLength),
+		ValidateUTF8:         envToBool(validateUTF8, defaultValidateUTF8),
+		GRPCPort:             grpcPort,
+		StreamConcurrency:    envToPositiveInt(streamConcurrency, defaultStreamConcurrency),
+	}
+}
+
+/*
+TLSEnabled : whether the HTTP listener serves HTTPS.
+*/
+func (c *Config) TLSEnabled() bool {
+	return len(c.TLSCertFile) != 0 && len(c.TLSKeyFile) != 0
+}
+
+/*
+LogOptions : the options of utils.Logger in the Config.
+*/
+func (c *Config) LogOptions() utils.LogOptions {
+	return utils.LogOptions{
+		Format:           c.LogFormat,
+		Level:            c.LogLevel,
+		Payload:          c.LogPayload,
+		PayloadMaxLength: c.LogPayloadMaxLength,
+	}
+}
+
+/*
+LoadConfig : a factory method to create Config from environment variables and the config file.
+	The variables written in the file specified by CONFIG_FILE override the environment variables.
+	Unlike environment variables, an invalid value in the file is not replaced by the default value but raises an error.
+*/
+func LoadConfig() (*Config, error) {
+	config := NewConfig()
+	if (len(config.TLSCertFile) == 0) != (len(config.TLSKeyFile) == 0) {
+		return nil, fmt.Errorf("both %s and %s are required for TLS", tlsCertFile, tlsKeyFile)
+	}
+	if len(config.TLSClientCAFile) != 0 && len(config.TLSCertFile) == 0 {
+		return nil, fmt.Errorf("%s requires %s and %s", tlsClientCAFile, tlsCertFile, tlsKeyFile)
+	}
+	if len(config.ConfigFile) == 0 {
+		return config, nil
+	}
+
+	vars, err := readConfigFile(config.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range vars {
+		switch key {
+		case listenPort:
+			config.ListenPort, err = toListenPort(value)
+		case etcdEndpoint:
+			config.EtcdEndpoint, err = toEtcdEndpoint(value)
+		case lockTTL:
+			config.LockTTL, err = toPositiveInt(value)
+		case dataTTL:
+			config.DataTTL, err = toPositiveInt(value)
+		case topicPolicies:
+			config.TopicPolicies, err = toTopicPolicies(value)
+		case excludeTimestamp:
+			config.ExcludeTimestamp, err = strconv.ParseBool(value)
+		case orionDuplicateStatus:
+			config.OrionDuplicateStatus, err = toStatusCode(value)
+		case orionDuplicateBody:
+			config.OrionDuplicateBody = value
+		case logFormat:
+			config.LogFormat, err = toChoice(value, utils.LogFormatText, utils.LogFormatJSON)
+		case logLevel:
+			config.LogLevel, err = toChoice(value, utils.LogLevelDebug, utils.LogLevelInfo, utils.LogLevelWarn, utils.LogLevelError)
+		case logPayload:
+			config.LogPayload, err = toChoice(value, utils.PayloadFull, utils.PayloadTruncate, utils.PayloadRedact)
+		case logPayloadMaxLength:
+			config.LogPayloadMaxLength, err = toPositiveInt(value)
+		case accessLogSampleRate:
+			config.AccessLogSampleRate, err = toRate(value)
+		case accessLogSkipPaths:
+			config.AccessLogSkipPaths = toList(value)
+		case rateLimit:
+			config.RateLimit, err = toPositiveInt(value)
+		case rateLimitBurst:
+			config.RateLimitBurst, err = toPositiveInt(value)
+		case trustedProxies:
+			config.TrustedProxies, err = toAddresses(value)
+		case instanceQuota:
+			config.InstanceQuota, err = toPositiveInt(value)
+		case maxBodySize:
+			config.MaxBodySize, err = toPositiveInt(value)
+		case maxPayloadLength:
+			config.MaxPayloadLength, err = toPositiveInt(value)
+		case validateUTF8:
+			config.ValidateUTF8, err = strconv.ParseBool(value)
+		case grpcPort:
+			config.GRPCPort, err = toGRPCPort(value)
+		case streamConcurrency:
+			config.StreamConcurrency, err = toPositiveInt(value)
+		default:
+			err = fmt.Errorf("unknown variable")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid %s=%q: %s", config.ConfigFile, key, value, err)
+		}
+	}
+	return config, nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: not KEY=VALUE format", path, n)
+		}
+		vars[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+func toListenPort(port string) (string, error) {
 	if len(port) == 0 {
 		port = defaultListenPort
 	}
 	intPort, err := strconv.Atoi(port)
-	if err != nil || intPort < 1 || 65535 < intPort {
-		port = defaultListenPort
+	if err != nil {
+		return "", err
+	}
+	if intPort < 1 || 65535 < intPort {
+		return "", fmt.Errorf("out of range")
+	}
+	return ":" + port, nil
+}
+
+// toGRPCPort returns "" for the empty port, which disables the gRPC API.
+func toGRPCPort(port string) (string, error) {
+	if len(port) == 0 {
+		return "", nil
 	}
+	return toListenPort(port)
+}
 
-	etcdEndpoint := os.Getenv(etcdEndpoint)
+func toEtcdEndpoint(endpoint string) (string, error) {
 	r := regexp.MustCompile(etcdEndpointRe)
-	if !r.MatchString(etcdEndpoint) {
-		etcdEndpoint = defaultEtcdEndpoint
+	if !r.MatchString(endpoint) {
+		return "", fmt.Errorf("not match %s", etcdEndpointRe)
 	}
-	g := r.FindStringSubmatch(etcdEndpoint)
+	g := r.FindStringSubmatch(endpoint)
 	ip, err := strconv.Atoi(g[1])
-	if err != nil || ip < 1 || 65535 < ip {
-		etcdEndpoint = defaultEtcdEndpoint
+	if err != nil {
+		return "", err
+	}
+	if ip < 1 || 65535 < ip {
+		return "", fmt.Errorf("out of range")
 	}
+	return endpoint, nil
+}
 
-	return &Config{
-		ListenPort:   ":" + port,
-		EtcdEndpoint: etcdEndpoint,
-		LockTTL:      envToPositiveInt(lockTTL, defaultLockTTL),
-		DataTTL:      envToPositiveInt(dataTTL, defaultDataTTL),
+func toTopicPolicies(v string) ([]TopicPolicy, error) {
+	if len(strings.TrimSpace(v)) == 0 {
+		return nil, nil
+	}
+	var policies []TopicPolicy
+	if err := json.Unmarshal([]byte(v), &policies); err != nil {
+		return nil, err
+	}
+	for _, p := range policies {
+		if !utils.ValidTopicFilter(p.Filter) {
+			return nil, fmt.Errorf("invalid topic filter: %q", p.Filter)
+		}
+		if p.DataTTL != nil && *p.DataTTL < 0 {
+			return nil, fmt.Errorf("negative dataTTL: %q", p.Filter)
+		}
+		if !payload.Valid(p.PayloadType) {
+			return nil, fmt.Errorf("unknown payloadType: %q", p.PayloadType)
+		}
+	}
+	return policies, nil
+}
+
+/*
+MatchTopicPolicy : find the first TopicPolicy whose Filter matches the MQTT topic.
+*/
+func (c *Config) MatchTopicPolicy(topic string) (*TopicPolicy, bool) {
+	for i := range c.TopicPolicies {
+		if _, ok := utils.MatchTopic(c.TopicPolicies[i].Filter, topic); ok {
+			return &c.TopicPolicies[i], true
+		}
+	}
+	return nil, false
+}
+
+func toHTTPURL(v string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(v))
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return "", fmt.Errorf("not http(s) url")
+	}
+	return strings.TrimRight(u.String(), "/"), nil
+}
+
+func toStatusCode(v string) (int, error) {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if i < 100 || 599 < i {
+		return 0, fmt.Errorf("out of range")
+	}
+	return i, nil
+}
+
+func toPositiveInt(v string) (int, error) {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("negative value")
 	}
+	return i, nil
+}
+
+func toRate(v string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || 1 < f {
+		return 0, fmt.Errorf("out of range")
+	}
+	return f, nil
+}
+
+// toAddresses parses the comma separated IP addresses and CIDRs.
+func toAddresses(v string) ([]string, error) {
+	list := toList(v)
+	for _, item := range list {
+		if _, _, err := net.ParseCIDR(item); err != nil && net.ParseIP(item) == nil {
+			return nil, fmt.Errorf("not an IP address or a CIDR: %s", item)
+		}
+	}
+	return list, nil
+}
+
+func toList(v string) []string {
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envToRate(envKey string, defVar string) float64 {
+	envVar, err := toRate(envToString(envKey, defVar))
+	if err != nil {
+		envVar, _ = toRate(defVar)
+	}
+	return envVar
+}
+
+func envToString(envKey string, defVar string) string {
+	strEnvVar := strings.TrimSpace(os.Getenv(envKey))
+	if len(strEnvVar) == 0 {
+		strEnvVar = defVar
+	}
+	return strEnvVar
+}
+
+func envToBool(envKey string, defVar string) bool {
+	envVar, err := strconv.ParseBool(envToString(envKey, defVar))
+	if err != nil {
+		envVar, _ = strconv.ParseBool(defVar)
+	}
+	return envVar
+}
+
+func toChoice(v string, choices ...string) (string, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	for _, c := range choices {
+		if v == c {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("not one of %s", strings.Join(choices, ", "))
+}
+
+func envToChoice(envKey string, defVar string, choices ...string) string {
+	envVar, err := toChoice(envToString(envKey, defVar), choices...)
+	if err != nil {
+		envVar = defVar
+	}
+	return envVar
 }
 
 func envToPositiveInt(envKey string, defVar string) int {
@@ -71,8 +658,8 @@ func envToPositiveInt(envKey string, defVar string) int {
 	if len(strEnvVar) == 0 {
 		strEnvVar = defVar
 	}
-	envVar, err := strconv.Atoi(strEnvVar)
-	if err != nil || envVar < 0 {
+	envVar, err := toPositiveInt(strEnvVar)
+	if err != nil {
 		envVar, _ = strconv.Atoi(defVar)
 	}
 	return envVar
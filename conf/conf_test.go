@@ -8,11 +8,14 @@ package conf
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
 )
 
 func TestNewConfigNoEnv(t *testing.T) {
@@ -20,12 +23,54 @@ func TestNewConfigNoEnv(t *testing.T) {
 
 	l, _ := strconv.Atoi(defaultLockTTL)
 	d, _ := strconv.Atoi(defaultDataTTL)
+	w, _ := strconv.Atoi(defaultConfigWatchInterval)
+	o, _ := strconv.Atoi(defaultOrionDuplicateStatus)
+	m, _ := strconv.Atoi(defaultMetricsTenantLimit)
+	lm, _ := strconv.Atoi(defaultLogPayloadMaxLength)
+	hostname, _ := os.Hostname()
 
 	expected := &Config{
-		ListenPort:   ":" + defaultListenPort,
-		EtcdEndpoint: defaultEtcdEndpoint,
-		LockTTL:      l,
-		DataTTL:      d,
+		ListenPort:           ":" + defaultListenPort,
+		EtcdEndpoint:         defaultEtcdEndpoint,
+		LockTTL:              l,
+		DataTTL:              d,
+		ConfigFile:           defaultConfigFile,
+		ConfigWatchInterval:  w,
+		ConfigPrefix:         defaultConfigPrefix,
+		MqttBroker:           defaultMqttBroker,
+		MqttClientID:         defaultMqttClientID,
+		MqttTopics:           defaultMqttTopics,
+		MqttOnError:          MqttOnErrorDrop,
+		OrionDuplicateStatus: o,
+		MetricsTenantLimit:   m,
+		TracingServiceName:   defaultTracingServiceName,
+		LogFormat:            defaultLogFormat,
+		LogLevel:             defaultLogLevel,
+		LogPayload:           defaultLogPayload,
+		LogPayloadMaxLength:  lm,
+		AccessLogSampleRate:  1,
+		AccessLogSkipPaths:   []string{"/healthz", "/readyz", "/metrics"},
+		InstanceID:           hostname,
+		AuditFile:            defaultAuditFile,
+		AuditMaxSize:         100,
+		AuditMaxBackups:      5,
+		AuditBufferSize:      1024,
+		ReadinessTimeout:     1000,
+		ShutdownGracePeriod:  20,
+		TLSClientAuth:        TLSClientAuthRequire,
+		AuthHMACMaxSkew:      300,
+		PepIdMURL:            "",
+		PepIdMType:           "keystone",
+		PepCacheTTL:          60,
+		RateLimit:            0,
+		RateLimitBurst:       0,
+		TrustedProxies:       []string{},
+		InstanceQuota:        0,
+		MaxBodySize:          1048576,
+		MaxPayloadLength:     65536,
+		ValidateUTF8:         false,
+		GRPCPort:             "",
+		StreamConcurrency:    8,
 	}
 
 	config := NewConfig()
@@ -88,6 +133,12 @@ func TestNewConfigWithEnv(t *testing.T) {
 		{dataTTL: "-1", expected: d},
 	}
 
+	w, _ := strconv.Atoi(defaultConfigWatchInterval)
+	o, _ := strconv.Atoi(defaultOrionDuplicateStatus)
+	m, _ := strconv.Atoi(defaultMetricsTenantLimit)
+	lm, _ := strconv.Atoi(defaultLogPayloadMaxLength)
+	hostname, _ := os.Hostname()
+
 	for _, p := range listenPortCases {
 		for _, e := range etcdEndpointCases {
 			for _, l := range lockTTLCases {
@@ -107,10 +158,47 @@ func TestNewConfigWithEnv(t *testing.T) {
 							os.Setenv(dataTTL, d.dataTTL)
 						}
 						expected := &Config{
-							ListenPort:   p.expected,
-							EtcdEndpoint: e.expected,
-							LockTTL:      l.expected,
-							DataTTL:      d.expected,
+							ListenPort:           p.expected,
+							EtcdEndpoint:         e.expected,
+							LockTTL:              l.expected,
+							DataTTL:              d.expected,
+							ConfigFile:           defaultConfigFile,
+							ConfigWatchInterval:  w,
+							ConfigPrefix:         defaultConfigPrefix,
+							MqttBroker:           defaultMqttBroker,
+							MqttClientID:         defaultMqttClientID,
+							MqttTopics:           defaultMqttTopics,
+							MqttOnError:          MqttOnErrorDrop,
+							OrionDuplicateStatus: o,
+							MetricsTenantLimit:   m,
+							TracingServiceName:   defaultTracingServiceName,
+							LogFormat:            defaultLogFormat,
+							LogLevel:             defaultLogLevel,
+							LogPayload:           defaultLogPayload,
+							LogPayloadMaxLength:  lm,
+							AccessLogSampleRate:  1,
+							AccessLogSkipPaths:   []string{"/healthz", "/readyz", "/metrics"},
+							InstanceID:           hostname,
+							AuditFile:            defaultAuditFile,
+							AuditMaxSize:         100,
+							AuditMaxBackups:      5,
+							AuditBufferSize:      1024,
+							ReadinessTimeout:     1000,
+							ShutdownGracePeriod:  20,
+							TLSClientAuth:        TLSClientAuthRequire,
+							AuthHMACMaxSkew:      300,
+							PepIdMURL:            "",
+							PepIdMType:           "keystone",
+							PepCacheTTL:          60,
+							RateLimit:            0,
+							RateLimitBurst:       0,
+							TrustedProxies:       []string{},
+							InstanceQuota:        0,
+							MaxBodySize:          1048576,
+							MaxPayloadLength:     65536,
+							ValidateUTF8:         false,
+							GRPCPort:             "",
+							StreamConcurrency:    8,
 						}
 						config := NewConfig()
 						assert.Equal(expected, config)
@@ -125,3 +213,540 @@ func TestNewConfigWithEnv(t *testing.T) {
 		}
 	}
 }
+
+func TestNewConfigPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		prefix   string
+		expected string
+	}{
+		{prefix: "", expected: defaultConfigPrefix},
+		{prefix: "/", expected: defaultConfigPrefix},
+		{prefix: "/msgfilter/config", expected: "/msgfilter/config"},
+		{prefix: "/msgfilter/config/", expected: "/msgfilter/config"},
+		{prefix: "msgfilter/config", expected: "/msgfilter/config"},
+	}
+	for _, testCase := range testCases {
+		os.Setenv(configPrefix, testCase.prefix)
+		assert.Equal(testCase.expected, NewConfig().ConfigPrefix)
+	}
+	os.Unsetenv(configPrefix)
+}
+
+func TestNewConfigMqtt(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(mqttBroker, "tcp://mosquitto:1883")
+	os.Setenv(mqttClientID, " ")
+	os.Setenv(mqttUsername, "user")
+	os.Setenv(mqttPassword, "pass")
+	os.Setenv(mqttTopics, "/ul/+/+/attrs=/filtered/ul/+/+/attrs")
+	os.Setenv(mqttOnError, "Republish")
+	defer func() {
+		for _, key := range []string{mqttBroker, mqttClientID, mqttUsername, mqttPassword, mqttTopics, mqttOnError} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	config := NewConfig()
+	assert.Equal("tcp://mosquitto:1883", config.MqttBroker)
+	assert.Equal(defaultMqttClientID, config.MqttClientID)
+	assert.Equal("user", config.MqttUsername)
+	assert.Equal("pass", config.MqttPassword)
+	assert.Equal("/ul/+/+/attrs=/filtered/ul/+/+/attrs", config.MqttTopics)
+	assert.Equal(MqttOnErrorRepublish, config.MqttOnError)
+
+	os.Setenv(mqttOnError, "retry")
+	assert.Equal(MqttOnErrorDrop, NewConfig().MqttOnError)
+}
+
+func TestNewConfigTopicPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	f := false
+	ttl := 30
+	os.Setenv(topicPolicies, `[{"filter":"/ul/+/+/cmd","skip":true},{"filter":"/ul/+/dev1/attrs","scopeTopic":false},{"filter":"/ul/#","dataTTL":30}]`)
+	config := NewConfig()
+	assert.Equal([]TopicPolicy{
+		{Filter: "/ul/+/+/cmd", Skip: true},
+		{Filter: "/ul/+/dev1/attrs", ScopeTopic: &f},
+		{Filter: "/ul/#", DataTTL: &ttl},
+	}, config.TopicPolicies)
+
+	p, ok := config.MatchTopicPolicy("/ul/key/dev1/attrs")
+	assert.True(ok)
+	assert.Equal("/ul/+/dev1/attrs", p.Filter)
+	p, ok = config.MatchTopicPolicy("/ul/key/dev2/attrs")
+	assert.True(ok)
+	assert.Equal("/ul/#", p.Filter)
+	p, ok = config.MatchTopicPolicy("/json/key/dev1/attrs")
+	assert.False(ok)
+	assert.Nil(p)
+
+	os.Setenv(topicPolicies, `[{"filter":"/ul/#","payloadType":"ul"}]`)
+	assert.Equal([]TopicPolicy{{Filter: "/ul/#", PayloadType: "ul"}}, NewConfig().TopicPolicies)
+
+	for _, policies := range []string{"", "invalid", `[{"filter":""}]`, `[{"filter":"/ul/#/attrs"}]`, `[{"filter":"/ul/#","dataTTL":-1}]`, `[{"filter":"/ul/#","payloadType":"unknown"}]`} {
+		os.Setenv(topicPolicies, policies)
+		assert.Nil(NewConfig().TopicPolicies, policies)
+	}
+	os.Unsetenv(topicPolicies)
+}
+
+func TestNewConfigExcludeTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		value    string
+		expected bool
+	}{
+		{value: "true", expected: true},
+		{value: "1", expected: true},
+		{value: "false", expected: false},
+		{value: "", expected: false},
+		{value: "invalid", expected: false},
+	}
+	for _, testCase := range testCases {
+		os.Setenv(excludeTimestamp, testCase.value)
+		assert.Equal(testCase.expected, NewConfig().ExcludeTimestamp, testCase.value)
+	}
+	os.Unsetenv(excludeTimestamp)
+}
+
+func TestNewConfigOrion(t *testing.T) {
+	assert := assert.New(t)
+
+	urlCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "http://orion:1026", expected: "http://orion:1026"},
+		{value: "", expected: defaultOrionURL},
+		{value: "invalid", expected: defaultOrionURL},
+	}
+	for _, testCase := range urlCases {
+		os.Setenv(orionURL, testCase.value)
+		assert.Equal(testCase.expected, NewConfig().OrionURL, testCase.value)
+	}
+	os.Unsetenv(orionURL)
+
+	o, _ := strconv.Atoi(defaultOrionDuplicateStatus)
+	statusCases := []struct {
+		value    string
+		expected int
+	}{
+		{value: "200", expected: 200},
+		{value: "409", expected: 409},
+		{value: "", expected: o},
+		{value: "99", expected: o},
+		{value: "600", expected: o},
+		{value: "invalid", expected: o},
+	}
+	for _, testCase := range statusCases {
+		os.Setenv(orionDuplicateStatus, testCase.value)
+		assert.Equal(testCase.expected, NewConfig().OrionDuplicateStatus, testCase.value)
+	}
+	os.Unsetenv(orionDuplicateStatus)
+
+	os.Setenv(orionDuplicateBody, `{"result":"duplicate"}`)
+	assert.Equal(`{"result":"duplicate"}`, NewConfig().OrionDuplicateBody)
+	os.Unsetenv(orionDuplicateBody)
+}
+
+func TestNewConfigMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewConfig()
+	assert.False(config.MetricsTenantLabel)
+	assert.Equal(100, config.MetricsTenantLimit)
+
+	os.Setenv(metricsTenantLabel, "true")
+	os.Setenv(metricsTenantLimit, "5")
+	config = NewConfig()
+	assert.True(config.MetricsTenantLabel)
+	assert.Equal(5, config.MetricsTenantLimit)
+
+	os.Setenv(metricsTenantLimit, "-1")
+	assert.Equal(100, NewConfig().MetricsTenantLimit)
+
+	os.Unsetenv(metricsTenantLabel)
+	os.Unsetenv(metricsTenantLimit)
+}
+
+func TestNewConfigTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	exporterCases := []struct {
+		value    string
+		expected string
+	}{
+		{value: "otlp", expected: TracingOTLP},
+		{value: "STDOUT", expected: TracingStdout},
+		{value: "", expected: defaultTracingExporter},
+		{value: "invalid", expected: defaultTracingExporter},
+	}
+	for _, testCase := range exporterCases {
+		os.Setenv(tracingExporter, testCase.value)
+		assert.Equal(testCase.expected, NewConfig().TracingExporter, testCase.value)
+	}
+	os.Unsetenv(tracingExporter)
+
+	os.Setenv(tracingEndpoint, "http://collector:4318/")
+	os.Setenv(tracingServiceName, "msgfilter-1")
+	config := NewConfig()
+	assert.Equal("http://collector:4318", config.TracingEndpoint)
+	assert.Equal("msgfilter-1", config.TracingServiceName)
+
+	os.Setenv(tracingEndpoint, "collector:4318")
+	assert.Equal(defaultTracingEndpoint, NewConfig().TracingEndpoint)
+
+	os.Unsetenv(tracingEndpoint)
+	os.Unsetenv(tracingServiceName)
+}
+
+func TestNewConfigLog(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(logFormat, "JSON")
+	os.Setenv(logLevel, "warn")
+	os.Setenv(logPayload, "truncate")
+	os.Setenv(logPayloadMaxLength, "8")
+	config := NewConfig()
+	assert.Equal(utils.LogOptions{
+		Format:           utils.LogFormatJSON,
+		Level:            utils.LogLevelWarn,
+		Payload:          utils.PayloadTruncate,
+		PayloadMaxLength: 8,
+	}, config.LogOptions())
+
+	os.Setenv(logFormat, "xml")
+	os.Setenv(logLevel, "trace")
+	os.Setenv(logPayload, "invalid")
+	os.Setenv(logPayloadMaxLength, "-1")
+	config = NewConfig()
+	assert.Equal(utils.LogOptions{
+		Format:           utils.LogFormatText,
+		Level:            utils.LogLevelDebug,
+		Payload:          utils.PayloadRedact,
+		PayloadMaxLength: 32,
+	}, config.LogOptions())
+
+	os.Unsetenv(logFormat)
+	os.Unsetenv(logLevel)
+	os.Unsetenv(logPayload)
+	os.Unsetenv(logPayloadMaxLength)
+}
+
+func TestNewConfigAccessLog(t *testing.T) {
+	assert := assert.New(t)
+
+	rateCases := []struct {
+		value    string
+		expected float64
+	}{
+		{value: "0", expected: 0},
+		{value: "0.25", expected: 0.25},
+		{value: "1", expected: 1},
+		{value: "", expected: 1},
+		{value: "1.5", expected: 1},
+		{value: "-0.1", expected: 1},
+		{value: "invalid", expected: 1},
+	}
+	for _, testCase := range rateCases {
+		os.Setenv(accessLogSampleRate, testCase.value)
+		assert.Equal(testCase.expected, NewConfig().AccessLogSampleRate, testCase.value)
+	}
+	os.Unsetenv(accessLogSampleRate)
+
+	os.Setenv(accessLogSkipPaths, " /healthz, ,/version ")
+	assert.Equal([]string{"/healthz", "/version"}, NewConfig().AccessLogSkipPaths)
+	os.Unsetenv(accessLogSkipPaths)
+}
+
+func TestNewConfigAudit(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(instanceID, "msgfilter-1")
+	os.Setenv(auditSink, "file")
+	os.Setenv(auditFile, "/var/log/msgfilter/audit.jsonl")
+	os.Setenv(auditMaxSize, "10")
+	os.Setenv(auditMaxBackups, "0")
+	os.Setenv(auditBufferSize, "16")
+	config := NewConfig()
+	assert.Equal("msgfilter-1", config.InstanceID)
+	assert.Equal(AuditFile, config.AuditSink)
+	assert.Equal("/var/log/msgfilter/audit.jsonl", config.AuditFile)
+	assert.Equal(10, config.AuditMaxSize)
+	assert.Equal(0, config.AuditMaxBackups)
+	assert.Equal(16, config.AuditBufferSize)
+
+	os.Setenv(auditSink, "syslog")
+	assert.Equal(defaultAuditSink, NewConfig().AuditSink)
+
+	for _, key := range []string{instanceID, auditSink, auditFile, auditMaxSize, auditMaxBackups, auditBufferSize} {
+		os.Unsetenv(key)
+	}
+}
+
+func TestNewConfigLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(readinessTimeout, "200")
+	assert.Equal(200, NewConfig().ReadinessTimeout)
+	os.Setenv(readinessTimeout, "-1")
+	assert.Equal(1000, NewConfig().ReadinessTimeout)
+	os.Unsetenv(readinessTimeout)
+
+	os.Setenv(shutdownGracePeriod, "5")
+	assert.Equal(5, NewConfig().ShutdownGracePeriod)
+	os.Unsetenv(shutdownGracePeriod)
+}
+
+func writeConfigFile(t *testing.T, content string) (string, func()) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "msgfilter")
+	assert.NoError(t, err)
+	_, err = f.WriteString(content)
+	assert.NoError(t, err)
+	f.Close()
+
+	os.Setenv(configFile, f.Name())
+	tearDown := func() {
+		os.Unsetenv(configFile)
+		os.Remove(f.Name())
+	}
+	return f.Name(), tearDown
+}
+
+func TestNewConfigTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewConfig()
+	assert.False(config.TLSEnabled())
+
+	os.Setenv(tlsCertFile, "/etc/msgfilter/server.crt")
+	os.Setenv(tlsKeyFile, "/etc/msgfilter/server.key")
+	os.Setenv(tlsClientCAFile, "/etc/msgfilter/ca.crt")
+	os.Setenv(tlsClientAuth, "Optional")
+	config = NewConfig()
+	assert.True(config.TLSEnabled())
+	assert.Equal("/etc/msgfilter/server.crt", config.TLSCertFile)
+	assert.Equal("/etc/msgfilter/server.key", config.TLSKeyFile)
+	assert.Equal("/etc/msgfilter/ca.crt", config.TLSClientCAFile)
+	assert.Equal(TLSClientAuthOptional, config.TLSClientAuth)
+	_, err := LoadConfig()
+	assert.NoError(err)
+
+	os.Setenv(tlsClientAuth, "none")
+	assert.Equal(TLSClientAuthRequire, NewConfig().TLSClientAuth)
+
+	os.Unsetenv(tlsKeyFile)
+	assert.False(NewConfig().TLSEnabled())
+	_, err = LoadConfig()
+	assert.Error(err)
+
+	os.Unsetenv(tlsCertFile)
+	_, err = LoadConfig()
+	assert.Error(err)
+
+	for _, key := range []string{tlsCertFile, tlsKeyFile, tlsClientCAFile, tlsClientAuth} {
+		os.Unsetenv(key)
+	}
+}
+
+func TestNewConfigAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(authFile, "/etc/msgfilter/auth.json")
+	os.Setenv(authHMACMaxSkew, "60")
+	config := NewConfig()
+	assert.Equal("/etc/msgfilter/auth.json", config.AuthFile)
+	assert.Equal(60, config.AuthHMACMaxSkew)
+
+	os.Setenv(authHMACMaxSkew, "1m")
+	assert.Equal(300, NewConfig().AuthHMACMaxSkew)
+
+	os.Unsetenv(authFile)
+	os.Unsetenv(authHMACMaxSkew)
+}
+
+func TestNewConfigPep(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(pepIdMURL, "http://keyrock:3000/")
+	os.Setenv(pepIdMType, "keyrock")
+	os.Setenv(pepCacheTTL, "0")
+	config := NewConfig()
+	assert.Equal("http://keyrock:3000", config.PepIdMURL)
+	assert.Equal(PepKeyrock, config.PepIdMType)
+	assert.Equal(0, config.PepCacheTTL)
+
+	os.Setenv(pepIdMURL, "keyrock:3000")
+	os.Setenv(pepIdMType, "oauth2")
+	os.Setenv(pepCacheTTL, "-1")
+	config = NewConfig()
+	assert.Equal("", config.PepIdMURL)
+	assert.Equal(PepKeystone, config.PepIdMType)
+	assert.Equal(60, config.PepCacheTTL)
+
+	os.Unsetenv(pepIdMURL)
+	os.Unsetenv(pepIdMType)
+	os.Unsetenv(pepCacheTTL)
+}
+
+func TestNewConfigRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(rateLimit, "100")
+	os.Setenv(rateLimitBurst, "200")
+	os.Setenv(instanceQuota, "10000")
+	config := NewConfig()
+	assert.Equal(100, config.RateLimit)
+	assert.Equal(200, config.RateLimitBurst)
+	assert.Equal(10000, config.InstanceQuota)
+
+	os.Setenv(rateLimit, "-1")
+	os.Setenv(rateLimitBurst, "1.5")
+	os.Setenv(instanceQuota, "many")
+	config = NewConfig()
+	assert.Equal(0, config.RateLimit)
+	assert.Equal(0, config.RateLimitBurst)
+	assert.Equal(0, config.InstanceQuota)
+
+	os.Unsetenv(rateLimit)
+	os.Unsetenv(rateLimitBurst)
+	os.Unsetenv(instanceQuota)
+}
+
+func TestNewConfigTrustedProxies(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(trustedProxies, " 10.0.0.0/8, ,192.168.0.3,::1 ")
+	assert.Equal([]string{"10.0.0.0/8", "192.168.0.3", "::1"}, NewConfig().TrustedProxies)
+
+	os.Setenv(trustedProxies, "10.0.0.0/8,proxy")
+	assert.Equal([]string{}, NewConfig().TrustedProxies)
+
+	os.Unsetenv(trustedProxies)
+}
+
+func TestNewConfigRequestLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(maxBodySize, "4096")
+	os.Setenv(maxPayloadLength, "0")
+	os.Setenv(validateUTF8, "true")
+	config := NewConfig()
+	assert.Equal(4096, config.MaxBodySize)
+	assert.Equal(0, config.MaxPayloadLength)
+	assert.True(config.ValidateUTF8)
+
+	os.Setenv(maxBodySize, "1MB")
+	os.Setenv(maxPayloadLength, "-1")
+	os.Setenv(validateUTF8, "yes")
+	config = NewConfig()
+	assert.Equal(1048576, config.MaxBodySize)
+	assert.Equal(65536, config.MaxPayloadLength)
+	assert.False(config.ValidateUTF8)
+
+	os.Unsetenv(maxBodySize)
+	os.Unsetenv(maxPayloadLength)
+	os.Unsetenv(validateUTF8)
+}
+
+func TestNewConfigGRPCPort(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(grpcPort, "50051")
+	assert.Equal(":50051", NewConfig().GRPCPort)
+
+	for _, port := range []string{"0", "65536", "grpc"} {
+		os.Setenv(grpcPort, port)
+		assert.Equal("", NewConfig().GRPCPort, port)
+	}
+	os.Unsetenv(grpcPort)
+	assert.Equal("", NewConfig().GRPCPort)
+}
+
+func TestNewConfigStreamConcurrency(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv(streamConcurrency, "32")
+	assert.Equal(32, NewConfig().StreamConcurrency)
+	os.Setenv(streamConcurrency, "many")
+	assert.Equal(8, NewConfig().StreamConcurrency)
+	os.Unsetenv(streamConcurrency)
+}
+
+func TestLoadConfigNoFile(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := LoadConfig()
+	assert.NoError(err)
+	assert.Equal(NewConfig(), config)
+}
+
+func TestLoadConfigWithFile(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv(lockTTL, "20")
+	os.Setenv(dataTTL, "30")
+	defer os.Unsetenv(lockTTL)
+	defer os.Unsetenv(dataTTL)
+
+	path, tearDown := writeConfigFile(t, "# comment\n\nDATA_TTL = 60\nETCD_ENDPOINT=http://etcd:2379\nTOPIC_POLICIES=[{\"filter\":\"/ul/#\",\"skip\":true}]\nRATE_LIMIT=50\nINSTANCE_QUOTA=1000\nTRUSTED_PROXIES=10.0.0.0/8\n")
+	defer tearDown()
+
+	config, err := LoadConfig()
+	assert.NoError(err)
+	assert.Equal(path, config.ConfigFile)
+	assert.Equal(20, config.LockTTL)
+	assert.Equal(60, config.DataTTL)
+	assert.Equal("http://etcd:2379", config.EtcdEndpoint)
+	assert.Equal(":"+defaultListenPort, config.ListenPort)
+	assert.Equal([]TopicPolicy{{Filter: "/ul/#", Skip: true}}, config.TopicPolicies)
+	assert.Equal(50, config.RateLimit)
+	assert.Equal(1000, config.InstanceQuota)
+	assert.Equal([]string{"10.0.0.0/8"}, config.TrustedProxies)
+}
+
+func TestLoadConfigWithInvalidFile(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []string{
+		"DATA_TTL=-1",
+		"LOCK_TTL=invalid",
+		"LISTEN_PORT=65536",
+		"ETCD_ENDPOINT=invalid",
+		"UNKNOWN=1",
+		"EXCLUDE_TIMESTAMP=invalid",
+		"ORION_DUPLICATE_STATUS=600",
+		"LOG_LEVEL=trace",
+		"ACCESS_LOG_SAMPLE_RATE=2",
+		"RATE_LIMIT=-1",
+		"INSTANCE_QUOTA=unlimited",
+		"TRUSTED_PROXIES=proxy",
+		"MAX_BODY_SIZE=-1",
+		"VALIDATE_UTF8=maybe",
+		"GRPC_PORT=0",
+		"STREAM_CONCURRENCY=-1",
+		"TOPIC_POLICIES=[{\"filter\":\"/ul/#/attrs\"}]",
+		"DATA_TTL",
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, tearDown := writeConfigFile(t, testCase)
+			defer tearDown()
+
+			config, err := LoadConfig()
+			assert.Nil(config)
+			assert.Error(err)
+		})
+	}
+
+	os.Setenv(configFile, "/not/exist/file")
+	defer os.Unsetenv(configFile)
+	config, err := LoadConfig()
+	assert.Nil(config)
+	assert.Error(err)
+}
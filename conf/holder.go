@@ -0,0 +1,43 @@
+/*
+Package conf : configuration variables
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package conf
+
+import (
+	"sync/atomic"
+)
+
+/*
+Holder : a struct to hold the current Config which can be swapped atomically.
+	A caller should Get the Config once and use it until the end of its process,
+	so that the process is not affected by the Config swapped on the way.
+*/
+type Holder struct {
+	value atomic.Value
+}
+
+/*
+NewHolder : a factory method to create Holder.
+*/
+func NewHolder(config *Config) *Holder {
+	holder := &Holder{}
+	holder.Set(config)
+	return holder
+}
+
+/*
+Get : get the current Config.
+*/
+func (h *Holder) Get() *Config {
+	return h.value.Load().(*Config)
+}
+
+/*
+Set : swap the current Config to the argument Config.
+*/
+func (h *Holder) Set(config *Config) {
+	h.value.Store(config)
+}
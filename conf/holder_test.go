@@ -0,0 +1,26 @@
+/*
+Package conf : configuration variables
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHolder(t *testing.T) {
+	assert := assert.New(t)
+
+	old := &Config{LockTTL: 1, DataTTL: 2}
+	holder := NewHolder(old)
+	current := holder.Get()
+	assert.Equal(old, current)
+
+	holder.Set(&Config{LockTTL: 3, DataTTL: 4})
+	assert.Equal(&Config{LockTTL: 3, DataTTL: 4}, holder.Get())
+	assert.Equal(&Config{LockTTL: 1, DataTTL: 2}, current)
+}
@@ -0,0 +1,124 @@
+/*
+Package conf : configuration variables
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package conf
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+// GetConfig : injection point to mock loading Config
+var GetConfig = LoadConfig
+
+/*
+Reloader : a struct to reload Config when the config file is changed or SIGHUP is received.
+	Reloader validates the new Config and swaps it into the Holder.
+	When the new Config is invalid, Reloader keeps the old one.
+*/
+type Reloader struct {
+	holder  *Holder
+	signals chan os.Signal
+	done    chan struct{}
+	logger  *utils.Logger
+}
+
+/*
+NewReloader : a factory method to create Reloader.
+*/
+func NewReloader(holder *Holder) *Reloader {
+	return &Reloader{
+		holder:  holder,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+		logger:  utils.NewLogger("reloader"),
+	}
+}
+
+/*
+Start : start watching the config file and SIGHUP.
+*/
+func (r *Reloader) Start() {
+	signal.Notify(r.signals, syscall.SIGHUP)
+
+	go func() {
+		config := r.holder.Get()
+		var tick <-chan time.Time
+		if len(config.ConfigFile) != 0 && config.ConfigWatchInterval > 0 {
+			ticker := time.NewTicker(time.Second * time.Duration(config.ConfigWatchInterval))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		modTime := r.modTime()
+		for {
+			select {
+			case <-r.done:
+				return
+			case s := <-r.signals:
+				r.logger.Infof("received %v", s)
+			case <-tick:
+				t := r.modTime()
+				if t.Equal(modTime) {
+					continue
+				}
+				modTime = t
+				r.logger.Infof("config file changed")
+			}
+			if err := r.Reload(); err != nil {
+				r.logger.Errorf("reload rejected: %s", err)
+			}
+		}
+	}()
+}
+
+/*
+Stop : stop watching the config file and SIGHUP.
+*/
+func (r *Reloader) Stop() {
+	signal.Stop(r.signals)
+	close(r.done)
+}
+
+/*
+Reload : load the new Config and swap it into the Holder if it is valid.
+*/
+func (r *Reloader) Reload() error {
+	current := r.holder.Get()
+	config, err := GetConfig()
+	if err != nil {
+		return err
+	}
+	if config.ListenPort != current.ListenPort {
+		return fmt.Errorf("%s can not be changed without restart", listenPort)
+	}
+	if config.EtcdEndpoint != current.EtcdEndpoint {
+		return fmt.Errorf("%s can not be changed without restart", etcdEndpoint)
+	}
+	if config.ConfigPrefix != current.ConfigPrefix {
+		return fmt.Errorf("%s can not be changed without restart", configPrefix)
+	}
+	if config.GRPCPort != current.GRPCPort {
+		return fmt.Errorf("%s can not be changed without restart", grpcPort)
+	}
+	r.holder.Set(config)
+	utils.SetLogOptions(config.LogOptions())
+	r.logger.Infof("config reloaded: %s=%d, %s=%d", lockTTL, config.LockTTL, dataTTL, config.DataTTL)
+	return nil
+}
+
+func (r *Reloader) modTime() time.Time {
+	fi, err := os.Stat(r.holder.Get().ConfigFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,123 @@
+/*
+Package conf : configuration variables
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package conf
+
+import (
+	"errors"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setUpReloader(t *testing.T) (*Holder, func(*Config, error)) {
+	t.Helper()
+	holder := NewHolder(&Config{
+		ListenPort:   ":5001",
+		EtcdEndpoint: "http://127.0.0.1:2379",
+		LockTTL:      10,
+		DataTTL:      600,
+	})
+	setNext := func(config *Config, err error) {
+		GetConfig = func() (*Config, error) {
+			return config, err
+		}
+	}
+	return holder, setNext
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	holder, setNext := setUpReloader(t)
+	defer func() { GetConfig = LoadConfig }()
+
+	reloader := NewReloader(holder)
+	next := &Config{
+		ListenPort:   ":5001",
+		EtcdEndpoint: "http://127.0.0.1:2379",
+		LockTTL:      20,
+		DataTTL:      60,
+	}
+	setNext(next, nil)
+	assert.NoError(reloader.Reload())
+	assert.Equal(next, holder.Get())
+}
+
+func TestReloadRejected(t *testing.T) {
+	assert := assert.New(t)
+	holder, setNext := setUpReloader(t)
+	defer func() { GetConfig = LoadConfig }()
+	old := holder.Get()
+
+	testCases := []struct {
+		config *Config
+		err    error
+	}{
+		{config: nil, err: errors.New("invalid")},
+		{config: &Config{ListenPort: ":5002", EtcdEndpoint: "http://127.0.0.1:2379", LockTTL: 20, DataTTL: 60}, err: nil},
+		{config: &Config{ListenPort: ":5001", EtcdEndpoint: "http://etcd:2379", LockTTL: 20, DataTTL: 60}, err: nil},
+		{config: &Config{ListenPort: ":5001", EtcdEndpoint: "http://127.0.0.1:2379", GRPCPort: ":50051", LockTTL: 20, DataTTL: 60}, err: nil},
+	}
+	reloader := NewReloader(holder)
+	for _, testCase := range testCases {
+		setNext(testCase.config, testCase.err)
+		assert.Error(reloader.Reload())
+		assert.Equal(old, holder.Get())
+	}
+}
+
+func TestReloadBySignal(t *testing.T) {
+	assert := assert.New(t)
+	holder, setNext := setUpReloader(t)
+	defer func() { GetConfig = LoadConfig }()
+
+	reloader := NewReloader(holder)
+	next := &Config{
+		ListenPort:   ":5001",
+		EtcdEndpoint: "http://127.0.0.1:2379",
+		LockTTL:      20,
+		DataTTL:      60,
+	}
+	setNext(next, nil)
+	reloader.Start()
+	defer reloader.Stop()
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	assert.True(waitFor(func() bool { return holder.Get() == next }))
+}
+
+func TestReloadByFileChange(t *testing.T) {
+	assert := assert.New(t)
+	path, tearDown := writeConfigFile(t, "DATA_TTL=60\n")
+	defer tearDown()
+
+	config, err := LoadConfig()
+	assert.NoError(err)
+	config.ConfigWatchInterval = 1
+	holder := NewHolder(config)
+
+	reloader := NewReloader(holder)
+	reloader.Start()
+	defer reloader.Stop()
+
+	// wait a moment so that the modification time of the config file is surely changed
+	time.Sleep(time.Millisecond * 10)
+	assert.NoError(ioutil.WriteFile(path, []byte("DATA_TTL=120\n"), 0644))
+	assert.True(waitFor(func() bool { return holder.Get().DataTTL == 120 }))
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
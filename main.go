@@ -7,18 +7,107 @@ Package main : entry point of fiware-distinct-message
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/audit"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/bridge"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/router"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
 )
 
 func main() {
 	logger := utils.NewLogger("main")
-	config := conf.NewConfig()
-	handler, err := router.NewHandler(config)
+	config, err := conf.LoadConfig()
+	if err != nil {
+		logger.Errorf("LoadConfig raise error: %s", err)
+		return
+	}
+	utils.SetLogOptions(config.LogOptions())
+	// the access logs are written by the router, so gin does not need to write its debug logs
+	if len(os.Getenv(gin.ENV_GIN_MODE)) == 0 {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	shutdown, err := tracing.Start(config)
+	if err != nil {
+		logger.Errorf("tracing.Start raise error: %s", err)
+		return
+	}
+	defer shutdown(context.Background())
+
+	stopAudit, err := audit.Start(config)
+	if err != nil {
+		logger.Errorf("audit.Start raise error: %s", err)
+		return
+	}
+	defer stopAudit()
+
+	holder := conf.NewHolder(config)
+	handler, err := router.NewHandler(holder)
 	if err != nil {
 		logger.Errorf("NewHandler raise error: %s", err)
 		return
 	}
-	handler.Run(config.ListenPort)
+	var b *bridge.Bridge
+	if len(config.MqttBroker) != 0 {
+		b, err = bridge.NewBridge(holder)
+		if err != nil {
+			logger.Errorf("NewBridge raise error: %s", err)
+			return
+		}
+		if err := b.Start(); err != nil {
+			logger.Errorf("Bridge.Start raise error: %s", err)
+			return
+		}
+	}
+	reloader := conf.NewReloader(holder)
+	reloader.Start()
+	defer reloader.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	errs := make(chan error, 2)
+	go func() {
+		errs <- handler.Run(config.ListenPort)
+	}()
+	if len(config.GRPCPort) != 0 {
+		go func() {
+			errs <- handler.RunGRPC(config.GRPCPort)
+		}()
+	}
+	select {
+	case err := <-errs:
+		logger.Errorf("Run raise error: %s", err)
+	case s := <-signals:
+		logger.Infof("received %v, shutting down", s)
+	}
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(config.ShutdownGracePeriod))
+	defer cancel()
+	// the bridge and the handler are drained in parallel within the same grace period
+	var wg sync.WaitGroup
+	if b != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.Shutdown(ctx); err != nil {
+				logger.Errorf("Bridge.Shutdown raise error: %s", err)
+			}
+		}()
+	}
+	if err := handler.Shutdown(ctx); err != nil {
+		logger.Errorf("Shutdown raise error: %s", err)
+	}
+	wg.Wait()
+	logger.Infof("shutdown completed")
 }
@@ -0,0 +1,251 @@
+/*
+Package metrics : collect the metrics of the duplication check and expose them in Prometheus format.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+const (
+	namespace = "msgfilter"
+
+	// VerdictNew : the message is not duplicate
+	VerdictNew = "new"
+	// VerdictDuplicate : the message is duplicate
+	VerdictDuplicate = "duplicate"
+	// VerdictError : the duplication could not be checked
+	VerdictError = "error"
+
+	// OtherTenant : the tenant label of the tenants over METRICS_TENANT_LIMIT
+	OtherTenant = "other"
+)
+
+var (
+	// Registry : the registry of all metrics of this service
+	Registry = prometheus.NewRegistry()
+
+	checks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "checks_total",
+		Help:      "Number of the duplication checks by verdict.",
+	}, []string{"verdict", "tenant"})
+
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "check_duration_seconds",
+		Help:      "Latency of the whole duplication check.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"verdict", "tenant"})
+
+	etcdDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "etcd_request_duration_seconds",
+		Help:      "Latency of each etcd request.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	storeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_errors_total",
+		Help:      "Number of the failed etcd requests by error type.",
+	}, []string{"operation", "type"})
+
+	lockWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lock_wait_seconds",
+		Help:      "Time to acquire the distributed lock.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	lockRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_retries_total",
+		Help:      "Number of the retries to acquire the distributed lock.",
+	})
+
+	inFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "in_flight_requests",
+		Help:      "Number of the requests in process.",
+	})
+
+	auditDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "audit_dropped_total",
+		Help:      "Number of the audit records dropped because the audit buffer was full.",
+	})
+
+	rejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "Number of the requests rejected by the rate limits or the quotas.",
+	}, []string{"reason", "tenant"})
+
+	bridgeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bridge_errors_total",
+		Help:      "Number of the MQTT messages whose duplication could not be checked by MQTT bridge.",
+	}, []string{"action"})
+
+	tenants = &tenantSet{
+		labels: map[string]bool{},
+	}
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		checks,
+		checkDuration,
+		etcdDuration,
+		storeErrors,
+		lockWait,
+		lockRetries,
+		inFlight,
+		auditDropped,
+		rejected,
+		bridgeErrors,
+	)
+}
+
+/*
+Handler : a http.Handler to expose the metrics.
+*/
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+/*
+Tenant : the tenant label of the argument service.
+	The label is empty unless METRICS_TENANT_LABEL is true,
+	and the tenants over METRICS_TENANT_LIMIT are aggregated into OtherTenant to limit the cardinality.
+*/
+func Tenant(config *conf.Config, service string) string {
+	if !config.MetricsTenantLabel {
+		return ""
+	}
+	return tenants.label(service, config.MetricsTenantLimit)
+}
+
+/*
+ObserveCheck : count the duplication check and observe its latency.
+*/
+func ObserveCheck(tenant string, verdict string, start time.Time) {
+	checks.WithLabelValues(verdict, tenant).Inc()
+	checkDuration.WithLabelValues(verdict, tenant).Observe(time.Since(start).Seconds())
+}
+
+/*
+ObserveEtcd : observe the latency of an etcd request and count the error if failed.
+	The expected errors in the duplication check (key not found and node exists) are not counted.
+*/
+func ObserveEtcd(operation string, start time.Time, err error) {
+	etcdDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if errorType, ok := classify(err); ok {
+		storeErrors.WithLabelValues(operation, errorType).Inc()
+	}
+}
+
+/*
+ObserveLock : observe the time to acquire the distributed lock and count the retries.
+*/
+func ObserveLock(start time.Time, retries int) {
+	lockWait.Observe(time.Since(start).Seconds())
+	lockRetries.Add(float64(retries))
+}
+
+/*
+IncInFlight : increase the number of the requests in process.
+*/
+func IncInFlight() {
+	inFlight.Inc()
+}
+
+/*
+DecInFlight : decrease the number of the requests in process.
+*/
+func DecInFlight() {
+	inFlight.Dec()
+}
+
+/*
+IncAuditDropped : count the audit record dropped without being written.
+*/
+func IncAuditDropped() {
+	auditDropped.Inc()
+}
+
+/*
+IncRejected : count the request rejected by the rate limit or the quota.
+*/
+func IncRejected(tenant string, reason string) {
+	rejected.WithLabelValues(reason, tenant).Inc()
+}
+
+/*
+IncBridgeError : count the MQTT message whose duplication could not be checked, by the action of MQTT_ON_ERROR.
+*/
+func IncBridgeError(action string) {
+	bridgeErrors.WithLabelValues(action).Inc()
+}
+
+func classify(err error) (string, bool) {
+	if err == nil {
+		return "", false
+	}
+	switch e := err.(type) {
+	case client.Error:
+		switch e.Code {
+		case client.ErrorCodeKeyNotFound, client.ErrorCodeNodeExist:
+			return "", false
+		case client.ErrorCodeTestFailed:
+			return "test_failed", true
+		case client.ErrorCodeRaftInternal, client.ErrorCodeLeaderElect:
+			return "unavailable", true
+		}
+		return "etcd_" + strconv.Itoa(e.Code), true
+	case *client.ClusterError:
+		return "cluster", true
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return "timeout", true
+	case context.Canceled:
+		return "canceled", true
+	}
+	return "other", true
+}
+
+// tenantSet : the tenants which have their own labels
+type tenantSet struct {
+	mutex  sync.Mutex
+	labels map[string]bool
+}
+
+func (s *tenantSet) label(service string, limit int) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.labels[service] {
+		return service
+	}
+	if len(s.labels) >= limit {
+		return OtherTenant
+	}
+	s.labels[service] = true
+	return service
+}
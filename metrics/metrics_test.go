@@ -0,0 +1,126 @@
+/*
+Package metrics : collect the metrics of the duplication check and expose them in Prometheus format.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+func TestTenant(t *testing.T) {
+	assert := assert.New(t)
+	tenants = &tenantSet{labels: map[string]bool{}}
+
+	config := conf.NewConfig()
+	assert.Equal("", Tenant(config, "a"))
+
+	config.MetricsTenantLabel = true
+	config.MetricsTenantLimit = 2
+	assert.Equal("a", Tenant(config, "a"))
+	assert.Equal("b", Tenant(config, "b"))
+	assert.Equal(OtherTenant, Tenant(config, "c"))
+	assert.Equal("a", Tenant(config, "a"))
+	assert.Equal(OtherTenant, Tenant(config, "d"))
+}
+
+func TestObserveCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	before := testutil.ToFloat64(checks.WithLabelValues(VerdictDuplicate, "t"))
+	ObserveCheck("t", VerdictDuplicate, time.Now())
+	ObserveCheck("t", VerdictDuplicate, time.Now())
+	assert.Equal(before+2, testutil.ToFloat64(checks.WithLabelValues(VerdictDuplicate, "t")))
+}
+
+func TestObserveEtcd(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{err: client.Error{Code: client.ErrorCodeTestFailed}, expected: "test_failed"},
+		{err: client.Error{Code: client.ErrorCodeLeaderElect}, expected: "unavailable"},
+		{err: client.Error{Code: client.ErrorCodeNotFile}, expected: "etcd_102"},
+		{err: &client.ClusterError{}, expected: "cluster"},
+		{err: context.DeadlineExceeded, expected: "timeout"},
+		{err: context.Canceled, expected: "canceled"},
+		{err: errors.New("error"), expected: "other"},
+	}
+	for _, testCase := range testCases {
+		before := testutil.ToFloat64(storeErrors.WithLabelValues("get", testCase.expected))
+		ObserveEtcd("get", time.Now(), testCase.err)
+		assert.Equal(before+1, testutil.ToFloat64(storeErrors.WithLabelValues("get", testCase.expected)), testCase.expected)
+	}
+
+	for _, err := range []error{nil, client.Error{Code: client.ErrorCodeKeyNotFound}, client.Error{Code: client.ErrorCodeNodeExist}} {
+		_, ok := classify(err)
+		assert.False(ok)
+	}
+}
+
+func TestObserveLockAndInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	before := testutil.ToFloat64(lockRetries)
+	ObserveLock(time.Now(), 2)
+	assert.Equal(before+2, testutil.ToFloat64(lockRetries))
+
+	IncInFlight()
+	assert.Equal(float64(1), testutil.ToFloat64(inFlight))
+	DecInFlight()
+	assert.Equal(float64(0), testutil.ToFloat64(inFlight))
+
+	before = testutil.ToFloat64(auditDropped)
+	IncAuditDropped()
+	assert.Equal(before+1, testutil.ToFloat64(auditDropped))
+}
+
+func TestIncRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	before := testutil.ToFloat64(rejected.WithLabelValues("quota", "smartcity"))
+	IncRejected("smartcity", "quota")
+	assert.Equal(before+1, testutil.ToFloat64(rejected.WithLabelValues("quota", "smartcity")))
+}
+
+func TestIncBridgeError(t *testing.T) {
+	assert := assert.New(t)
+
+	before := testutil.ToFloat64(bridgeErrors.WithLabelValues("drop"))
+	IncBridgeError("drop")
+	assert.Equal(before+1, testutil.ToFloat64(bridgeErrors.WithLabelValues("drop")))
+}
+
+func TestHandler(t *testing.T) {
+	assert := assert.New(t)
+	ObserveCheck("", VerdictNew, time.Now())
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	for _, name := range []string{
+		"msgfilter_checks_total",
+		"msgfilter_check_duration_seconds",
+		"msgfilter_in_flight_requests",
+		"msgfilter_lock_retries_total",
+		"go_goroutines",
+	} {
+		assert.True(strings.Contains(w.Body.String(), name), name)
+	}
+}
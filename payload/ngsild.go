@@ -0,0 +1,237 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const (
+	ldContext          = "@context"
+	ldValue            = "@value"
+	ldData             = "data"
+	ldValueMember      = "value"
+	ldObject           = "object"
+	ldLanguageMap      = "languageMap"
+	ldProperty         = "Property"
+	ldGeoProperty      = "GeoProperty"
+	ldRelationship     = "Relationship"
+	ldLanguageProperty = "LanguageProperty"
+	ldNotification     = "Notification"
+)
+
+// the temporal members which are different in every observation or every update of the same value
+var ldTimestamps = map[string]bool{
+	"observedAt": true,
+	"createdAt":  true,
+	"modifiedAt": true,
+}
+
+// the members of an attribute which are not sub-attributes
+var ldMetaMembers = map[string]bool{
+	"unitCode":  true,
+	"datasetId": true,
+}
+
+type ldEntity struct {
+	ID    string                 `json:"id"`
+	Type  interface{}            `json:"type"`
+	Attrs map[string]interface{} `json:"attrs"`
+}
+
+// ngsiLDIdentity computes the identity of NGSI-LD payload, which is an entity, an array of entities
+// or a notification which has entities in "data".
+// "@context" is ignored, and the attributes are compared by their values (the objects of relationships)
+// regardless of the representation (normalized, concise or keyValues), the order of the members
+// and the order of the multi-attribute instances.
+// The temporal members like "observedAt" are ignored when ExcludeTimestamp is true.
+func ngsiLDIdentity(payload string, opts Options) (string, error) {
+	var body interface{}
+	if err := json.Unmarshal([]byte(payload), &body); err != nil {
+		return "", &Error{PayloadType: NGSILD, Reason: jsonReason(err)}
+	}
+
+	var rawEntities []interface{}
+	switch b := body.(type) {
+	case map[string]interface{}:
+		if b[ngsiType] == ldNotification {
+			es, ok := b[ldData].([]interface{})
+			if !ok {
+				return "", &Error{PayloadType: NGSILD, Reason: "data of notification is not an array"}
+			}
+			rawEntities = es
+		} else {
+			rawEntities = []interface{}{b}
+		}
+	case []interface{}:
+		rawEntities = b
+	default:
+		return "", &Error{PayloadType: NGSILD, Reason: "neither an entity nor entities"}
+	}
+
+	entities := []*ldEntity{}
+	for _, raw := range rawEntities {
+		e, err := parseNGSILDEntity(raw, opts)
+		if err != nil {
+			return "", err
+		}
+		entities = append(entities, e)
+	}
+	if len(entities) == 0 {
+		return "", &Error{PayloadType: NGSILD, Reason: "no entity"}
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].ID != entities[j].ID {
+			return entities[i].ID < entities[j].ID
+		}
+		return marshalString(entities[i].Type) < marshalString(entities[j].Type)
+	})
+
+	b, err := json.Marshal(entities)
+	if err != nil {
+		return "", &Error{PayloadType: NGSILD, Reason: jsonReason(err)}
+	}
+	return string(b), nil
+}
+
+func parseNGSILDEntity(raw interface{}, opts Options) (*ldEntity, error) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, &Error{PayloadType: NGSILD, Reason: "entity is not an object"}
+	}
+	e := &ldEntity{
+		Attrs: map[string]interface{}{},
+	}
+	e.ID, _ = m[ngsiID].(string)
+	if len(e.ID) == 0 {
+		return nil, &Error{PayloadType: NGSILD, Reason: "entity has no id"}
+	}
+	e.Type = normalizeLDType(m[ngsiType])
+
+	for name, attr := range m {
+		if name == ngsiID || name == ngsiType || name == ldContext {
+			continue
+		}
+		if ldTimestamps[name] {
+			if !opts.ExcludeTimestamp {
+				e.Attrs[name] = attr
+			}
+			continue
+		}
+		e.Attrs[name] = normalizeLDAttr(attr, opts)
+	}
+	return e, nil
+}
+
+// normalizeLDType makes the multiple types of an entity independent of their order.
+func normalizeLDType(t interface{}) interface{} {
+	ts, ok := t.([]interface{})
+	if !ok {
+		return t
+	}
+	if len(ts) == 1 {
+		return ts[0]
+	}
+	sorted := append([]interface{}{}, ts...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return marshalString(sorted[i]) < marshalString(sorted[j])
+	})
+	return sorted
+}
+
+// normalizeLDAttr converts an attribute of any representation into {"type": ..., "value"|"object"|"languageMap": ...}.
+// GeoProperty is regarded as Property, because the concise representation can not distinguish them.
+func normalizeLDAttr(attr interface{}, opts Options) interface{} {
+	// the instances of a multi-attribute are distinguished by their datasetId, not by their order
+	if instances, ok := attr.([]interface{}); ok && isLDMultiAttribute(instances) {
+		normalized := []interface{}{}
+		for _, i := range instances {
+			normalized = append(normalized, normalizeLDAttr(i, opts))
+		}
+		sort.SliceStable(normalized, func(i, j int) bool {
+			return marshalString(normalized[i]) < marshalString(normalized[j])
+		})
+		return normalized
+	}
+
+	m, ok := attr.(map[string]interface{})
+	if !ok || !isLDAttribute(m) {
+		// keyValues representation
+		return map[string]interface{}{
+			ngsiType:      ldProperty,
+			ldValueMember: normalizeLDValue(attr),
+		}
+	}
+
+	normalized := map[string]interface{}{}
+	for name, member := range m {
+		switch {
+		case name == ngsiType:
+			continue
+		case name == ldValueMember:
+			normalized[ngsiType] = ldProperty
+			normalized[name] = normalizeLDValue(member)
+		case name == ldObject:
+			normalized[ngsiType] = ldRelationship
+			normalized[name] = normalizeLDType(member)
+		case name == ldLanguageMap:
+			normalized[ngsiType] = ldLanguageProperty
+			normalized[name] = member
+		case ldTimestamps[name]:
+			if !opts.ExcludeTimestamp {
+				normalized[name] = member
+			}
+		case ldMetaMembers[name]:
+			normalized[name] = member
+		default:
+			// sub-attribute
+			normalized[name] = normalizeLDAttr(member, opts)
+		}
+	}
+	return normalized
+}
+
+// normalizeLDValue unwraps the JSON-LD value object like {"@value": "2018-06-01T00:00:00Z", "@type": "DateTime"}.
+func normalizeLDValue(value interface{}) interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		if v, ok := m[ldValue]; ok {
+			return v
+		}
+	}
+	return value
+}
+
+func isLDAttribute(m map[string]interface{}) bool {
+	switch m[ngsiType] {
+	case ldProperty, ldGeoProperty, ldRelationship, ldLanguageProperty:
+		return true
+	}
+	_, hasValue := m[ldValueMember]
+	_, hasObject := m[ldObject]
+	_, hasLanguageMap := m[ldLanguageMap]
+	return hasValue || hasObject || hasLanguageMap
+}
+
+func isLDMultiAttribute(instances []interface{}) bool {
+	if len(instances) == 0 {
+		return false
+	}
+	for _, i := range instances {
+		m, ok := i.(map[string]interface{})
+		if !ok || !isLDAttribute(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalString is used to sort the values of any type, json.Marshal never fails for the unmarshaled values.
+func marshalString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,142 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNGSILDIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	identity, err := Identity(NGSILD, `{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"unitCode":"CEL"},"isPartOf":{"type":"Relationship","object":"urn:ngsi-ld:Building:1"}}`, Options{})
+	assert.NoError(err)
+	assert.Equal(`[{"id":"urn:ngsi-ld:Room:1","type":"Room","attrs":{"isPartOf":{"object":"urn:ngsi-ld:Building:1","type":"Relationship"},"temperature":{"type":"Property","unitCode":"CEL","value":25.3}}}]`, identity)
+}
+
+func TestNGSILDIdentitySame(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name     string
+		exclude  bool
+		payloads []string
+	}{
+		{
+			name: "context and representation",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3},"isPartOf":{"type":"Relationship","object":"urn:ngsi-ld:Building:1"},"@context":"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"}`,
+				`{"@context":["https://example.com/context.jsonld"],"isPartOf":{"object":"urn:ngsi-ld:Building:1"},"temperature":{"value":25.30},"type":"Room","id":"urn:ngsi-ld:Room:1"}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":["Room"],"temperature":25.3,"isPartOf":{"type":"Relationship","object":"urn:ngsi-ld:Building:1"}}`,
+			},
+		},
+		{
+			name: "geo property and value object",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[139.7,35.6]}},"since":{"type":"Property","value":{"@type":"DateTime","@value":"2018-06-01T00:00:00Z"}}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","location":{"value":{"coordinates":[139.7,35.6],"type":"Point"}},"since":"2018-06-01T00:00:00Z"}`,
+			},
+		},
+		{
+			name: "multi-attribute and multiple types",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":["Room","Space"],"temperature":[{"type":"Property","value":25.3,"datasetId":"urn:a"},{"type":"Property","value":25.1,"datasetId":"urn:b"}]}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":["Space","Room"],"temperature":[{"value":25.1,"datasetId":"urn:b"},{"value":25.3,"datasetId":"urn:a"}]}`,
+			},
+		},
+		{
+			name:    "observedAt",
+			exclude: true,
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"observedAt":"2018-06-01T00:00:00Z","accuracy":{"type":"Property","value":0.1,"observedAt":"2018-06-01T00:00:00Z"}}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","modifiedAt":"2018-06-01T00:00:01Z","temperature":{"type":"Property","value":25.3,"observedAt":"2018-06-01T00:00:01Z","accuracy":{"type":"Property","value":0.1}}}`,
+			},
+		},
+		{
+			name: "entities and notification",
+			payloads: []string{
+				`[{"id":"urn:ngsi-ld:Room:2","type":"Room","temperature":21},{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":25.3}]`,
+				`{"id":"urn:ngsi-ld:Notification:1","type":"Notification","subscriptionId":"urn:ngsi-ld:Subscription:1","notifiedAt":"2018-06-01T00:00:00Z","data":[{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3}},{"id":"urn:ngsi-ld:Room:2","type":"Room","temperature":{"type":"Property","value":21}}]}`,
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		expected, err := Identity(NGSILD, testCase.payloads[0], Options{ExcludeTimestamp: testCase.exclude})
+		assert.NoError(err, testCase.name)
+		for _, payload := range testCase.payloads[1:] {
+			identity, err := Identity(NGSILD, payload, Options{ExcludeTimestamp: testCase.exclude})
+			assert.NoError(err, payload)
+			assert.Equal(expected, identity, testCase.name)
+		}
+	}
+}
+
+func TestNGSILDIdentityDifferent(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name     string
+		payloads []string
+	}{
+		{
+			name: "value",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.4}}`,
+			},
+		},
+		{
+			name: "property and relationship",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","owner":{"type":"Property","value":"urn:ngsi-ld:Person:1"}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","owner":{"type":"Relationship","object":"urn:ngsi-ld:Person:1"}}`,
+			},
+		},
+		{
+			name: "unitCode",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"unitCode":"CEL"}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"unitCode":"FAH"}}`,
+			},
+		},
+		{
+			name: "observedAt",
+			payloads: []string{
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"observedAt":"2018-06-01T00:00:00Z"}}`,
+				`{"id":"urn:ngsi-ld:Room:1","type":"Room","temperature":{"type":"Property","value":25.3,"observedAt":"2018-06-01T00:00:01Z"}}`,
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		first, err := Identity(NGSILD, testCase.payloads[0], Options{})
+		assert.NoError(err, testCase.name)
+		second, err := Identity(NGSILD, testCase.payloads[1], Options{})
+		assert.NoError(err, testCase.name)
+		assert.NotEqual(first, second, testCase.name)
+	}
+}
+
+func TestNGSILDIdentityError(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, payload := range []string{
+		"",
+		"invalid",
+		`"urn:ngsi-ld:Room:1"`,
+		`[]`,
+		`["urn:ngsi-ld:Room:1"]`,
+		`{"type":"Room","temperature":25.3}`,
+		`{"type":"Notification","data":{"id":"urn:ngsi-ld:Room:1"}}`,
+		`{"type":"Notification","data":[]}`,
+	} {
+		identity, err := Identity(NGSILD, payload, Options{})
+		assert.Equal("", identity, payload)
+		assert.IsType(&Error{}, err, payload)
+	}
+}
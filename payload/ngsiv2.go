@@ -0,0 +1,118 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const (
+	ngsiID       = "id"
+	ngsiType     = "type"
+	ngsiValue    = "value"
+	ngsiEntities = "entities"
+	ngsiAction   = "actionType"
+)
+
+type ngsiEntity struct {
+	ID    string                 `json:"id"`
+	Type  string                 `json:"type"`
+	Attrs map[string]interface{} `json:"attrs"`
+}
+
+// ngsiV2Identity computes the identity of NGSI v2 payload, which is a body of
+// "POST /v2/entities" (an entity) or "POST /v2/op/update" (actionType and entities).
+// Only id, type and the values of attributes are compared, so that the order of attributes and entities,
+// the types and metadata of attributes and the formats of the JSON do not affect the identity.
+func ngsiV2Identity(payload string, opts Options) (string, error) {
+	var body interface{}
+	if err := json.Unmarshal([]byte(payload), &body); err != nil {
+		return "", &Error{PayloadType: NGSIv2, Reason: jsonReason(err)}
+	}
+
+	action := ""
+	var rawEntities []interface{}
+	switch b := body.(type) {
+	case map[string]interface{}:
+		if es, ok := b[ngsiEntities]; ok {
+			action, _ = b[ngsiAction].(string)
+			rawEntities, ok = es.([]interface{})
+			if !ok {
+				return "", &Error{PayloadType: NGSIv2, Reason: "entities is not an array"}
+			}
+		} else {
+			rawEntities = []interface{}{b}
+		}
+	case []interface{}:
+		rawEntities = b
+	default:
+		return "", &Error{PayloadType: NGSIv2, Reason: "neither an entity nor entities"}
+	}
+
+	entities := []*ngsiEntity{}
+	for _, raw := range rawEntities {
+		e, err := parseNGSIv2Entity(raw, opts)
+		if err != nil {
+			return "", err
+		}
+		entities = append(entities, e)
+	}
+	if len(entities) == 0 {
+		return "", &Error{PayloadType: NGSIv2, Reason: "no entity"}
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Type != entities[j].Type {
+			return entities[i].Type < entities[j].Type
+		}
+		return entities[i].ID < entities[j].ID
+	})
+
+	// json.Marshal sorts the keys of map, so the identity does not depend on the order of attributes
+	b, err := json.Marshal(entities)
+	if err != nil {
+		return "", &Error{PayloadType: NGSIv2, Reason: jsonReason(err)}
+	}
+	if len(action) != 0 {
+		return strings.ToLower(action) + ":" + string(b), nil
+	}
+	return string(b), nil
+}
+
+func parseNGSIv2Entity(raw interface{}, opts Options) (*ngsiEntity, error) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, &Error{PayloadType: NGSIv2, Reason: "entity is not an object"}
+	}
+	e := &ngsiEntity{
+		Attrs: map[string]interface{}{},
+	}
+	e.ID, _ = m[ngsiID].(string)
+	if len(e.ID) == 0 {
+		return nil, &Error{PayloadType: NGSIv2, Reason: "entity has no id"}
+	}
+	e.Type, _ = m[ngsiType].(string)
+
+	for name, attr := range m {
+		if name == ngsiID || name == ngsiType {
+			continue
+		}
+		if opts.ExcludeTimestamp && name == timeInstant {
+			continue
+		}
+		// the attribute of normalized representation has its value in "value", and the one of keyValues is a value itself
+		if a, ok := attr.(map[string]interface{}); ok {
+			if v, ok := a[ngsiValue]; ok {
+				e.Attrs[name] = v
+				continue
+			}
+		}
+		e.Attrs[name] = attr
+	}
+	return e, nil
+}
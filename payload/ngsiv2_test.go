@@ -0,0 +1,78 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNGSIv2Identity(t *testing.T) {
+	assert := assert.New(t)
+
+	entity := `[{"id":"Room1","type":"Room","attrs":{"humidity":40,"temperature":25.3}}]`
+	testCases := []struct {
+		payload  string
+		exclude  bool
+		expected string
+	}{
+		{
+			payload:  `{"id":"Room1","type":"Room","temperature":{"value":25.3,"type":"Number"},"humidity":{"value":40,"type":"Number"}}`,
+			expected: entity,
+		},
+		{
+			payload:  `{"humidity":{"type":"Number","value":40.0,"metadata":{"unit":{"value":"%"}}}, "type":"Room", "temperature":{"value":25.30}, "id":"Room1"}`,
+			expected: entity,
+		},
+		{
+			payload:  `{"id":"Room1","type":"Room","temperature":25.3,"humidity":40}`,
+			expected: entity,
+		},
+		{
+			payload:  `{"id":"Room1","type":"Room","temperature":25.3,"humidity":40,"TimeInstant":"2018-06-01T00:00:00Z"}`,
+			exclude:  true,
+			expected: entity,
+		},
+		{
+			payload:  `{"id":"Room1","type":"Room","temperature":25.3,"TimeInstant":"2018-06-01T00:00:00Z"}`,
+			expected: `[{"id":"Room1","type":"Room","attrs":{"TimeInstant":"2018-06-01T00:00:00Z","temperature":25.3}}]`,
+		},
+		{
+			payload:  `{"actionType":"APPEND","entities":[{"id":"Room2","type":"Room","temperature":{"value":21}},{"id":"Room1","type":"Room","temperature":{"value":25.3}}]}`,
+			expected: `append:[{"id":"Room1","type":"Room","attrs":{"temperature":25.3}},{"id":"Room2","type":"Room","attrs":{"temperature":21}}]`,
+		},
+		{
+			payload:  `{"actionType":"append","entities":[{"id":"Room1","type":"Room","temperature":{"value":25.3}},{"id":"Room2","type":"Room","temperature":{"value":21}}]}`,
+			expected: `append:[{"id":"Room1","type":"Room","attrs":{"temperature":25.3}},{"id":"Room2","type":"Room","attrs":{"temperature":21}}]`,
+		},
+	}
+	for _, testCase := range testCases {
+		identity, err := Identity(NGSIv2, testCase.payload, Options{ExcludeTimestamp: testCase.exclude})
+		assert.NoError(err, testCase.payload)
+		assert.Equal(testCase.expected, identity, testCase.payload)
+	}
+}
+
+func TestNGSIv2IdentityError(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, payload := range []string{
+		"",
+		"invalid",
+		`"Room1"`,
+		`[]`,
+		`["Room1"]`,
+		`{"type":"Room","temperature":25.3}`,
+		`{"actionType":"append","entities":{"id":"Room1"}}`,
+		`{"actionType":"append","entities":[]}`,
+	} {
+		identity, err := Identity(NGSIv2, payload, Options{})
+		assert.Equal("", identity, payload)
+		assert.IsType(&Error{}, err, payload)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// Raw : the payload is compared as it is
+	Raw = "raw"
+	// UltraLight : the payload is parsed as FIWARE IoT Agent UltraLight 2.0
+	UltraLight = "ul"
+	// NGSIv2 : the payload is parsed as NGSI v2 entity or entities
+	NGSIv2 = "ngsi-v2"
+	// NGSILD : the payload is parsed as NGSI-LD entity or entities
+	NGSILD = "ngsi-ld"
+)
+
+/*
+Options : options to compute the identity of the payload
+	ExcludeTimestamp : whether the timestamp attributes are excluded from the identity
+*/
+type Options struct {
+	ExcludeTimestamp bool
+}
+
+/*
+Error : an error raised when the payload can not be parsed as its type
+	Reason never contains the payload, because the error is logged regardless of LOG_PAYLOAD.
+*/
+type Error struct {
+	PayloadType string
+	Reason      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid %s payload: %s", e.PayloadType, e.Reason)
+}
+
+// jsonReason describes the JSON error without the fragment of the payload which the error message may quote.
+func jsonReason(err error) string {
+	if e, ok := err.(*json.SyntaxError); ok {
+		return fmt.Sprintf("invalid JSON at offset %d", e.Offset)
+	}
+	return "invalid JSON"
+}
+
+type identifier func(payload string, opts Options) (string, error)
+
+var identifiers = map[string]identifier{
+	Raw:        rawIdentity,
+	UltraLight: ulIdentity,
+	NGSIv2:     ngsiV2Identity,
+	NGSILD:     ngsiLDIdentity,
+}
+
+/*
+Valid : check whether the argument is a supported payload type.
+	An empty payload type means Raw.
+*/
+func Valid(payloadType string) bool {
+	if len(payloadType) == 0 {
+		return true
+	}
+	_, ok := identifiers[payloadType]
+	return ok
+}
+
+/*
+Identity : compute the identity of the payload according to its type.
+	The payloads which have the same identity are regarded as duplicate.
+*/
+func Identity(payloadType string, payload string, opts Options) (string, error) {
+	if len(payloadType) == 0 {
+		payloadType = Raw
+	}
+	f, ok := identifiers[payloadType]
+	if !ok {
+		return "", &Error{PayloadType: payloadType, Reason: "unknown payload type"}
+	}
+	return f(payload, opts)
+}
+
+func rawIdentity(payload string, _ Options) (string, error) {
+	return payload, nil
+}
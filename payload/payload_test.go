@@ -0,0 +1,56 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValid(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, payloadType := range []string{"", Raw, UltraLight, NGSIv2, NGSILD} {
+		assert.True(Valid(payloadType), payloadType)
+	}
+	assert.False(Valid("unknown"))
+}
+
+func TestRawIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, payloadType := range []string{"", Raw} {
+		identity, err := Identity(payloadType, "h|40|t|25.3", Options{ExcludeTimestamp: true})
+		assert.NoError(err)
+		assert.Equal("h|40|t|25.3", identity)
+	}
+
+	identity, err := Identity("unknown", "h|40|t|25.3", Options{})
+	assert.Equal("", identity)
+	assert.EqualError(err, "invalid unknown payload: unknown payload type")
+}
+
+func TestErrorWithoutPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	// the reasons never quote the payload, because they are logged
+	testCases := []struct {
+		payloadType string
+		payload     string
+		expected    string
+	}{
+		{payloadType: UltraLight, payload: "t|25.3| |secret", expected: "invalid ul payload: empty measure name"},
+		{payloadType: NGSIv2, payload: "secret", expected: "invalid ngsi-v2 payload: invalid JSON at offset 1"},
+		{payloadType: NGSIv2, payload: `{"id":"secret"`, expected: "invalid ngsi-v2 payload: invalid JSON at offset 14"},
+		{payloadType: NGSILD, payload: "secret", expected: "invalid ngsi-ld payload: invalid JSON at offset 1"},
+	}
+	for _, testCase := range testCases {
+		_, err := Identity(testCase.payloadType, testCase.payload, Options{})
+		assert.EqualError(err, testCase.expected, testCase.payload)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	ulGroupSeparator = "#"
+	ulFieldSeparator = "|"
+	timeInstant      = "TimeInstant"
+)
+
+type ulMeasure struct {
+	name  string
+	value string
+}
+
+// ulIdentity computes the identity of UltraLight 2.0 payload like "t|25.3|h|40#t|25.4|h|41".
+// The measures of each group are sorted by their names, and the groups are sorted too,
+// so that the order of measures and groups does not affect the identity.
+func ulIdentity(payload string, opts Options) (string, error) {
+	groups := []string{}
+	for _, g := range strings.Split(payload, ulGroupSeparator) {
+		if len(strings.TrimSpace(g)) == 0 {
+			continue
+		}
+		measures, err := parseULGroup(g)
+		if err != nil {
+			return "", err
+		}
+
+		fields := []string{}
+		for _, m := range measures {
+			if opts.ExcludeTimestamp && m.name == timeInstant {
+				continue
+			}
+			fields = append(fields, m.name, m.value)
+		}
+		if len(fields) != 0 {
+			groups = append(groups, strings.Join(fields, ulFieldSeparator))
+		}
+	}
+	if len(groups) == 0 {
+		return "", &Error{PayloadType: UltraLight, Reason: "no measure"}
+	}
+	sort.Strings(groups)
+	return strings.Join(groups, ulGroupSeparator), nil
+}
+
+// parseULGroup parses a measure group like "t|25.3|h|40".
+// A group which has odd number of fields starts with its timestamp, which is regarded as TimeInstant measure.
+func parseULGroup(group string) ([]ulMeasure, error) {
+	fields := strings.Split(strings.TrimSpace(group), ulFieldSeparator)
+	measures := []ulMeasure{}
+	if len(fields)%2 == 1 {
+		measures = append(measures, ulMeasure{name: timeInstant, value: fields[0]})
+		fields = fields[1:]
+	}
+	for i := 0; i < len(fields); i += 2 {
+		name := strings.TrimSpace(fields[i])
+		if len(name) == 0 {
+			return nil, &Error{PayloadType: UltraLight, Reason: "empty measure name"}
+		}
+		measures = append(measures, ulMeasure{name: name, value: strings.TrimSpace(fields[i+1])})
+	}
+	sort.SliceStable(measures, func(i, j int) bool {
+		if measures[i].name != measures[j].name {
+			return measures[i].name < measures[j].name
+		}
+		return measures[i].value < measures[j].value
+	})
+	return measures, nil
+}
@@ -0,0 +1,59 @@
+/*
+Package payload : compute the identity of the payload which is used as the key of duplication check.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package payload
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestULIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		payload  string
+		exclude  bool
+		expected string
+	}{
+		{payload: "t|25.3|h|40", expected: "h|40|t|25.3"},
+		{payload: "h|40|t|25.3", expected: "h|40|t|25.3"},
+		{payload: " t | 25.3 | h | 40 ", expected: "h|40|t|25.3"},
+		{payload: "t|25.3|h|40#t|25.4|h|41", expected: "h|40|t|25.3#h|41|t|25.4"},
+		{payload: "h|41|t|25.4#t|25.3|h|40#", expected: "h|40|t|25.3#h|41|t|25.4"},
+		{payload: "t|25.3|h|", expected: "h||t|25.3"},
+		{payload: "2018-06-01T00:00:00Z|t|25.3", expected: "TimeInstant|2018-06-01T00:00:00Z|t|25.3"},
+		{payload: "2018-06-01T00:00:00Z|t|25.3", exclude: true, expected: "t|25.3"},
+		{payload: "t|25.3|TimeInstant|2018-06-01T00:00:00Z", exclude: true, expected: "t|25.3"},
+		{payload: "t|25.3#TimeInstant|2018-06-01T00:00:00Z", exclude: true, expected: "t|25.3"},
+	}
+	for _, testCase := range testCases {
+		identity, err := Identity(UltraLight, testCase.payload, Options{ExcludeTimestamp: testCase.exclude})
+		assert.NoError(err, testCase.payload)
+		assert.Equal(testCase.expected, identity, testCase.payload)
+	}
+}
+
+func TestULIdentityError(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		payload string
+		exclude bool
+	}{
+		{payload: ""},
+		{payload: "#"},
+		{payload: "|25.3"},
+		{payload: "t|25.3|  |40"},
+		{payload: "TimeInstant|2018-06-01T00:00:00Z", exclude: true},
+	}
+	for _, testCase := range testCases {
+		identity, err := Identity(UltraLight, testCase.payload, Options{ExcludeTimestamp: testCase.exclude})
+		assert.Equal("", identity, testCase.payload)
+		assert.IsType(&Error{}, err, testCase.payload)
+	}
+}
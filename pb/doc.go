@@ -0,0 +1,9 @@
+/*
+Package pb : the gRPC API generated from msgfilter.proto, which is served by router.Handler on GRPC_PORT.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative msgfilter.proto
@@ -0,0 +1,346 @@
+// msgfilter.proto : the gRPC API to check message duplication, which is served on GRPC_PORT.
+//
+//   license: Apache license 2.0
+//   copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+//
+// Fiware-Service and the credentials (x-api-key, authorization or x-auth-token) are given as the metadata.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.33.0
+// 	protoc        (unknown)
+// source: msgfilter.proto
+
+package pb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type CheckResponse_Result int32
+
+const (
+	CheckResponse_RESULT_UNSPECIFIED CheckResponse_Result = 0
+	CheckResponse_SUCCESS            CheckResponse_Result = 1
+	CheckResponse_DUPLICATE          CheckResponse_Result = 2
+	CheckResponse_FAILURE            CheckResponse_Result = 3
+)
+
+// Enum value maps for CheckResponse_Result.
+var (
+	CheckResponse_Result_name = map[int32]string{
+		0: "RESULT_UNSPECIFIED",
+		1: "SUCCESS",
+		2: "DUPLICATE",
+		3: "FAILURE",
+	}
+	CheckResponse_Result_value = map[string]int32{
+		"RESULT_UNSPECIFIED": 0,
+		"SUCCESS":            1,
+		"DUPLICATE":          2,
+		"FAILURE":            3,
+	}
+)
+
+func (x CheckResponse_Result) Enum() *CheckResponse_Result {
+	p := new(CheckResponse_Result)
+	*p = x
+	return p
+}
+
+func (x CheckResponse_Result) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (CheckResponse_Result) Descriptor() protoreflect.EnumDescriptor {
+	return file_msgfilter_proto_enumTypes[0].Descriptor()
+}
+
+func (CheckResponse_Result) Type() protoreflect.EnumType {
+	return &file_msgfilter_proto_enumTypes[0]
+}
+
+func (x CheckResponse_Result) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use CheckResponse_Result.Descriptor instead.
+func (CheckResponse_Result) EnumDescriptor() ([]byte, []int) {
+	return file_msgfilter_proto_rawDescGZIP(), []int{1, 0}
+}
+
+type CheckRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// the raw bytes of the message, which may be binary
+	Payload []byte `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	// MQTT topic of the message (optional)
+	Topic string `protobuf:"bytes,2,opt,name=topic,proto3" json:"topic,omitempty"`
+	// how to compare the payloads: raw (default), ul, ngsi-v2 or ngsi-ld
+	PayloadType string `protobuf:"bytes,3,opt,name=payload_type,json=payloadType,proto3" json:"payload_type,omitempty"`
+	// an id chosen by the client to correlate the responses of CheckStream (optional)
+	Id string `protobuf:"bytes,4,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *CheckRequest) Reset() {
+	*x = CheckRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_msgfilter_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CheckRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckRequest) ProtoMessage() {}
+
+func (x *CheckRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_msgfilter_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckRequest.ProtoReflect.Descriptor instead.
+func (*CheckRequest) Descriptor() ([]byte, []int) {
+	return file_msgfilter_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *CheckRequest) GetPayload() []byte {
+	if x != nil {
+		return x.Payload
+	}
+	return nil
+}
+
+func (x *CheckRequest) GetTopic() string {
+	if x != nil {
+		return x.Topic
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetPayloadType() string {
+	if x != nil {
+		return x.PayloadType
+	}
+	return ""
+}
+
+func (x *CheckRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type CheckResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Result CheckResponse_Result `protobuf:"varint,1,opt,name=result,proto3,enum=msgfilter.v1.CheckResponse_Result" json:"result,omitempty"`
+	// the id of the request
+	Id string `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	// the reason of FAILURE
+	Error string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (x *CheckResponse) Reset() {
+	*x = CheckResponse{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_msgfilter_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CheckResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CheckResponse) ProtoMessage() {}
+
+func (x *CheckResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_msgfilter_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CheckResponse.ProtoReflect.Descriptor instead.
+func (*CheckResponse) Descriptor() ([]byte, []int) {
+	return file_msgfilter_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CheckResponse) GetResult() CheckResponse_Result {
+	if x != nil {
+		return x.Result
+	}
+	return CheckResponse_RESULT_UNSPECIFIED
+}
+
+func (x *CheckResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *CheckResponse) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+var File_msgfilter_proto protoreflect.FileDescriptor
+
+var file_msgfilter_proto_rawDesc = []byte{
+	0x0a, 0x0f, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x12, 0x0c, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x22,
+	0x71, 0x0a, 0x0c, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12,
+	0x18, 0x0a, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x07, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x12, 0x14, 0x0a, 0x05, 0x74, 0x6f, 0x70,
+	0x69, 0x63, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x74, 0x6f, 0x70, 0x69, 0x63, 0x12,
+	0x21, 0x0a, 0x0c, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x70, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x54, 0x79,
+	0x70, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02,
+	0x69, 0x64, 0x22, 0xbc, 0x01, 0x0a, 0x0d, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x73, 0x70,
+	0x6f, 0x6e, 0x73, 0x65, 0x12, 0x3a, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0e, 0x32, 0x22, 0x2e, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x2e, 0x76, 0x31, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x2e, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64,
+	0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x22, 0x49, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74,
+	0x12, 0x16, 0x0a, 0x12, 0x52, 0x45, 0x53, 0x55, 0x4c, 0x54, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45,
+	0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x0b, 0x0a, 0x07, 0x53, 0x55, 0x43, 0x43,
+	0x45, 0x53, 0x53, 0x10, 0x01, 0x12, 0x0d, 0x0a, 0x09, 0x44, 0x55, 0x50, 0x4c, 0x49, 0x43, 0x41,
+	0x54, 0x45, 0x10, 0x02, 0x12, 0x0b, 0x0a, 0x07, 0x46, 0x41, 0x49, 0x4c, 0x55, 0x52, 0x45, 0x10,
+	0x03, 0x32, 0x99, 0x01, 0x0a, 0x09, 0x4d, 0x73, 0x67, 0x46, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x12,
+	0x40, 0x0a, 0x05, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x12, 0x1a, 0x2e, 0x6d, 0x73, 0x67, 0x66, 0x69,
+	0x6c, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x71,
+	0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x2e, 0x76, 0x31, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73,
+	0x65, 0x12, 0x4a, 0x0a, 0x0b, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x12, 0x1a, 0x2e, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e,
+	0x43, 0x68, 0x65, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1b, 0x2e, 0x6d,
+	0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72, 0x2e, 0x76, 0x31, 0x2e, 0x43, 0x68, 0x65, 0x63,
+	0x6b, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x28, 0x01, 0x30, 0x01, 0x42, 0x57, 0x0a,
+	0x22, 0x63, 0x6f, 0x6d, 0x2e, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x74, 0x65, 0x63, 0x68,
+	0x73, 0x6b, 0x65, 0x74, 0x63, 0x68, 0x2e, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c, 0x74, 0x65, 0x72,
+	0x2e, 0x76, 0x31, 0x50, 0x01, 0x5a, 0x2f, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
+	0x6d, 0x2f, 0x74, 0x65, 0x63, 0x68, 0x2d, 0x73, 0x6b, 0x65, 0x74, 0x63, 0x68, 0x2f, 0x66, 0x69,
+	0x77, 0x61, 0x72, 0x65, 0x2d, 0x6d, 0x71, 0x74, 0x74, 0x2d, 0x6d, 0x73, 0x67, 0x66, 0x69, 0x6c,
+	0x74, 0x65, 0x72, 0x2f, 0x70, 0x62, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_msgfilter_proto_rawDescOnce sync.Once
+	file_msgfilter_proto_rawDescData = file_msgfilter_proto_rawDesc
+)
+
+func file_msgfilter_proto_rawDescGZIP() []byte {
+	file_msgfilter_proto_rawDescOnce.Do(func() {
+		file_msgfilter_proto_rawDescData = protoimpl.X.CompressGZIP(file_msgfilter_proto_rawDescData)
+	})
+	return file_msgfilter_proto_rawDescData
+}
+
+var file_msgfilter_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_msgfilter_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_msgfilter_proto_goTypes = []interface{}{
+	(CheckResponse_Result)(0), // 0: msgfilter.v1.CheckResponse.Result
+	(*CheckRequest)(nil),      // 1: msgfilter.v1.CheckRequest
+	(*CheckResponse)(nil),     // 2: msgfilter.v1.CheckResponse
+}
+var file_msgfilter_proto_depIdxs = []int32{
+	0, // 0: msgfilter.v1.CheckResponse.result:type_name -> msgfilter.v1.CheckResponse.Result
+	1, // 1: msgfilter.v1.MsgFilter.Check:input_type -> msgfilter.v1.CheckRequest
+	1, // 2: msgfilter.v1.MsgFilter.CheckStream:input_type -> msgfilter.v1.CheckRequest
+	2, // 3: msgfilter.v1.MsgFilter.Check:output_type -> msgfilter.v1.CheckResponse
+	2, // 4: msgfilter.v1.MsgFilter.CheckStream:output_type -> msgfilter.v1.CheckResponse
+	3, // [3:5] is the sub-list for method output_type
+	1, // [1:3] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_msgfilter_proto_init() }
+func file_msgfilter_proto_init() {
+	if File_msgfilter_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_msgfilter_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CheckRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_msgfilter_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CheckResponse); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_msgfilter_proto_rawDesc,
+			NumEnums:      1,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_msgfilter_proto_goTypes,
+		DependencyIndexes: file_msgfilter_proto_depIdxs,
+		EnumInfos:         file_msgfilter_proto_enumTypes,
+		MessageInfos:      file_msgfilter_proto_msgTypes,
+	}.Build()
+	File_msgfilter_proto = out.File
+	file_msgfilter_proto_rawDesc = nil
+	file_msgfilter_proto_goTypes = nil
+	file_msgfilter_proto_depIdxs = nil
+}
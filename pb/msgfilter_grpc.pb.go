@@ -0,0 +1,190 @@
+// msgfilter.proto : the gRPC API to check message duplication, which is served on GRPC_PORT.
+//
+//   license: Apache license 2.0
+//   copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+//
+// Fiware-Service and the credentials (x-api-key, authorization or x-auth-token) are given as the metadata.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: msgfilter.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	MsgFilter_Check_FullMethodName       = "/msgfilter.v1.MsgFilter/Check"
+	MsgFilter_CheckStream_FullMethodName = "/msgfilter.v1.MsgFilter/CheckStream"
+)
+
+// MsgFilterClient is the client API for MsgFilter service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MsgFilterClient interface {
+	// Check checks the duplication of a message.
+	Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error)
+	// CheckStream checks the duplication of each message, and responds in the same order as requested.
+	CheckStream(ctx context.Context, opts ...grpc.CallOption) (MsgFilter_CheckStreamClient, error)
+}
+
+type msgFilterClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMsgFilterClient(cc grpc.ClientConnInterface) MsgFilterClient {
+	return &msgFilterClient{cc}
+}
+
+func (c *msgFilterClient) Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error) {
+	out := new(CheckResponse)
+	err := c.cc.Invoke(ctx, MsgFilter_Check_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *msgFilterClient) CheckStream(ctx context.Context, opts ...grpc.CallOption) (MsgFilter_CheckStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MsgFilter_ServiceDesc.Streams[0], MsgFilter_CheckStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &msgFilterCheckStreamClient{stream}
+	return x, nil
+}
+
+type MsgFilter_CheckStreamClient interface {
+	Send(*CheckRequest) error
+	Recv() (*CheckResponse, error)
+	grpc.ClientStream
+}
+
+type msgFilterCheckStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *msgFilterCheckStreamClient) Send(m *CheckRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *msgFilterCheckStreamClient) Recv() (*CheckResponse, error) {
+	m := new(CheckResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MsgFilterServer is the server API for MsgFilter service.
+// All implementations must embed UnimplementedMsgFilterServer
+// for forward compatibility
+type MsgFilterServer interface {
+	// Check checks the duplication of a message.
+	Check(context.Context, *CheckRequest) (*CheckResponse, error)
+	// CheckStream checks the duplication of each message, and responds in the same order as requested.
+	CheckStream(MsgFilter_CheckStreamServer) error
+	mustEmbedUnimplementedMsgFilterServer()
+}
+
+// UnimplementedMsgFilterServer must be embedded to have forward compatible implementations.
+type UnimplementedMsgFilterServer struct {
+}
+
+func (UnimplementedMsgFilterServer) Check(context.Context, *CheckRequest) (*CheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Check not implemented")
+}
+func (UnimplementedMsgFilterServer) CheckStream(MsgFilter_CheckStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method CheckStream not implemented")
+}
+func (UnimplementedMsgFilterServer) mustEmbedUnimplementedMsgFilterServer() {}
+
+// UnsafeMsgFilterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MsgFilterServer will
+// result in compilation errors.
+type UnsafeMsgFilterServer interface {
+	mustEmbedUnimplementedMsgFilterServer()
+}
+
+func RegisterMsgFilterServer(s grpc.ServiceRegistrar, srv MsgFilterServer) {
+	s.RegisterService(&MsgFilter_ServiceDesc, srv)
+}
+
+func _MsgFilter_Check_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MsgFilterServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MsgFilter_Check_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MsgFilterServer).Check(ctx, req.(*CheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MsgFilter_CheckStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(MsgFilterServer).CheckStream(&msgFilterCheckStreamServer{stream})
+}
+
+type MsgFilter_CheckStreamServer interface {
+	Send(*CheckResponse) error
+	Recv() (*CheckRequest, error)
+	grpc.ServerStream
+}
+
+type msgFilterCheckStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *msgFilterCheckStreamServer) Send(m *CheckResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *msgFilterCheckStreamServer) Recv() (*CheckRequest, error) {
+	m := new(CheckRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MsgFilter_ServiceDesc is the grpc.ServiceDesc for MsgFilter service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MsgFilter_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "msgfilter.v1.MsgFilter",
+	HandlerType: (*MsgFilterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    _MsgFilter_Check_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CheckStream",
+			Handler:       _MsgFilter_CheckStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "msgfilter.proto",
+}
@@ -0,0 +1,68 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	verdictKey = "verdict"
+)
+
+// sample : injection point to mock the sampling of the access logs
+var sample = rand.Float64
+
+// accessLog logs each request by utils.Logger instead of the logger of gin.
+// The successful requests (including the duplicate ones) are sampled by ACCESS_LOG_SAMPLE_RATE,
+// but the failed requests are always logged.
+func accessLog(holder *conf.Holder) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		start := time.Now()
+		context.Next()
+
+		config := holder.Get()
+		path := context.Request.URL.Path
+		for _, skip := range config.AccessLogSkipPaths {
+			if path == skip {
+				return
+			}
+		}
+		status := context.Writer.Status()
+		verdict := context.GetString(verdictKey)
+		failed := status >= http.StatusBadRequest && verdict != metrics.VerdictDuplicate
+		if !failed && sample() >= config.AccessLogSampleRate {
+			return
+		}
+
+		logger := utils.NewLogger("access").WithContext(context.Request.Context()).
+			With("method", context.Request.Method).
+			With("path", path).
+			With("status", strconv.Itoa(status)).
+			With("latency", time.Since(start).String()).
+			With("verdict", verdict).
+			With(utils.FieldTenant, context.Request.Header.Get(fiwareService)).
+			With("client_ip", clientAddress(context.Request, config.TrustedProxies))
+		switch {
+		case status >= http.StatusInternalServerError:
+			logger.Errorf("access")
+		case failed:
+			logger.Warnf("access")
+		default:
+			logger.Infof("access")
+		}
+	}
+}
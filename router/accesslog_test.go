@@ -0,0 +1,120 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+// captureLogs returns the logs of the logger written to stdout while f is running.
+func captureLogs(t *testing.T, name string, f func()) []map[string]string {
+	t.Helper()
+	utils.SetLogOptions(utils.LogOptions{Format: utils.LogFormatJSON, Level: utils.LogLevelDebug, Payload: utils.PayloadRedact})
+	defer utils.SetLogOptions(conf.NewConfig().LogOptions())
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	b, _ := ioutil.ReadAll(r)
+
+	logs := []map[string]string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		l := map[string]string{}
+		if json.Unmarshal([]byte(line), &l) == nil && l["logger"] == name {
+			logs = append(logs, l)
+		}
+	}
+	return logs
+}
+
+func TestAccessLog(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	original := sample
+	defer func() {
+		sample = original
+	}()
+
+	config := conf.NewConfig()
+	config.AccessLogSampleRate = 0.5
+	config.TrustedProxies = []string{"192.0.2.1"}
+	holder := conf.NewHolder(config)
+
+	engine := gin.New()
+	engine.Use(accessLog(holder))
+	engine.GET("/healthz", func(context *gin.Context) {
+		context.Status(http.StatusOK)
+	})
+	engine.POST("/check/:status/:verdict", func(context *gin.Context) {
+		context.Set(verdictKey, context.Param("verdict"))
+		status := http.StatusOK
+		if context.Param("status") != "200" {
+			status = http.StatusConflict
+			if context.Param("verdict") == "error" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		context.Status(status)
+	})
+
+	testCases := []struct {
+		method   string
+		path     string
+		sampled  float64
+		expected string
+	}{
+		{method: "POST", path: "/check/200/new", sampled: 0.1, expected: "info"},
+		{method: "POST", path: "/check/200/new", sampled: 0.9, expected: ""},
+		{method: "POST", path: "/check/409/duplicate", sampled: 0.1, expected: "info"},
+		{method: "POST", path: "/check/409/duplicate", sampled: 0.9, expected: ""},
+		{method: "POST", path: "/check/503/error", sampled: 0.9, expected: "error"},
+		{method: "GET", path: "/invalid", sampled: 0.9, expected: "warn"},
+		{method: "GET", path: "/healthz", sampled: 0.1, expected: ""},
+	}
+	for _, testCase := range testCases {
+		sampled := testCase.sampled
+		sample = func() float64 {
+			return sampled
+		}
+		logs := captureLogs(t, "access", func() {
+			r := httptest.NewRequest(testCase.method, testCase.path, bytes.NewBufferString(""))
+			r.Header.Set(fiwareService, "tenant")
+			r.Header.Set("X-Forwarded-For", "203.0.113.5")
+			engine.ServeHTTP(httptest.NewRecorder(), r)
+		})
+		if len(testCase.expected) == 0 {
+			assert.Empty(logs, testCase.path)
+			continue
+		}
+		if assert.Len(logs, 1, testCase.path) {
+			assert.Equal(testCase.expected, logs[0]["level"], testCase.path)
+			assert.Equal(testCase.method, logs[0]["method"], testCase.path)
+			assert.Equal(testCase.path, logs[0]["path"], testCase.path)
+			assert.Equal("tenant", logs[0][utils.FieldTenant], testCase.path)
+			assert.Equal("203.0.113.5", logs[0]["client_ip"], testCase.path)
+			assert.NotEmpty(logs[0]["status"], testCase.path)
+			assert.NotEmpty(logs[0]["latency"], testCase.path)
+		}
+	}
+}
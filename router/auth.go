@@ -0,0 +1,405 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	xAPIKey       = "X-API-Key"
+	authorization = "Authorization"
+	hmacScheme    = "HMAC-SHA256"
+	bearerScheme  = "Bearer"
+	sha256Prefix  = "sha256:"
+	allServices   = "*"
+)
+
+// errNoCredentials : the request does not have the credentials of the Authenticator
+var errNoCredentials = errors.New("no credentials")
+
+// now : injection point to mock the current time to verify the timestamps
+var now = time.Now
+
+/*
+Identity : the client authenticated by Authenticator.
+	Services are the services granted by the credentials themselves (e.g. the token of IdM).
+	When Services is nil, the services of the principal are given by "principals" of AUTH_FILE.
+*/
+type Identity struct {
+	Principal string
+	Services  []string
+}
+
+/*
+Authenticator : a method to authenticate HTTP Request.
+	Authenticate returns the Identity of the request.
+	When the request does not have the credentials of the method, Authenticate returns errNoCredentials
+	so that the next Authenticator is tried.
+*/
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+	// Scheme is the WWW-Authenticate challenge of the method
+	Scheme() string
+}
+
+// authFileType : the content of AUTH_FILE
+type authFileType struct {
+	Principals map[string][]string `json:"principals"`
+	APIKeys    []apiKeyType        `json:"apiKeys"`
+	HMACKeys   []hmacKeyType       `json:"hmacKeys"`
+	JWT        *jwtType            `json:"jwt"`
+}
+
+type apiKeyType struct {
+	Principal string `json:"principal"`
+	Hash      string `json:"hash"`
+}
+
+type hmacKeyType struct {
+	Principal string `json:"principal"`
+	KeyID     string `json:"keyId"`
+	Secret    string `json:"secret"`
+}
+
+// auth : the Authenticators and the FIWARE services allowed to each principal
+type auth struct {
+	authenticators []Authenticator
+	principals     map[string]map[string]bool
+}
+
+// newAuth loads AUTH_FILE and adds the PEP mode by PEP_IDM_URL, which returns nil without both of them.
+func newAuth(config *conf.Config) (*auth, error) {
+	if len(config.AuthFile) == 0 && len(config.PepIdMURL) == 0 {
+		return nil, nil
+	}
+	a := &auth{
+		principals: map[string]map[string]bool{},
+	}
+	if len(config.AuthFile) != 0 {
+		if err := a.load(config); err != nil {
+			return nil, err
+		}
+	}
+	if len(config.PepIdMURL) != 0 {
+		a.authenticators = append(a.authenticators, newPepAuthenticator(config))
+	}
+	return a, nil
+}
+
+// load adds the principals and the Authenticators of AUTH_FILE.
+func (a *auth) load(config *conf.Config) error {
+	b, err := ioutil.ReadFile(config.AuthFile)
+	if err != nil {
+		return err
+	}
+	var file authFileType
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("%s: %s", config.AuthFile, err.Error())
+	}
+
+	for principal, services := range file.Principals {
+		a.principals[principal] = map[string]bool{}
+		for _, service := range services {
+			a.principals[principal][service] = true
+		}
+	}
+	if len(file.APIKeys) != 0 {
+		authenticator, err := newAPIKeyAuthenticator(file.APIKeys)
+		if err != nil {
+			return fmt.Errorf("%s: %s", config.AuthFile, err.Error())
+		}
+		a.authenticators = append(a.authenticators, authenticator)
+	}
+	if len(file.HMACKeys) != 0 {
+		authenticator, err := newHMACAuthenticator(file.HMACKeys, config.AuthHMACMaxSkew, config.MaxBodySize)
+		if err != nil {
+			return fmt.Errorf("%s: %s", config.AuthFile, err.Error())
+		}
+		a.authenticators = append(a.authenticators, authenticator)
+	}
+	if file.JWT != nil {
+		authenticator, err := newJWTAuthenticator(file.JWT)
+		if err != nil {
+			return fmt.Errorf("%s: %s", config.AuthFile, err.Error())
+		}
+		a.authenticators = append(a.authenticators, authenticator)
+	}
+	if len(a.authenticators) == 0 {
+		return fmt.Errorf("%s: no apiKeys, hmacKeys nor jwt", config.AuthFile)
+	}
+	return nil
+}
+
+// authenticate tries the Authenticators in order, and returns the Identity of the first one which has the credentials.
+func (a *auth) authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range a.authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if err == errNoCredentials {
+			continue
+		}
+		return identity, err
+	}
+	return nil, errNoCredentials
+}
+
+// withoutBody returns the auth without the Authenticators which sign the body, or nil for nil.
+func (a *auth) withoutBody() *auth {
+	if a == nil {
+		return nil
+	}
+	b := &auth{principals: a.principals}
+	for _, authenticator := range a.authenticators {
+		if _, ok := authenticator.(*hmacAuthenticator); !ok {
+			b.authenticators = append(b.authenticators, authenticator)
+		}
+	}
+	return b
+}
+
+// allowed reports whether the client can check the messages of the service.
+// The empty service is the default service of the requests without Fiware-Service.
+func (a *auth) allowed(identity *Identity, service string) bool {
+	if identity.Services != nil {
+		for _, s := range identity.Services {
+			if s == service {
+				return true
+			}
+		}
+		return false
+	}
+	services := a.principals[identity.Principal]
+	return services[allServices] || services[service]
+}
+
+// authenticate rejects the requests without valid credentials (401) or for the services not allowed to the principal (403).
+// When IdM is unavailable, the requests are rejected by 503 so that the clients retry them,
+// and the bodies too large to be verified are rejected by 413.
+// The requests for monitoring are not authenticated, and the streams are not authenticated by HMAC-SHA256,
+// because their bodies are not buffered to be signed.
+func authenticate(full *auth) gin.HandlerFunc {
+	stream := full.withoutBody()
+	return func(context *gin.Context) {
+		if internalPaths[context.Request.URL.Path] {
+			context.Next()
+			return
+		}
+		logger := utils.NewLogger("auth").WithContext(context.Request.Context())
+		a := full
+		if context.Request.URL.Path == streamPath {
+			a = stream
+		}
+
+		identity, err := a.authenticate(context.Request)
+		if _, ok := err.(*idmUnavailableError); ok {
+			logger.Errorf("authentication failed: %s", err.Error())
+			context.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"result": "failure",
+				"error":  "idm unavailable",
+			})
+			return
+		}
+		if e, ok := err.(*requestError); ok {
+			logger.Warnf("authentication failed: %s", e.Error())
+			e.abort(context)
+			return
+		}
+		if err != nil {
+			logger.Warnf("authentication failed: %s", err.Error())
+			for _, authenticator := range a.authenticators {
+				context.Writer.Header().Add("WWW-Authenticate", authenticator.Scheme())
+			}
+			context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"result": "failure",
+				"error":  "unauthorized",
+			})
+			return
+		}
+
+		ctx := utils.ContextWithField(context.Request.Context(), utils.FieldPrincipal, identity.Principal)
+		service := context.Request.Header.Get(fiwareService)
+		if !a.allowed(identity, service) {
+			logger.With(utils.FieldPrincipal, identity.Principal).Warnf("service not allowed: %q", service)
+			context.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"result": "failure",
+				"error":  "service not allowed: " + service,
+			})
+			return
+		}
+		context.Request = context.Request.WithContext(ctx)
+		context.Next()
+	}
+}
+
+// apiKeyAuthenticator : authenticate X-API-Key header by the SHA-256 hashes of the keys
+type apiKeyAuthenticator struct {
+	principals map[string]string
+}
+
+func newAPIKeyAuthenticator(keys []apiKeyType) (*apiKeyAuthenticator, error) {
+	a := &apiKeyAuthenticator{
+		principals: map[string]string{},
+	}
+	for _, key := range keys {
+		if !strings.HasPrefix(key.Hash, sha256Prefix) {
+			return nil, fmt.Errorf("hash of api key for %q is not %s<hex>", key.Principal, sha256Prefix)
+		}
+		hash, err := hex.DecodeString(strings.TrimPrefix(key.Hash, sha256Prefix))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("hash of api key for %q is not sha256", key.Principal)
+		}
+		a.principals[string(hash)] = key.Principal
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(xAPIKey)
+	if len(key) == 0 {
+		return nil, errNoCredentials
+	}
+	// the keys are looked up by their hashes, so the lookup time does not leak the keys
+	hash := sha256.Sum256([]byte(key))
+	principal, ok := a.principals[string(hash[:])]
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+	return &Identity{Principal: principal}, nil
+}
+
+func (a *apiKeyAuthenticator) Scheme() string {
+	return "ApiKey header=\"" + xAPIKey + "\""
+}
+
+// hmacAuthenticator : authenticate the requests signed by the shared secrets
+//
+//	Authorization: HMAC-SHA256 keyId="<id>", timestamp="<unix time>", signature="<base64 of HMAC-SHA256>"
+//
+// The signature is computed over the method, the request URI, Fiware-Service, the timestamp and the hash of the body,
+// which are joined by "\n".
+type hmacAuthenticator struct {
+	keys        map[string]hmacKeyType
+	maxSkew     time.Duration
+	maxBodySize int
+}
+
+func newHMACAuthenticator(keys []hmacKeyType, maxSkew int, maxBodySize int) (*hmacAuthenticator, error) {
+	a := &hmacAuthenticator{
+		keys:        map[string]hmacKeyType{},
+		maxSkew:     time.Second * time.Duration(maxSkew),
+		maxBodySize: maxBodySize,
+	}
+	for _, key := range keys {
+		if len(key.KeyID) == 0 || len(key.Secret) == 0 {
+			return nil, fmt.Errorf("hmac key for %q has no keyId or secret", key.Principal)
+		}
+		a.keys[key.KeyID] = key
+	}
+	return a, nil
+}
+
+func (a *hmacAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	value := r.Header.Get(authorization)
+	if !strings.HasPrefix(value, hmacScheme+" ") {
+		return nil, errNoCredentials
+	}
+	params := parseAuthParams(strings.TrimPrefix(value, hmacScheme+" "))
+	key, ok := a.keys[params["keyId"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyId %q", params["keyId"])
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid timestamp")
+	}
+	if skew := now().Sub(time.Unix(timestamp, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, errors.New("timestamp out of range")
+	}
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	body, err := readBody(r, a.maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(signature, signHMAC(key.Secret, r, params["timestamp"], body)) {
+		return nil, errors.New("signature mismatch")
+	}
+	return &Identity{Principal: key.Principal}, nil
+}
+
+func (a *hmacAuthenticator) Scheme() string {
+	return hmacScheme
+}
+
+func signHMAC(secret string, r *http.Request, timestamp string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		r.Method,
+		r.URL.RequestURI(),
+		r.Header.Get(fiwareService),
+		timestamp,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+	return mac.Sum(nil)
+}
+
+// readBody reads the body up to maxSize bytes (0 means unlimited), and restores it so that the handlers can read it again.
+// The body over maxSize bytes is the error of 413 like limitBody.
+func readBody(r *http.Request, maxSize int) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+	var reader io.Reader = r.Body
+	if maxSize > 0 {
+		reader = io.LimitReader(r.Body, int64(maxSize)+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && len(body) > maxSize {
+		return nil, bodyTooLarge(maxSize)
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// parseAuthParams parses the comma separated key="value" pairs of Authorization header.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], "\"")
+	}
+	return params
+}
@@ -0,0 +1,280 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const testAuthFile = `{
+  "principals": {
+    "bridge": ["tenant1", ""],
+    "agent": ["tenant2"],
+    "admin": ["*"]
+  },
+  "apiKeys": [
+    {"principal": "bridge", "hash": "sha256:%s"}
+  ],
+  "hmacKeys": [
+    {"principal": "agent", "keyId": "agent-1", "secret": "s3cr3t"}
+  ],
+  "jwt": {
+    "jwksFile": "%s",
+    "issuer": "https://idm.example.com",
+    "audience": "msgfilter"
+  }
+}`
+
+func setUpAuth(t *testing.T) (*conf.Config, *testJWKS, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "auth")
+	assert.NoError(t, err)
+
+	jwks := newTestJWKS(t)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwksFile, jwks.json(t), 0600))
+
+	hash := sha256.Sum256([]byte("bridge-key"))
+	config := conf.NewConfig()
+	config.AuthFile = filepath.Join(dir, "auth.json")
+	content := []byte(fmt.Sprintf(testAuthFile, hex.EncodeToString(hash[:]), jwksFile))
+	assert.NoError(t, ioutil.WriteFile(config.AuthFile, content, 0600))
+	return config, jwks, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func newAuthEngine(t *testing.T, config *conf.Config) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	a, err := newAuth(config)
+	assert.NoError(t, err)
+
+	engine := gin.New()
+	engine.Use(authenticate(a))
+	handle := func(context *gin.Context) {
+		body, _ := ioutil.ReadAll(context.Request.Body)
+		context.String(http.StatusOK, "%s:%s", utils.FieldFromContext(context.Request.Context(), utils.FieldPrincipal), body)
+	}
+	engine.POST("/distinct/", handle)
+	engine.POST(streamPath, handle)
+	engine.GET("/metrics", handle)
+	return engine
+}
+
+func signRequest(r *http.Request, keyID string, secret string, timestamp time.Time, body string) {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	bodyHash := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get(fiwareService) + "\n" + ts + "\n" + hex.EncodeToString(bodyHash[:])))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	r.Header.Set(authorization, `HMAC-SHA256 keyId="`+keyID+`", timestamp="`+ts+`", signature="`+signature+`"`)
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	config, jwks, tearDown := setUpAuth(t)
+	defer tearDown()
+	engine := newAuthEngine(t, config)
+
+	current := time.Date(2018, 12, 31, 18, 0, 17, 0, time.UTC)
+	original := now
+	now = func() time.Time { return current }
+	defer func() { now = original }()
+
+	testCases := []struct {
+		name     string
+		service  string
+		body     string
+		setUp    func(r *http.Request)
+		code     int
+		expected string
+	}{
+		{name: "no credentials", service: "tenant1", setUp: func(r *http.Request) {}, code: http.StatusUnauthorized},
+		{name: "api key", service: "tenant1", body: `{"payload":"a"}`, setUp: func(r *http.Request) {
+			r.Header.Set(xAPIKey, "bridge-key")
+		}, code: http.StatusOK, expected: `bridge:{"payload":"a"}`},
+		{name: "api key of default service", setUp: func(r *http.Request) {
+			r.Header.Set(xAPIKey, "bridge-key")
+		}, code: http.StatusOK, expected: "bridge:"},
+		{name: "api key of other service", service: "tenant2", setUp: func(r *http.Request) {
+			r.Header.Set(xAPIKey, "bridge-key")
+		}, code: http.StatusForbidden},
+		{name: "invalid api key", service: "tenant1", setUp: func(r *http.Request) {
+			r.Header.Set(xAPIKey, "other-key")
+		}, code: http.StatusUnauthorized},
+		{name: "hmac", service: "tenant2", body: `{"payload":"b"}`, setUp: func(r *http.Request) {
+			signRequest(r, "agent-1", "s3cr3t", current.Add(-time.Minute), `{"payload":"b"}`)
+		}, code: http.StatusOK, expected: `agent:{"payload":"b"}`},
+		{name: "hmac with other body", service: "tenant2", body: `{"payload":"c"}`, setUp: func(r *http.Request) {
+			signRequest(r, "agent-1", "s3cr3t", current, `{"payload":"b"}`)
+		}, code: http.StatusUnauthorized},
+		{name: "hmac signed for other service", service: "tenant2", setUp: func(r *http.Request) {
+			r.Header.Set(fiwareService, "tenant1")
+			signRequest(r, "agent-1", "s3cr3t", current, "")
+			r.Header.Set(fiwareService, "tenant2")
+		}, code: http.StatusUnauthorized},
+		{name: "hmac with wrong secret", service: "tenant2", setUp: func(r *http.Request) {
+			signRequest(r, "agent-1", "wrong", current, "")
+		}, code: http.StatusUnauthorized},
+		{name: "hmac with unknown key", service: "tenant2", setUp: func(r *http.Request) {
+			signRequest(r, "agent-2", "s3cr3t", current, "")
+		}, code: http.StatusUnauthorized},
+		{name: "hmac expired", service: "tenant2", setUp: func(r *http.Request) {
+			signRequest(r, "agent-1", "s3cr3t", current.Add(-time.Minute*6), "")
+		}, code: http.StatusUnauthorized},
+		{name: "jwt", service: "tenant3", setUp: func(r *http.Request) {
+			r.Header.Set(authorization, "Bearer "+jwks.sign(t, "ec", "admin", time.Now().Add(time.Minute)))
+		}, code: http.StatusOK, expected: "admin:"},
+		{name: "jwt of other service", service: "tenant1", setUp: func(r *http.Request) {
+			r.Header.Set(authorization, "Bearer "+jwks.sign(t, "rsa", "agent", time.Now().Add(time.Minute)))
+		}, code: http.StatusForbidden},
+		{name: "jwt expired", service: "tenant3", setUp: func(r *http.Request) {
+			r.Header.Set(authorization, "Bearer "+jwks.sign(t, "ec", "admin", time.Now().Add(-time.Minute)))
+		}, code: http.StatusUnauthorized},
+		{name: "unknown scheme", service: "tenant1", setUp: func(r *http.Request) {
+			r.Header.Set(authorization, "Basic YnJpZGdlOmtleQ==")
+		}, code: http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(testCase.body))
+		if len(testCase.service) != 0 {
+			r.Header.Set(fiwareService, testCase.service)
+		}
+		testCase.setUp(r)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		assert.Equal(testCase.code, w.Code, testCase.name)
+		if testCase.code == http.StatusOK {
+			assert.Equal(testCase.expected, w.Body.String(), testCase.name)
+		}
+		if testCase.code == http.StatusUnauthorized {
+			assert.Equal([]string{`ApiKey header="X-API-Key"`, "HMAC-SHA256", "Bearer"}, w.Header()["Www-Authenticate"], testCase.name)
+		}
+	}
+
+	// the requests for monitoring are not authenticated
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(http.StatusOK, w.Code)
+}
+
+func TestAuthenticateStream(t *testing.T) {
+	assert := assert.New(t)
+	config, _, tearDown := setUpAuth(t)
+	defer tearDown()
+	config.MaxBodySize = 16
+	engine := newAuthEngine(t, config)
+
+	post := func(path string, body string, setUp func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		r.Header.Set(fiwareService, "tenant2")
+		setUp(r)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w
+	}
+	sign := func(body string) func(r *http.Request) {
+		return func(r *http.Request) {
+			signRequest(r, "agent-1", "s3cr3t", time.Now(), body)
+		}
+	}
+
+	// the stream is not read to verify the signature, so HMAC-SHA256 is not accepted
+	w := post(streamPath, `{"payload":"a"}`, sign(`{"payload":"a"}`))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal([]string{`ApiKey header="X-API-Key"`, "Bearer"}, w.Header()["Www-Authenticate"])
+	w = post(streamPath, `{"payload":"a"}`, func(r *http.Request) {
+		r.Header.Set(fiwareService, "tenant1")
+		r.Header.Set(xAPIKey, "bridge-key")
+	})
+	assert.Equal(http.StatusOK, w.Code)
+
+	// the signed body is read up to MAX_BODY_SIZE, and the larger one is rejected like limitBody
+	assert.Equal(http.StatusOK, post("/distinct/", `{"payload":"a"}`, sign(`{"payload":"a"}`)).Code)
+	w = post("/distinct/", `{"payload":"abc"}`, sign(`{"payload":"abc"}`))
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.JSONEq(`{"result":"failure","error":"request body too large","code":"bodyTooLarge","limit":16}`, w.Body.String())
+}
+
+func TestNewAuth(t *testing.T) {
+	assert := assert.New(t)
+	config, _, tearDown := setUpAuth(t)
+	defer tearDown()
+
+	a, err := newAuth(conf.NewConfig())
+	assert.Nil(a)
+	assert.NoError(err)
+
+	a, err = newAuth(config)
+	assert.NoError(err)
+	assert.Len(a.authenticators, 3)
+	assert.True(a.allowed(&Identity{Principal: "admin"}, "any"))
+	assert.True(a.allowed(&Identity{Principal: "bridge"}, ""))
+	assert.False(a.allowed(&Identity{Principal: "agent"}, ""))
+	assert.False(a.allowed(&Identity{Principal: "unknown"}, "tenant1"))
+	// the services granted by the credentials take precedence over "principals"
+	assert.True(a.allowed(&Identity{Principal: "agent", Services: []string{"tenant3"}}, "tenant3"))
+	assert.False(a.allowed(&Identity{Principal: "admin", Services: []string{}}, "tenant1"))
+
+	for _, content := range []string{
+		"",
+		"{}",
+		`{"apiKeys": [{"principal": "a", "hash": "plain"}]}`,
+		`{"apiKeys": [{"principal": "a", "hash": "sha256:0123"}]}`,
+		`{"hmacKeys": [{"principal": "a", "keyId": "k"}]}`,
+		`{"jwt": {"jwksFile": "/nonexistent/jwks.json"}}`,
+	} {
+		assert.NoError(ioutil.WriteFile(config.AuthFile, []byte(content), 0600))
+		_, err := newAuth(config)
+		assert.Error(err, content)
+	}
+
+	config.AuthFile = "/nonexistent/auth.json"
+	_, err = newAuth(config)
+	assert.Error(err)
+}
+
+func TestNewHandlerWithAuth(t *testing.T) {
+	assert := assert.New(t)
+	_, _, tearDownHealth := setUpHealth(t)
+	defer tearDownHealth()
+	config, _, tearDown := setUpAuth(t)
+	defer tearDown()
+
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+	w := httptest.NewRecorder()
+	handler.Engine.ServeHTTP(w, httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(`{"payload":"a"}`)))
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	w = httptest.NewRecorder()
+	handler.Engine.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(http.StatusOK, w.Code)
+
+	config.AuthFile = "/nonexistent/auth.json"
+	_, err = NewHandler(conf.NewHolder(config))
+	assert.Error(err)
+}
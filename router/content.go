@@ -0,0 +1,181 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ugorji/go/codec"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+const (
+	mimeJSON        = "application/json"
+	mimeText        = "text/plain"
+	mimeOctetStream = "application/octet-stream"
+	mimeMsgpack     = "application/msgpack"
+	mimeCBOR        = "application/cbor"
+)
+
+var (
+	// msgpackHandle decodes str as string and bin as []byte, and encodes them back as they were
+	msgpackHandle = &codec.MsgpackHandle{RawToString: true, WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+
+	// envelopeHandles : the binary envelopes, which are responded in the same format
+	envelopeHandles = map[string]codec.Handle{
+		mimeMsgpack:               msgpackHandle,
+		"application/x-msgpack":   msgpackHandle,
+		"application/vnd.msgpack": msgpackHandle,
+		mimeCBOR:                  cborHandle,
+	}
+)
+
+// binaryBodyType : the request body of MessagePack or CBOR, whose payload is a string or binary
+type binaryBodyType struct {
+	Payload     interface{} `codec:"payload"`
+	Topic       string      `codec:"topic"`
+	PayloadType string      `codec:"payloadType"`
+}
+
+/*
+envelope : the message to check decoded from the request body of any content type.
+	binary : the payload was given as binary, which is neither validated as text nor echoed in JSON
+	encoding : the encoding of the payload decoded by Checker, which is echoed in the same field as requested
+	handle : the codec of the binary envelope, which is also used for the response (nil means JSON)
+*/
+type envelope struct {
+	payload       []byte
+	topic         string
+	payloadType   string
+	binary        bool
+	encoding      string
+	payloadBase64 bool
+	mediaType     string
+	handle        codec.Handle
+}
+
+// decodeEnvelope decodes the body by Content-Type.
+// text/plain and application/octet-stream bodies are the payloads, whose topic and payloadType are given by the query.
+func decodeEnvelope(r *http.Request, config *conf.Config) (*envelope, *requestError) {
+	cType := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(cType)
+	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Content-Type not allowd: " + cType}
+	}
+	e := &envelope{mediaType: mediaType}
+	if handle, ok := envelopeHandles[mediaType]; ok {
+		e.handle = handle
+	} else if mediaType != mimeJSON && mediaType != mimeText && mediaType != mimeOctetStream {
+		return nil, &requestError{status: http.StatusBadRequest, message: "Content-Type not allowd: " + cType}
+	}
+	if mediaType != mimeOctetStream && e.handle == nil {
+		if err := validateBodyEncoding(config, r); err != nil {
+			return nil, err
+		}
+	}
+	body, err := readBody(r, config.MaxBodySize)
+	if e, ok := err.(*requestError); ok {
+		return nil, e
+	}
+	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, code: codeInvalidBody, message: err.Error()}
+	}
+
+	switch {
+	case mediaType == mimeJSON:
+		return decodeJSON(body)
+	case e.handle != nil:
+		var b binaryBodyType
+		if err := codec.NewDecoderBytes(body, e.handle).Decode(&b); err != nil {
+			return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+		}
+		switch p := b.Payload.(type) {
+		case nil:
+		case string:
+			e.payload = []byte(p)
+		case []byte:
+			e.payload, e.binary = p, true
+		default:
+			return nil, &requestError{status: http.StatusBadRequest, message: "payload is neither a string nor binary"}
+		}
+		e.topic, e.payloadType = b.Topic, b.PayloadType
+	default:
+		query := r.URL.Query()
+		e.payload, e.topic, e.payloadType = body, query.Get("topic"), query.Get("payloadType")
+		e.binary = mediaType == mimeOctetStream
+	}
+	return e, nil
+}
+
+// decodeJSON decodes the JSON body, which is also a line of /distinct/stream.
+func decodeJSON(body []byte) (*envelope, *requestError) {
+	var b bodyType
+	if err := json.Unmarshal(body, &b); err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	e := &envelope{
+		payload:     []byte(b.Payload),
+		topic:       b.Topic,
+		payloadType: b.PayloadType,
+		encoding:    b.Encoding,
+		mediaType:   mimeJSON,
+	}
+	if len(b.PayloadBase64) != 0 {
+		if len(b.Payload) != 0 || (len(b.Encoding) != 0 && b.Encoding != checker.EncodingBase64) {
+			return nil, &requestError{status: http.StatusBadRequest, message: "payloadBase64 conflicts with payload or encoding"}
+		}
+		e.payload, e.encoding, e.payloadBase64 = []byte(b.PayloadBase64), checker.EncodingBase64, true
+	}
+	if !checker.ValidEncoding(e.encoding) {
+		return nil, &requestError{status: http.StatusBadRequest, message: "encoding not allowd: " + e.encoding}
+	}
+	return e, nil
+}
+
+// jsonResult is the JSON response of the result, which echoes the payload in the same field as requested.
+func (e *envelope) jsonResult(result string) gin.H {
+	h := gin.H{"result": result}
+	switch {
+	case e.payloadBase64:
+		h["payloadBase64"] = string(e.payload)
+	case !e.binary:
+		h["payload"] = string(e.payload)
+		if len(e.encoding) != 0 {
+			h["encoding"] = e.encoding
+		}
+	}
+	return h
+}
+
+// respond responds the result in the format of the request.
+// The binary payload is echoed only in the binary envelopes, because JSON can not hold it.
+func (e *envelope) respond(context *gin.Context, status int, result string) {
+	if e.handle == nil {
+		context.JSON(status, e.jsonResult(result))
+		return
+	}
+
+	var payload interface{} = string(e.payload)
+	if e.binary {
+		payload = e.payload
+	}
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, e.handle).Encode(map[string]interface{}{
+		"result":  result,
+		"payload": payload,
+	}); err != nil {
+		context.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	context.Data(status, e.mediaType, b)
+}
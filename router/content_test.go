@@ -0,0 +1,179 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+func encodeEnvelope(t *testing.T, handle codec.Handle, body map[string]interface{}) string {
+	t.Helper()
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, handle).Encode(body); err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	return string(b)
+}
+
+func decodeResponse(t *testing.T, handle codec.Handle, r *http.Response) map[string]interface{} {
+	t.Helper()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var body map[string]interface{}
+	if err := codec.NewDecoderBytes(b, handle).Decode(&body); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	return body
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+
+	testCases := []struct {
+		cType    string
+		path     string
+		body     string
+		expected envelope
+	}{
+		{cType: "application/json; charset=utf-8", path: "/distinct/", body: `{"payload": "a", "topic": "t", "payloadType": "ul"}`,
+			expected: envelope{payload: []byte("a"), topic: "t", payloadType: "ul", mediaType: mimeJSON}},
+		{cType: "application/json", path: "/distinct/", body: `{"payloadBase64": "AP8=", "topic": "t"}`,
+			expected: envelope{payload: []byte("AP8="), topic: "t", encoding: checker.EncodingBase64, payloadBase64: true, mediaType: mimeJSON}},
+		{cType: "application/json", path: "/distinct/", body: `{"payload": "AP8=", "encoding": "base64"}`,
+			expected: envelope{payload: []byte("AP8="), encoding: checker.EncodingBase64, mediaType: mimeJSON}},
+		{cType: "text/plain", path: "/distinct/?topic=t&payloadType=ul", body: "t|25.3",
+			expected: envelope{payload: []byte("t|25.3"), topic: "t", payloadType: "ul", mediaType: mimeText}},
+		{cType: "application/octet-stream", path: "/distinct/", body: "\x00\xff",
+			expected: envelope{payload: []byte("\x00\xff"), binary: true, mediaType: mimeOctetStream}},
+		{cType: "application/msgpack", path: "/distinct/", body: encodeEnvelope(t, msgpackHandle, map[string]interface{}{"payload": []byte("\x00\xff"), "topic": "t"}),
+			expected: envelope{payload: []byte("\x00\xff"), topic: "t", binary: true, mediaType: mimeMsgpack, handle: msgpackHandle}},
+		{cType: "application/x-msgpack", path: "/distinct/", body: encodeEnvelope(t, msgpackHandle, map[string]interface{}{"payload": "a"}),
+			expected: envelope{payload: []byte("a"), mediaType: "application/x-msgpack", handle: msgpackHandle}},
+		{cType: "application/cbor", path: "/distinct/", body: encodeEnvelope(t, cborHandle, map[string]interface{}{"payload": []byte("\x00\xff"), "payloadType": "raw"}),
+			expected: envelope{payload: []byte("\x00\xff"), payloadType: "raw", binary: true, mediaType: mimeCBOR, handle: cborHandle}},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("POST", testCase.path, bytes.NewBufferString(testCase.body))
+		r.Header.Set("Content-Type", testCase.cType)
+		e, err := decodeEnvelope(r, config)
+		if assert.Nil(err, testCase.cType) {
+			assert.Equal(testCase.expected, *e, testCase.cType)
+		}
+	}
+
+	invalidCases := []struct {
+		cType string
+		body  string
+	}{
+		{cType: "application/xml", body: "<payload>a</payload>"},
+		{cType: "application/json; charset", body: `{"payload": "a"}`},
+		{cType: "application/json", body: "payload=a"},
+		{cType: "application/json", body: `{"payload": "a", "payloadBase64": "AP8="}`},
+		{cType: "application/json", body: `{"payloadBase64": "AP8=", "encoding": "hex"}`},
+		{cType: "application/json", body: `{"payload": "00ff", "encoding": "hex"}`},
+		{cType: "application/msgpack", body: "\xc1"},
+		{cType: "application/msgpack", body: encodeEnvelope(t, msgpackHandle, map[string]interface{}{"payload": 1})},
+		{cType: "application/cbor", body: encodeEnvelope(t, cborHandle, map[string]interface{}{"payload": []string{"a"}})},
+	}
+	for _, testCase := range invalidCases {
+		r := httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(testCase.body))
+		r.Header.Set("Content-Type", testCase.cType)
+		_, err := decodeEnvelope(r, config)
+		if assert.NotNil(err, testCase.cType) {
+			assert.Equal(http.StatusBadRequest, err.status, testCase.cType)
+		}
+	}
+}
+
+func TestDistinctContentTypes(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	r, err := doRequest("POST", "/distinct/", "application/json; charset=utf-8", dedupKey("", "", "a"), `{"payload": "a"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+
+	r, err = doRequest("POST", "/distinct/?topic=%2Ful%2Fkey%2Fdev1%2Fattrs", "text/plain", dedupKey("", "/ul/key/dev1/attrs", "a"), "a", true)
+	assert.Nil(err)
+	assert.Equal(http.StatusConflict, r.StatusCode)
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"duplicate","payload":"a"}`, string(b))
+
+	// the binary payload is not echoed in JSON
+	r, err = doRequest("POST", "/distinct/", "application/octet-stream", dedupKey("", "", "\x00\xff"), "\x00\xff", false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	b, _ = ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"success"}`, string(b))
+
+	r, err = doRequest("POST", "/distinct/", "application/octet-stream", dedupKey("", "", ""), "", false)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, r.StatusCode)
+}
+
+func TestDistinctBase64(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	// the duplication is checked on the decoded bytes, and the payload is echoed in the same field as requested
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "\x00\xff"), `{"payloadBase64": "AP8="}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"success","payloadBase64":"AP8="}`, string(b))
+
+	r, err = doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "\x00\xff"), `{"payload": "AP8=", "encoding": "base64"}`, true)
+	assert.Nil(err)
+	assert.Equal(http.StatusConflict, r.StatusCode)
+	b, _ = ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"duplicate","payload":"AP8=","encoding":"base64"}`, string(b))
+
+	r, err = doRequest("POST", "/distinct/", "application/json", dedupKey("", "", ""), `{"payloadBase64": "AP8"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusBadRequest, r.StatusCode)
+	b, _ = ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"failure","error":"invalid base64 payload: illegal base64 data at input byte 0"}`, string(b))
+}
+
+func TestDistinctEnvelopes(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	for _, cType := range []string{"application/msgpack", "application/cbor"} {
+		handle := envelopeHandles[cType]
+
+		// the payload is echoed in the same type as requested
+		body := encodeEnvelope(t, handle, map[string]interface{}{"payload": []byte("\x00\xff")})
+		r, err := doRequest("POST", "/distinct/", cType, dedupKey("", "", "\x00\xff"), body, false)
+		assert.Nil(err)
+		assert.Equal(http.StatusOK, r.StatusCode)
+		assert.Equal(cType, r.Header.Get("Content-Type"))
+		assert.Equal(map[string]interface{}{"result": "success", "payload": []byte("\x00\xff")}, decodeResponse(t, handle, r))
+
+		body = encodeEnvelope(t, handle, map[string]interface{}{"payload": "a"})
+		r, err = doRequest("POST", "/distinct/", cType, dedupKey("", "", "a"), body, true)
+		assert.Nil(err)
+		assert.Equal(http.StatusConflict, r.StatusCode)
+		assert.Equal(map[string]interface{}{"result": "duplicate", "payload": "a"}, decodeResponse(t, handle, r))
+	}
+}
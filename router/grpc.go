@@ -0,0 +1,247 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/pb"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+/*
+grpcService : the gRPC API backed by the same Checker, authentication and limits as the REST API.
+	The metadata of the call are the headers of the REST API (fiware-service, x-api-key, authorization, x-auth-token and x-request-id).
+*/
+type grpcService struct {
+	pb.UnimplementedMsgFilterServer
+	holder  *conf.Holder
+	checker *checker.Checker
+	auth    *auth
+	limiter *limiter
+}
+
+// newGRPCServer creates the gRPC server, which serves TLS with the same certificates as the REST API.
+// HMAC-SHA256 is not accepted, because gRPC has no HTTP body to be signed.
+func newGRPCServer(holder *conf.Holder, c *checker.Checker, a *auth, l *limiter) (*grpc.Server, error) {
+	s := &grpcService{
+		holder:  holder,
+		checker: c,
+		auth:    a.withoutBody(),
+		limiter: l,
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	}
+	if config := holder.Get(); config.TLSEnabled() {
+		reloader, err := newCertReloader(config, "h2")
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(reloader.tlsConfig())))
+	}
+	server := grpc.NewServer(options...)
+	pb.RegisterMsgFilterServer(server, s)
+	return server, nil
+}
+
+// requestFromMetadata converts the metadata of the call to HTTP Request, so that the Authenticators of the REST API are shared.
+func requestFromMetadata(ctx context.Context, method string) *http.Request {
+	r := &http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: method},
+		Header: http.Header{},
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// admit attaches the request id and the tenant of the call to the context, and authenticates the call like authenticate.
+func (s *grpcService) admit(ctx context.Context, method string) (context.Context, error) {
+	r := requestFromMetadata(ctx, method)
+	id := r.Header.Get(xRequestID)
+	if !validRequestID.MatchString(id) {
+		id = GenerateRequestID()
+	}
+	ctx = utils.ContextWithField(ctx, utils.FieldRequestID, id)
+	service := r.Header.Get(fiwareService)
+	ctx = utils.ContextWithField(ctx, utils.FieldTenant, service)
+	if s.auth == nil {
+		return ctx, nil
+	}
+
+	logger := utils.NewLogger("grpcAuth").WithContext(ctx)
+	identity, err := s.auth.authenticate(r)
+	if _, ok := err.(*idmUnavailableError); ok {
+		logger.Errorf("authentication failed: %s", err.Error())
+		return nil, status.Error(codes.Unavailable, "idm unavailable")
+	}
+	if err != nil {
+		logger.Warnf("authentication failed: %s", err.Error())
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	ctx = utils.ContextWithField(ctx, utils.FieldPrincipal, identity.Principal)
+	if !s.auth.allowed(identity, service) {
+		logger.With(utils.FieldPrincipal, identity.Principal).Warnf("service not allowed: %q", service)
+		return nil, status.Error(codes.PermissionDenied, "service not allowed: "+service)
+	}
+	return ctx, nil
+}
+
+func (s *grpcService) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.admit(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// contextStream : the ServerStream with the context attached by admit
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *grpcService) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.admit(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// Check checks the duplication of a message.
+// The invalid message is rejected by InvalidArgument, and the message over the limits by ResourceExhausted.
+func (s *grpcService) Check(ctx context.Context, req *pb.CheckRequest) (*pb.CheckResponse, error) {
+	return s.check(ctx, req)
+}
+
+// CheckStream checks the messages one by one, so the responses are in the same order as the requests.
+// The invalid message and the message over the limits are responded as FAILURE, and the stream is continued.
+func (s *grpcService) CheckStream(stream pb.MsgFilter_CheckStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res, err := s.check(stream.Context(), req)
+		if err != nil {
+			res = &pb.CheckResponse{
+				Result: pb.CheckResponse_FAILURE,
+				Id:     req.Id,
+				Error:  status.Convert(err).Message(),
+			}
+		}
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *grpcService) check(ctx context.Context, req *pb.CheckRequest) (*pb.CheckResponse, error) {
+	logger := utils.NewLogger("grpcCheck").WithContext(ctx)
+	config := s.holder.Get()
+	service := utils.FieldFromContext(ctx, utils.FieldTenant)
+
+	client := utils.FieldFromContext(ctx, utils.FieldPrincipal)
+	if p, ok := peer.FromContext(ctx); ok && len(client) == 0 {
+		client, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if reason, _ := s.limiter.allow(client, service); len(reason) != 0 {
+		logger.Warnf("request rejected: %s, client=%s, service=%q", reason, client, service)
+		metrics.IncRejected(metrics.Tenant(config, service), reason)
+		return nil, status.Error(codes.ResourceExhausted, rejectedErrors[reason])
+	}
+	// the payload is bytes, so it is validated as binary
+	if e := validatePayload(config, req.Payload, true); e != nil {
+		logger.Errorf("validate failed: %s", e.Error())
+		return nil, status.Error(codes.InvalidArgument, e.Error())
+	}
+
+	message := checker.Message{
+		Service:     service,
+		Topic:       req.Topic,
+		Payload:     string(req.Payload),
+		PayloadType: req.PayloadType,
+	}
+	isDup, err := s.checker.IsDuplicateContext(ctx, message)
+	if e, ok := err.(*payload.Error); ok {
+		logger.Errorf("validate failed: %s", e.Error())
+		return nil, status.Error(codes.InvalidArgument, e.Error())
+	}
+	if isDup || err != nil {
+		logger.Infof("duplicate payload = %s", utils.Payload(message.Payload))
+		return &pb.CheckResponse{Result: pb.CheckResponse_DUPLICATE, Id: req.Id}, nil
+	}
+	logger.Infof("new payload = %s", utils.Payload(message.Payload))
+	return &pb.CheckResponse{Result: pb.CheckResponse_SUCCESS, Id: req.Id}, nil
+}
+
+/*
+RunGRPC : start listening gRPC calls on the port.
+	RunGRPC returns immediately when GRPC_PORT is not given.
+	RunGRPC blocks until Shutdown is called, and then returns nil.
+*/
+func (router *Handler) RunGRPC(port string) error {
+	if router.grpcServer == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	// Serve returns nil when stopped while serving, and ErrServerStopped when stopped before
+	if err := router.grpcServer.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return nil
+}
+
+// stopGRPC waits for the calls in process until ctx is done, and then cancels them.
+func (router *Handler) stopGRPC(ctx context.Context) {
+	if router.grpcServer == nil {
+		return
+	}
+	stopped := make(chan struct{})
+	go func() {
+		router.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		router.grpcServer.Stop()
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/pb"
+)
+
+func setUpGRPC(t *testing.T, config *conf.Config) (pb.MsgFilterClient, *mock.MockKeysAPI, func()) {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	kapi := mock.NewMockKeysAPI(ctrl)
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+	checker.GetMutexID = func(_ string) string {
+		return "mutexID"
+	}
+
+	config.GRPCPort = ":50051"
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(t, err)
+	listener := bufconn.Listen(1024 * 1024)
+	go handler.grpcServer.Serve(listener)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	return pb.NewMsgFilterClient(conn), kapi, func() {
+		conn.Close()
+		handler.grpcServer.Stop()
+		ctrl.Finish()
+	}
+}
+
+func TestGRPCCheck(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	c, kapi, tearDown := setUpGRPC(t, config)
+	defer tearDown()
+	ctx := context.Background()
+
+	expectCheck(kapi, config, dedupKey("", "", "\x00\xff"), false)
+	res, err := c.Check(ctx, &pb.CheckRequest{Payload: []byte("\x00\xff"), Id: "1"})
+	assert.NoError(err)
+	assert.Equal(pb.CheckResponse_SUCCESS, res.Result)
+	assert.Equal("1", res.Id)
+
+	expectCheck(kapi, config, dedupKey("", "/ul/key/dev1/attrs", "h|40|t|25.3"), true)
+	res, err = c.Check(ctx, &pb.CheckRequest{Payload: []byte("t|25.3|h|40"), Topic: "/ul/key/dev1/attrs", PayloadType: "ul"})
+	assert.NoError(err)
+	assert.Equal(pb.CheckResponse_DUPLICATE, res.Result)
+
+	for _, req := range []*pb.CheckRequest{
+		{},
+		{Payload: []byte("|25.3"), PayloadType: "ul"},
+	} {
+		_, err = c.Check(ctx, req)
+		assert.Equal(codes.InvalidArgument, status.Code(err), string(req.Payload))
+	}
+}
+
+func TestGRPCCheckStream(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	c, kapi, tearDown := setUpGRPC(t, config)
+	defer tearDown()
+
+	stream, err := c.CheckStream(context.Background())
+	assert.NoError(err)
+	expectCheck(kapi, config, dedupKey("", "", "a"), false)
+	expectCheck(kapi, config, dedupKey("", "", "b"), true)
+	for _, req := range []*pb.CheckRequest{
+		{Payload: []byte("a"), Id: "1"},
+		{Id: "2"},
+		{Payload: []byte("b"), Id: "3"},
+	} {
+		assert.NoError(stream.Send(req))
+	}
+	assert.NoError(stream.CloseSend())
+
+	// the invalid message does not stop the stream, and the responses are in the same order
+	expected := []*pb.CheckResponse{
+		{Result: pb.CheckResponse_SUCCESS, Id: "1"},
+		{Result: pb.CheckResponse_FAILURE, Id: "2", Error: "payload is empty"},
+		{Result: pb.CheckResponse_DUPLICATE, Id: "3"},
+	}
+	for _, e := range expected {
+		res, err := stream.Recv()
+		if assert.NoError(err) {
+			assert.Equal(e.Result, res.Result, e.Id)
+			assert.Equal(e.Id, res.Id)
+			assert.Equal(e.Error, res.Error, e.Id)
+		}
+	}
+	_, err = stream.Recv()
+	assert.Error(err)
+}
+
+func TestGRPCAuth(t *testing.T) {
+	assert := assert.New(t)
+	config, _, tearDownAuth := setUpAuth(t)
+	defer tearDownAuth()
+	c, kapi, tearDown := setUpGRPC(t, config)
+	defer tearDown()
+
+	testCases := []struct {
+		md       metadata.MD
+		expected codes.Code
+	}{
+		{md: metadata.Pairs(), expected: codes.Unauthenticated},
+		{md: metadata.Pairs("x-api-key", "wrong-key"), expected: codes.Unauthenticated},
+		// HMAC-SHA256 is not accepted even with the valid signature of the empty body
+		{md: metadata.Pairs("authorization", hmacAuthorization("agent-1", "s3cr3t", "/msgfilter.v1.MsgFilter/Check", "tenant2"), "fiware-service", "tenant2"), expected: codes.Unauthenticated},
+		{md: metadata.Pairs("x-api-key", "bridge-key", "fiware-service", "tenant2"), expected: codes.PermissionDenied},
+		{md: metadata.Pairs("x-api-key", "bridge-key", "fiware-service", "tenant1"), expected: codes.OK},
+	}
+	expectCheck(kapi, config, dedupKey("tenant1", "", "a"), false)
+	for _, testCase := range testCases {
+		ctx := metadata.NewOutgoingContext(context.Background(), testCase.md)
+		_, err := c.Check(ctx, &pb.CheckRequest{Payload: []byte("a")})
+		assert.Equal(testCase.expected, status.Code(err), testCase.md)
+
+		stream, err := c.CheckStream(ctx)
+		assert.NoError(err)
+		if testCase.expected != codes.OK {
+			_, err = stream.Recv()
+			assert.Equal(testCase.expected, status.Code(err), testCase.md)
+		}
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	config.RateLimit = 1
+	c, kapi, tearDown := setUpGRPC(t, config)
+	defer tearDown()
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("fiware-service", "tenant1"))
+
+	expectCheck(kapi, config, dedupKey("tenant1", "", "a"), false)
+	_, err := c.Check(ctx, &pb.CheckRequest{Payload: []byte("a")})
+	assert.NoError(err)
+	_, err = c.Check(ctx, &pb.CheckRequest{Payload: []byte("a")})
+	assert.Equal(codes.ResourceExhausted, status.Code(err))
+	assert.Equal("rate limit exceeded", status.Convert(err).Message())
+}
+
+func TestRunGRPC(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDown := setUpHealth(t)
+	defer tearDown()
+
+	// without GRPC_PORT
+	assert.NoError(handler.RunGRPC("127.0.0.1:0"))
+
+	config := conf.NewConfig()
+	config.GRPCPort = "127.0.0.1:0"
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- handler.RunGRPC(config.GRPCPort)
+	}()
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(handler.Shutdown(context.Background()))
+	assert.NoError(<-errs)
+}
+
+func hmacAuthorization(keyID string, secret string, path string, service string) string {
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: path}, Header: http.Header{}}
+	r.Header.Set(fiwareService, service)
+	signRequest(r, keyID, secret, time.Now(), "")
+	return r.Header.Get(authorization)
+}
@@ -7,13 +7,17 @@ Package router : routing http request and check message duplication using Checke
 package router
 
 import (
+	"context"
 	"net/http"
+	"sync"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
+	"google.golang.org/grpc"
 
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
 )
 
@@ -23,75 +27,219 @@ Handler : a struct to handle HTTP Request and check its Header.
 	Handler authorizes and authenticates all HTTP Requests using its HTTP Header.
 */
 type Handler struct {
-	Engine *gin.Engine
+	Engine  *gin.Engine
+	health  *health
+	checker *checker.Checker
+	holder  *conf.Holder
+	mutex   sync.Mutex
+	server  *http.Server
+
+	grpcServer *grpc.Server
+}
+
+// internalPaths : the paths for monitoring, which are neither traced nor counted as the requests in process
+var internalPaths = map[string]bool{
+	"/metrics": true,
+	"/healthz": true,
+	"/readyz":  true,
 }
 
 /*
 NewHandler : a factory method to create Handler.
 */
-func NewHandler(config *conf.Config) (*Handler, error) {
-	engine := gin.Default()
-	c, err := checker.NewChecker(config)
+func NewHandler(holder *conf.Holder) (*Handler, error) {
+	engine := gin.New()
+	c, err := checker.NewChecker(holder)
 	if err != nil {
 		return nil, err
 	}
 
+	h := newHealth(holder, c)
+
+	engine.Use(assignRequestID, accessLog(holder), gin.Recovery(), countInFlight, traceRequest(holder), limitBody(holder))
+	a, err := newAuth(holder.Get())
+	if err != nil {
+		return nil, err
+	}
+	if a != nil {
+		engine.Use(authenticate(a))
+	}
+	l := newLimiter(holder, c)
+	engine.Use(limitRequests(l))
+	engine.GET("/metrics", gin.WrapH(metrics.Handler()))
+	engine.GET("/healthz", h.healthz)
+	engine.GET("/readyz", h.readyz)
 	engine.POST("/distinct/", func(context *gin.Context) {
-		distinctMessage(context, c)
+		distinctMessage(context, holder, c)
+	})
+	engine.POST(streamPath, func(context *gin.Context) {
+		distinctStream(context, holder, c, l)
 	})
+	engine.POST("/webhook/auth_on_publish", func(context *gin.Context) {
+		authOnPublish(context, c)
+	})
+	if len(holder.Get().OrionURL) != 0 {
+		proxy, err := newOrionProxy(holder, c)
+		if err != nil {
+			return nil, err
+		}
+		engine.POST("/v2/entities", proxy.handle)
+		engine.POST("/v2/op/update", proxy.handle)
+	}
 
 	router := &Handler{
-		Engine: engine,
+		Engine:  engine,
+		health:  h,
+		checker: c,
+		holder:  holder,
+	}
+	if len(holder.Get().GRPCPort) != 0 {
+		if router.grpcServer, err = newGRPCServer(holder, c, a, l); err != nil {
+			return nil, err
+		}
 	}
 	return router, nil
 }
 
+// countInFlight counts the requests in process except the requests for monitoring.
+func countInFlight(context *gin.Context) {
+	if internalPaths[context.Request.URL.Path] {
+		context.Next()
+		return
+	}
+	metrics.IncInFlight()
+	defer metrics.DecInFlight()
+	context.Next()
+}
+
 /*
 Run : start listening HTTP Request using enclosed gin.Engine.
+	/readyz reports ready after Run is called.
+	Run serves HTTPS when TLS_CERT_FILE and TLS_KEY_FILE are given.
+	Run blocks until Shutdown is called, and then returns nil.
 */
-func (router *Handler) Run(port string) {
-	router.Engine.Run(port)
+func (router *Handler) Run(port string) error {
+	config := router.holder.Get()
+	var reloader *certReloader
+	if config.TLSEnabled() {
+		var err error
+		if reloader, err = newCertReloader(config); err != nil {
+			return err
+		}
+	}
+
+	router.mutex.Lock()
+	if router.server == nil {
+		router.server = &http.Server{
+			Addr:    port,
+			Handler: fullDuplex(router.Engine),
+		}
+		if reloader != nil {
+			router.server.TLSConfig = reloader.tlsConfig()
+		}
+	}
+	server := router.server
+	router.mutex.Unlock()
+
+	// Shutdown may be called before the server starts, and then the state must stay stopping
+	router.health.transit(stateStarting, stateRunning)
+	var err error
+	if reloader != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-type bodyType struct {
-	Payload string `json:"payload" binding:"required"`
+/*
+Shutdown : stop accepting HTTP Request and gRPC calls, and wait for the requests in process until ctx is done.
+	/readyz reports not ready after Shutdown is called.
+	The locks held by the abandoned requests are released by Checker.Close.
+*/
+func (router *Handler) Shutdown(ctx context.Context) error {
+	router.health.setState(stateStopping)
+	logger := utils.NewLogger("shutdown")
+
+	router.mutex.Lock()
+	if router.server == nil {
+		// Run has not been called, so it returns immediately when called
+		router.server = &http.Server{}
+	}
+	server := router.server
+	router.mutex.Unlock()
+
+	// the gRPC calls are drained in parallel with the HTTP requests within the same ctx
+	grpcStopped := make(chan struct{})
+	go func() {
+		router.stopGRPC(ctx)
+		close(grpcStopped)
+	}()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Warnf("http server shutdown failed: %s", err.Error())
+	}
+	<-grpcStopped
+	if e := router.checker.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
 
-func distinctMessage(context *gin.Context, checker *checker.Checker) {
-	logger := utils.NewLogger("distinctMessage")
-	var body bodyType
+const (
+	fiwareService = "Fiware-Service"
+)
+
+// bodyType : the request body, whose empty payload is rejected by validatePayload.
+// The binary payload is given by payloadBase64, or by payload with encoding "base64".
+type bodyType struct {
+	Payload       string `json:"payload"`
+	PayloadBase64 string `json:"payloadBase64"`
+	Encoding      string `json:"encoding"`
+	Topic         string `json:"topic"`
+	PayloadType   string `json:"payloadType"`
+}
 
-	cType := context.GetHeader("Content-Type")
+func distinctMessage(context *gin.Context, holder *conf.Holder, c *checker.Checker) {
+	logger := utils.NewLogger("distinctMessage").WithContext(context.Request.Context())
 
-	if cType != "application/json" {
-		logger.Errorf("header failed: Content-Type=%s", cType)
-		context.JSON(http.StatusBadRequest, gin.H{
-			"result": "failure",
-			"error":  "Content-Type not allowd: " + cType,
-		})
+	config := holder.Get()
+	body, e := decodeEnvelope(context.Request, config)
+	if e != nil {
+		logger.Errorf("validate failed: %s", e.Error())
+		e.abort(context)
 		return
 	}
-
-	if err := context.ShouldBindWith(&body, binding.JSON); err != nil {
-		logger.Errorf("validate failed: %s", err.Error())
+	if e := body.validate(config); e != nil {
+		logger.Errorf("validate failed: %s", e.Error())
+		e.abort(context)
+		return
+	}
+	message := checker.Message{
+		Service:     context.GetHeader(fiwareService),
+		Topic:       body.topic,
+		Payload:     string(body.payload),
+		PayloadType: body.payloadType,
+		Encoding:    body.encoding,
+	}
+	isDup, err := c.IsDuplicateContext(context.Request.Context(), message)
+	context.Set(verdictKey, checker.Verdict(isDup, err))
+	if e, ok := err.(*payload.Error); ok {
+		logger.Errorf("validate failed: %s", e.Error())
 		context.JSON(http.StatusBadRequest, gin.H{
 			"result": "failure",
-			"error":  err.Error(),
+			"error":  e.Error(),
 		})
 		return
 	}
-	isDup, err := checker.IsDuplicate(body.Payload)
 	if isDup || err != nil {
-		logger.Infof("duplicate payload = %s", body.Payload)
-		context.JSON(http.StatusConflict, gin.H{
-			"result":  "duplicate",
-			"payload": body.Payload,
-		})
+		logger.Infof("duplicate payload = %s", utils.Payload(message.Payload))
+		body.respond(context, http.StatusConflict, "duplicate")
 	} else {
-		logger.Infof("new payload = %s", body.Payload)
-		context.JSON(http.StatusOK, gin.H{
-			"result":  "success",
-			"payload": body.Payload,
-		})
+		logger.Infof("new payload = %s", utils.Payload(message.Payload))
+		body.respond(context, http.StatusOK, "success")
 	}
 }
@@ -9,6 +9,7 @@ package router
 import (
 	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -61,18 +62,18 @@ func setUp(t *testing.T) (func(string, string, string, string, string, bool) (*h
 			gomock.InOrder(
 				kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
 				kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, nil),
-				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, nil).Return(nil, nil),
+				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 			)
 		} else {
 			gomock.InOrder(
 				kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
 				kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, keyNotFound),
-				kapi.EXPECT().Set(context.Background(), "/data/"+key, "duplicate", dataOptions).Return(nil, nil),
-				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, nil).Return(nil, nil),
+				kapi.EXPECT().Set(context.Background(), "/data/"+key, gomock.Any(), dataOptions).Return(nil, nil),
+				kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
 			)
 		}
 
-		handler, err := NewHandler(config)
+		handler, err := NewHandler(conf.NewHolder(config))
 		assert.NoError(t, err)
 		ts = httptest.NewServer(handler.Engine)
 		r, err := http.NewRequest(method, ts.URL+path, bytes.NewBuffer([]byte(jsonBody)))
@@ -95,7 +96,7 @@ func TestDistinctOK(t *testing.T) {
 	doRequest, tearDown := setUp(t)
 	defer tearDown()
 
-	r, err := doRequest("POST", "/distinct/", "application/json", "a", `{"payload": "a"}`, false)
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "a"), `{"payload": "a"}`, false)
 	assert.Nil(err)
 	assert.Equal(http.StatusOK, r.StatusCode)
 }
@@ -105,11 +106,43 @@ func TestDistinctConflict(t *testing.T) {
 	doRequest, tearDown := setUp(t)
 	defer tearDown()
 
-	r, err := doRequest("POST", "/distinct/", "application/json", "a", `{"payload": "a"}`, true)
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "a"), `{"payload": "a"}`, true)
 	assert.Nil(err)
 	assert.Equal(http.StatusConflict, r.StatusCode)
 }
 
+func TestDistinctWithTopic(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "/ul/key/dev1/attrs", "a"), `{"payload": "a", "topic": "/ul/key/dev1/attrs"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+}
+
+func TestDistinctWithPayloadType(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "h|40|t|25.3"), `{"payload": "t|25.3|h|40", "payloadType": "ul"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+}
+
+func TestDistinctWithNGSILD(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	key := dedupKey("", "", `[{"id":"urn:ngsi-ld:Room:1","type":"Room","attrs":{"temperature":{"type":"Property","value":25.3}}}]`)
+	body := `{"payload": "{\"@context\":\"https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld\",\"id\":\"urn:ngsi-ld:Room:1\",\"type\":\"Room\",\"temperature\":25.3}", "payloadType": "ngsi-ld"}`
+	r, err := doRequest("POST", "/distinct/", "application/json", key, body, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+}
+
 func TestBadRequest(t *testing.T) {
 	assert := assert.New(t)
 	doRequest, tearDown := setUp(t)
@@ -122,13 +155,17 @@ func TestBadRequest(t *testing.T) {
 		{cType: "application/json", body: ""},
 		{cType: "application/json", body: "payload=a"},
 		{cType: "application/json", body: `{"x":"Y"}`},
+		{cType: "application/json", body: `{"payload": ""}`},
+		{cType: "application/json", body: `{"payload": " \t\n"}`},
+		{cType: "application/json", body: `{"payload": "a", "payloadType": "unknown"}`},
+		{cType: "application/json", body: `{"payload": "|a", "payloadType": "ul"}`},
 		{cType: "application/x-www-form-urlencoded", body: `{"payload": "a"}`},
 		{cType: "application/x-www-form-urlencoded", body: "payload=a"},
 		{cType: "", body: `{"payload": "a"}`},
 		{cType: "", body: "payload=a"},
 	}
 	for _, testCase := range testCases {
-		r, err := doRequest("POST", "/distinct/", testCase.cType, "a", testCase.body, false)
+		r, err := doRequest("POST", "/distinct/", testCase.cType, dedupKey("", "", "a"), testCase.body, false)
 		assert.Nil(err)
 		assert.Equal(http.StatusBadRequest, r.StatusCode)
 	}
@@ -140,7 +177,7 @@ func TestNotAllowdMethod(t *testing.T) {
 	defer tearDown()
 
 	for _, method := range []string{"GET", "PUT", "PATCH", "DELETE"} {
-		r, err := doRequest(method, "/distinct/", "application/json", "a", `{"payload": "a"}`, false)
+		r, err := doRequest(method, "/distinct/", "application/json", dedupKey("", "", "a"), `{"payload": "a"}`, false)
 		assert.Nil(err)
 		assert.Equal(http.StatusNotFound, r.StatusCode)
 	}
@@ -152,8 +189,25 @@ func TestNotFoundPath(t *testing.T) {
 	defer tearDown()
 
 	for _, method := range []string{"GET", "POST", "PUT", "PATCH", "DELETE"} {
-		r, err := doRequest(method, "/invalid/", "application/json", "a", `{"payload": "a"}`, false)
+		r, err := doRequest(method, "/invalid/", "application/json", dedupKey("", "", "a"), `{"payload": "a"}`, false)
 		assert.Nil(err)
 		assert.Equal(http.StatusNotFound, r.StatusCode)
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	r, err := doRequest("POST", "/distinct/", "application/json", dedupKey("", "", "a"), `{"payload": "a"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+
+	r, err = http.Get(r.Request.URL.Scheme + "://" + r.Request.URL.Host + "/metrics")
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.Contains(string(b), `msgfilter_checks_total{tenant="",verdict="new"}`)
+	assert.Contains(string(b), `msgfilter_etcd_request_duration_seconds_count{operation="set"}`)
+}
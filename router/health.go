@@ -0,0 +1,130 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	stateStarting int32 = iota
+	stateRunning
+	stateStopping
+
+	statusOK    = "ok"
+	statusError = "error"
+)
+
+var stateNames = map[int32]string{
+	stateStarting: "starting",
+	stateRunning:  "running",
+	stateStopping: "stopping",
+}
+
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// health : the state of this service reported to the liveness and readiness probes
+type health struct {
+	holder  *conf.Holder
+	store   pinger
+	state   int32
+	started time.Time
+}
+
+func newHealth(holder *conf.Holder, store pinger) *health {
+	return &health{
+		holder:  holder,
+		store:   store,
+		state:   stateStarting,
+		started: time.Now(),
+	}
+}
+
+func (h *health) setState(state int32) {
+	atomic.StoreInt32(&h.state, state)
+}
+
+// transit changes the state to next only when the state is from, and reports whether it changed.
+func (h *health) transit(from, next int32) bool {
+	return atomic.CompareAndSwapInt32(&h.state, from, next)
+}
+
+func (h *health) getState() int32 {
+	return atomic.LoadInt32(&h.state)
+}
+
+// healthz reports that the process is alive, regardless of the state of etcd.
+func (h *health) healthz(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{
+		"status": statusOK,
+		"components": gin.H{
+			"process": gin.H{
+				"status": statusOK,
+				"uptime": time.Since(h.started).Truncate(time.Second).String(),
+			},
+		},
+	})
+}
+
+// readyz reports whether this service can check the duplication,
+// which means it is neither starting nor stopping and etcd responds before READINESS_TIMEOUT.
+func (h *health) readyz(context *gin.Context) {
+	ready := true
+
+	state := h.getState()
+	lifecycle := gin.H{
+		"status": statusOK,
+		"state":  stateNames[state],
+	}
+	if state != stateRunning {
+		ready = false
+		lifecycle["status"] = statusError
+	}
+
+	timeout := time.Millisecond * time.Duration(h.holder.Get().ReadinessTimeout)
+	ctx, cancel := contextWithTimeout(context.Request.Context(), timeout)
+	defer cancel()
+	start := time.Now()
+	err := h.store.Ping(ctx)
+	store := gin.H{
+		"status":  statusOK,
+		"latency": time.Since(start).String(),
+	}
+	if err != nil {
+		ready = false
+		store["status"] = statusError
+		store["error"] = err.Error()
+		utils.NewLogger("readyz").WithContext(context.Request.Context()).Warnf("etcd ping failed: %s", err.Error())
+	}
+
+	status, code := statusOK, http.StatusOK
+	if !ready {
+		status, code = statusError, http.StatusServiceUnavailable
+	}
+	context.JSON(code, gin.H{
+		"status": status,
+		"components": gin.H{
+			"lifecycle": lifecycle,
+			"store":     store,
+		},
+	})
+}
+
+// contextWithTimeout is context.WithTimeout, which can not be called in the handlers whose gin.Context is named context.
+func contextWithTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, timeout)
+}
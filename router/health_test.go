@@ -0,0 +1,141 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+type healthBody struct {
+	Status     string                       `json:"status"`
+	Components map[string]map[string]string `json:"components"`
+}
+
+func setUpHealth(t *testing.T) (*mock.MockKeysAPI, *Handler, func()) {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	ctrl := gomock.NewController(t)
+	kapi := mock.NewMockKeysAPI(ctrl)
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+
+	handler, err := NewHandler(conf.NewHolder(conf.NewConfig()))
+	assert.NoError(t, err)
+	return kapi, handler, ctrl.Finish
+}
+
+func getHealth(t *testing.T, handler *Handler, path string) (int, healthBody) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.Engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var body healthBody
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDown := setUpHealth(t)
+	defer tearDown()
+
+	// the process is alive without etcd even while starting
+	code, body := getHealth(t, handler, "/healthz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(statusOK, body.Status)
+	assert.Equal(statusOK, body.Components["process"]["status"])
+	assert.NotEmpty(body.Components["process"]["uptime"])
+}
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+	kapi, handler, tearDown := setUpHealth(t)
+	defer tearDown()
+
+	keyNotFound := client.Error{Code: client.ErrorCodeKeyNotFound}
+	gomock.InOrder(
+		kapi.EXPECT().Get(gomock.Any(), "/health", nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Get(gomock.Any(), "/health", nil).Return(nil, keyNotFound),
+		kapi.EXPECT().Get(gomock.Any(), "/health", nil).Return(nil, errors.New("etcd down")),
+		kapi.EXPECT().Get(gomock.Any(), "/health", nil).Return(nil, keyNotFound),
+	)
+
+	code, body := getHealth(t, handler, "/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(statusError, body.Status)
+	assert.Equal(statusError, body.Components["lifecycle"]["status"])
+	assert.Equal("starting", body.Components["lifecycle"]["state"])
+	assert.Equal(statusOK, body.Components["store"]["status"])
+
+	handler.health.setState(stateRunning)
+	code, body = getHealth(t, handler, "/readyz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(statusOK, body.Status)
+	assert.Equal("running", body.Components["lifecycle"]["state"])
+	assert.NotEmpty(body.Components["store"]["latency"])
+
+	code, body = getHealth(t, handler, "/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(statusOK, body.Components["lifecycle"]["status"])
+	assert.Equal(statusError, body.Components["store"]["status"])
+	assert.Equal("etcd down", body.Components["store"]["error"])
+
+	handler.health.setState(stateStopping)
+	code, body = getHealth(t, handler, "/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("stopping", body.Components["lifecycle"]["state"])
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDown := setUpHealth(t)
+	defer tearDown()
+
+	finished := make(chan error)
+	go func() {
+		finished <- handler.Run("127.0.0.1:0")
+	}()
+	for handler.health.getState() != stateRunning {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(handler.Shutdown(ctx))
+	assert.NoError(<-finished)
+	assert.Equal(stateStopping, handler.health.getState())
+
+	// the duplication is not checked after shutdown
+	isDup, err := handler.checker.IsDuplicate(checker.Message{Payload: "a"})
+	assert.True(isDup)
+	assert.Equal(checker.ErrClosed, err)
+}
+
+func TestShutdownBeforeRun(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDown := setUpHealth(t)
+	defer tearDown()
+
+	assert.NoError(handler.Shutdown(context.Background()))
+	assert.NoError(handler.Run("127.0.0.1:0"))
+	assert.Equal(stateStopping, handler.health.getState())
+}
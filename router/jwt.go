@@ -0,0 +1,196 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultPrincipalClaim = "sub"
+)
+
+// the asymmetric algorithms, because the local JWKS has only the public keys
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// jwtType : the settings of the JWT bearer tokens in AUTH_FILE
+type jwtType struct {
+	JWKSFile       string `json:"jwksFile"`
+	Issuer         string `json:"issuer"`
+	Audience       string `json:"audience"`
+	PrincipalClaim string `json:"principalClaim"`
+}
+
+type jwkType struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtAuthenticator : authenticate the bearer tokens signed by the keys of the local JWKS file.
+// The principal is the claim of principalClaim ("sub" by default).
+type jwtAuthenticator struct {
+	keys           map[string]crypto.PublicKey
+	parser         *jwt.Parser
+	principalClaim string
+}
+
+func newJWTAuthenticator(settings *jwtType) (*jwtAuthenticator, error) {
+	keys, err := loadJWKS(settings.JWKSFile)
+	if err != nil {
+		return nil, err
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithExpirationRequired(),
+	}
+	if len(settings.Issuer) != 0 {
+		opts = append(opts, jwt.WithIssuer(settings.Issuer))
+	}
+	if len(settings.Audience) != 0 {
+		opts = append(opts, jwt.WithAudience(settings.Audience))
+	}
+	principalClaim := settings.PrincipalClaim
+	if len(principalClaim) == 0 {
+		principalClaim = defaultPrincipalClaim
+	}
+	return &jwtAuthenticator{
+		keys:           keys,
+		parser:         jwt.NewParser(opts...),
+		principalClaim: principalClaim,
+	}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	value := r.Header.Get(authorization)
+	if !strings.HasPrefix(value, bearerScheme+" ") {
+		return nil, errNoCredentials
+	}
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(strings.TrimPrefix(value, bearerScheme+" "), claims, a.key)
+	if err != nil {
+		return nil, err
+	}
+	principal, ok := claims[a.principalClaim].(string)
+	if !ok || len(principal) == 0 {
+		return nil, fmt.Errorf("no %s claim", a.principalClaim)
+	}
+	return &Identity{Principal: principal}, nil
+}
+
+func (a *jwtAuthenticator) Scheme() string {
+	return bearerScheme
+}
+
+// key finds the key by "kid" of the token, which can be omitted when the JWKS has only one key.
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if len(kid) == 0 && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown kid %q", kid)
+}
+
+// loadJWKS reads the RSA and EC public keys of the JWKS file.
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []jwkType `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("%s: kid %q: %s", path, k.Kid, err.Error())
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+func (k *jwkType) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
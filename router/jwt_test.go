@@ -0,0 +1,196 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type testJWKS struct {
+	ec  *ecdsa.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	t.Helper()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return &testJWKS{ec: ecKey, rsa: rsaKey}
+}
+
+func (k *testJWKS) json(t *testing.T) []byte {
+	t.Helper()
+	encode := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"keys": []jwkType{
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(k.ec.X), Y: encode(k.ec.Y)},
+			{Kty: "RSA", Kid: "rsa", N: encode(k.rsa.N), E: encode(big.NewInt(int64(k.rsa.E)))},
+		},
+	})
+	assert.NoError(t, err)
+	return b
+}
+
+func (k *testJWKS) sign(t *testing.T, kid string, subject string, expiresAt time.Time) string {
+	t.Helper()
+	claims := jwt.MapClaims{
+		"sub": subject,
+		"iss": "https://idm.example.com",
+		"aud": "msgfilter",
+		"exp": expiresAt.Unix(),
+	}
+	var token *jwt.Token
+	var key interface{}
+	if kid == "rsa" {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), k.rsa
+	} else {
+		token, key = jwt.NewWithClaims(jwt.SigningMethodES256, claims), k.ec
+	}
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func setUpJWT(t *testing.T, settings *jwtType) (*testJWKS, *jwtAuthenticator, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "jwt")
+	assert.NoError(t, err)
+	jwks := newTestJWKS(t)
+	settings.JWKSFile = filepath.Join(dir, "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(settings.JWKSFile, jwks.json(t), 0600))
+
+	a, err := newJWTAuthenticator(settings)
+	assert.NoError(t, err)
+	return jwks, a, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	assert := assert.New(t)
+	jwks, a, tearDown := setUpJWT(t, &jwtType{Issuer: "https://idm.example.com", Audience: "msgfilter"})
+	defer tearDown()
+
+	authenticate := func(value string) (string, error) {
+		r := httptest.NewRequest("POST", "/distinct/", nil)
+		if len(value) != 0 {
+			r.Header.Set(authorization, value)
+		}
+		identity, err := a.Authenticate(r)
+		if err != nil {
+			return "", err
+		}
+		return identity.Principal, nil
+	}
+
+	principal, err := authenticate("Bearer " + jwks.sign(t, "ec", "bridge", time.Now().Add(time.Minute)))
+	assert.NoError(err)
+	assert.Equal("bridge", principal)
+	principal, err = authenticate("Bearer " + jwks.sign(t, "rsa", "agent", time.Now().Add(time.Minute)))
+	assert.NoError(err)
+	assert.Equal("agent", principal)
+
+	_, err = authenticate("")
+	assert.Equal(errNoCredentials, err)
+	_, err = authenticate("Basic YnJpZGdlOmtleQ==")
+	assert.Equal(errNoCredentials, err)
+
+	// the token signed by the other key
+	other := newTestJWKS(t)
+	_, err = authenticate("Bearer " + other.sign(t, "ec", "bridge", time.Now().Add(time.Minute)))
+	assert.Error(err)
+	_, err = authenticate("Bearer " + jwks.sign(t, "unknown", "bridge", time.Now().Add(time.Minute)))
+	assert.Error(err)
+	_, err = authenticate("Bearer invalid")
+	assert.Error(err)
+
+	// the symmetric algorithm is not accepted even if the public key is used as the secret
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "bridge", "exp": time.Now().Add(time.Minute).Unix()})
+	token.Header["kid"] = "ec"
+	signed, err := token.SignedString([]byte("secret"))
+	assert.NoError(err)
+	_, err = authenticate("Bearer " + signed)
+	assert.Error(err)
+
+	// the token without exp, of the other issuer or of the other audience
+	for _, claims := range []jwt.MapClaims{
+		{"sub": "bridge", "iss": "https://idm.example.com", "aud": "msgfilter"},
+		{"sub": "bridge", "iss": "https://other.example.com", "aud": "msgfilter", "exp": time.Now().Add(time.Minute).Unix()},
+		{"sub": "bridge", "iss": "https://idm.example.com", "aud": "other", "exp": time.Now().Add(time.Minute).Unix()},
+		{"iss": "https://idm.example.com", "aud": "msgfilter", "exp": time.Now().Add(time.Minute).Unix()},
+	} {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "ec"
+		signed, err := token.SignedString(jwks.ec)
+		assert.NoError(err)
+		_, err = authenticate("Bearer " + signed)
+		assert.Error(err, "%v", claims)
+	}
+}
+
+func TestJWTAuthenticatorPrincipalClaim(t *testing.T) {
+	assert := assert.New(t)
+	jwks, a, tearDown := setUpJWT(t, &jwtType{PrincipalClaim: "azp"})
+	defer tearDown()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "user", "azp": "bridge", "exp": time.Now().Add(time.Minute).Unix()})
+	signed, err := token.SignedString(jwks.ec)
+	assert.NoError(err)
+
+	// kid is required when the JWKS has multiple keys
+	r := httptest.NewRequest("POST", "/distinct/", nil)
+	r.Header.Set(authorization, "Bearer "+signed)
+	_, err = a.Authenticate(r)
+	assert.Error(err)
+
+	delete(a.keys, "rsa")
+	identity, err := a.Authenticate(r)
+	assert.NoError(err)
+	assert.Equal(&Identity{Principal: "bridge"}, identity)
+}
+
+func TestLoadJWKS(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "jwt")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jwks.json")
+
+	for _, content := range []string{
+		"",
+		`{"keys": []}`,
+		`{"keys": [{"kty": "oct", "kid": "k", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "k", "crv": "P-192", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "k", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "RSA", "kid": "k", "n": "", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "RSA", "kid": "k", "n": "!", "e": "AQAB"}]}`,
+	} {
+		assert.NoError(ioutil.WriteFile(path, []byte(content), 0600))
+		_, err := loadJWKS(path)
+		assert.Error(err, content)
+	}
+}
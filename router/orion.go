@@ -0,0 +1,139 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	fiwareServicePath  = "Fiware-ServicePath"
+	defaultServicePath = "/"
+	scopeSeparator     = "|"
+)
+
+// orionProxy : proxy NGSI v2 update requests to Orion Context Broker only when they are not duplicated.
+type orionProxy struct {
+	upstream *url.URL
+	holder   *conf.Holder
+	checker  *checker.Checker
+}
+
+func newOrionProxy(holder *conf.Holder, c *checker.Checker) (*orionProxy, error) {
+	upstream, err := url.Parse(holder.Get().OrionURL)
+	if err != nil {
+		return nil, err
+	}
+	return &orionProxy{
+		upstream: upstream,
+		holder:   holder,
+		checker:  c,
+	}, nil
+}
+
+func (p *orionProxy) handle(context *gin.Context) {
+	logger := utils.NewLogger("orionProxy").WithContext(context.Request.Context())
+	config := p.holder.Get()
+
+	body, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil {
+		logger.Errorf("read body failed: %s", err.Error())
+		context.JSON(http.StatusBadRequest, gin.H{
+			"error":       "BadRequest",
+			"description": err.Error(),
+		})
+		return
+	}
+	identity, err := payload.Identity(payload.NGSIv2, string(body), payload.Options{
+		ExcludeTimestamp: config.ExcludeTimestamp,
+	})
+	if err != nil {
+		logger.Errorf("validate failed: %s", err.Error())
+		context.JSON(http.StatusBadRequest, gin.H{
+			"error":       "ParseError",
+			"description": err.Error(),
+		})
+		return
+	}
+
+	// the same entities of the different tenants or the different requests are not duplicate
+	service := context.Request.Header.Get(fiwareService)
+	servicePath := context.Request.Header.Get(fiwareServicePath)
+	if len(servicePath) == 0 {
+		servicePath = defaultServicePath
+	}
+	message := checker.Message{
+		Service: service,
+		Payload: strings.Join([]string{service, servicePath, context.Request.URL.RequestURI(), identity}, scopeSeparator),
+	}
+	isDup, err := p.checker.IsDuplicateContext(context.Request.Context(), message)
+	context.Set(verdictKey, checker.Verdict(isDup, err))
+	if isDup || err != nil {
+		logger.Infof("duplicate payload = %s", utils.Payload(message.Payload))
+		if len(config.OrionDuplicateBody) == 0 {
+			context.Status(config.OrionDuplicateStatus)
+		} else {
+			context.Data(config.OrionDuplicateStatus, "application/json", []byte(config.OrionDuplicateBody))
+		}
+		return
+	}
+
+	logger.Infof("new payload = %s", utils.Payload(message.Payload))
+	context.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	p.reverseProxy(message, context.GetString(requestIDKey)).ServeHTTP(context.Writer, context.Request)
+}
+
+// reverseProxy makes the checker forget the message when Orion could not process it,
+// so that the client can retry to send the same message.
+func (p *orionProxy) reverseProxy(message checker.Message, requestID string) *httputil.ReverseProxy {
+	logger := utils.NewLogger("orionProxy").With(utils.FieldRequestID, requestID)
+	proxy := httputil.NewSingleHostReverseProxy(p.upstream)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// Orion logs the same correlator as this service
+		r.Header.Set(fiwareCorrelator, requestID)
+		// Orion continues the trace of this service instead of the one of the client
+		otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// the correlator of this service is already set
+		resp.Header.Del(fiwareCorrelator)
+		if resp.StatusCode >= http.StatusInternalServerError {
+			logger.Warnf("upstream responded %d", resp.StatusCode)
+			p.forget(logger, message)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		logger.Errorf("upstream failed: %s", err.Error())
+		p.forget(logger, message)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
+
+// forget logs the failure of Forget, because the retried message is regarded as duplicate until DATA_TTL expires.
+func (p *orionProxy) forget(logger *utils.Logger, message checker.Message) {
+	if err := p.checker.Forget(message); err != nil {
+		logger.Errorf("forget failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+type orionRequest struct {
+	path        string
+	servicePath string
+	body        string
+}
+
+func setUpOrion(t *testing.T, upstreamStatus int, config *conf.Config) (*mock.MockKeysAPI, *httptest.Server, *[]string, func(orionRequest) *http.Response, func()) {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	ctrl := gomock.NewController(t)
+	kapi := mock.NewMockKeysAPI(ctrl)
+
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+	checker.GetMutexID = func(_ string) string {
+		return "mutexID"
+	}
+
+	received := []string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r.URL.Path+" "+r.Header.Get(fiwareService)+" "+string(b))
+		w.WriteHeader(upstreamStatus)
+	}))
+	config.OrionURL = upstream.URL
+
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(t, err)
+	ts := httptest.NewServer(handler.Engine)
+
+	doRequest := func(req orionRequest) *http.Response {
+		r, err := http.NewRequest("POST", ts.URL+req.path, bytes.NewBufferString(req.body))
+		assert.NoError(t, err)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(fiwareService, "tenant")
+		r.Header.Set(fiwareServicePath, req.servicePath)
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		return resp
+	}
+	tearDown := func() {
+		ts.Close()
+		upstream.Close()
+		ctrl.Finish()
+	}
+	return kapi, upstream, &received, doRequest, tearDown
+}
+
+// dedupKey is the key of the identity in etcd without "/data/" or "/lock/".
+func dedupKey(service string, topic string, identity string) string {
+	prefix := "-/"
+	if len(service) != 0 {
+		prefix = strings.Replace(url.PathEscape(service), ".", "%2E", -1) + "/"
+	}
+	sum := sha256.Sum256([]byte(identity))
+	if len(topic) == 0 {
+		return prefix + "n/" + hex.EncodeToString(sum[:])
+	}
+	return prefix + "t/" + strings.Replace(url.PathEscape(topic), ".", "%2E", -1) + "/" + hex.EncodeToString(sum[:])
+}
+
+func expectCheck(kapi *mock.MockKeysAPI, config *conf.Config, key string, isDuplicate bool) {
+	lockOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.LockTTL),
+	}
+	dataOptions := &client.SetOptions{
+		PrevExist: client.PrevNoExist,
+		TTL:       time.Second * time.Duration(config.DataTTL),
+	}
+	keyNotFound := client.Error{
+		Code: client.ErrorCodeKeyNotFound,
+	}
+	if isDuplicate {
+		gomock.InOrder(
+			kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
+			kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, nil),
+			kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+		)
+	} else {
+		gomock.InOrder(
+			kapi.EXPECT().Set(context.TODO(), "/lock/"+key, "mutexID", lockOptions).Return(nil, nil),
+			kapi.EXPECT().Get(context.Background(), "/data/"+key, nil).Return(nil, keyNotFound),
+			kapi.EXPECT().Set(context.Background(), "/data/"+key, gomock.Any(), dataOptions).Return(nil, nil),
+			kapi.EXPECT().Delete(context.TODO(), "/lock/"+key, &client.DeleteOptions{PrevValue: "mutexID"}).Return(nil, nil),
+		)
+	}
+}
+
+func TestOrionProxyForward(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	kapi, _, received, doRequest, tearDown := setUpOrion(t, http.StatusCreated, config)
+	defer tearDown()
+
+	body := `{"id":"dev1","type":"Thing","temperature":{"type":"Number","value":25.3}}`
+	expectCheck(kapi, config, dedupKey("tenant", "", `tenant|/|/v2/entities|[{"id":"dev1","type":"Thing","attrs":{"temperature":25.3}}]`), false)
+
+	r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: body})
+	assert.Equal(http.StatusCreated, r.StatusCode)
+	assert.Equal([]string{"/v2/entities tenant " + body}, *received)
+}
+
+func TestOrionProxyDuplicate(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	kapi, _, received, doRequest, tearDown := setUpOrion(t, http.StatusNoContent, config)
+	defer tearDown()
+
+	body := `{"actionType":"append","entities":[{"id":"dev1","type":"Thing","temperature":25.3}]}`
+	expectCheck(kapi, config, dedupKey("tenant", "", `tenant|/x|/v2/op/update|append:[{"id":"dev1","type":"Thing","attrs":{"temperature":25.3}}]`), true)
+
+	r := doRequest(orionRequest{path: "/v2/op/update", servicePath: "/x", body: body})
+	assert.Equal(http.StatusNoContent, r.StatusCode)
+	assert.Empty(*received)
+}
+
+func TestOrionProxyDuplicateResponse(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	config.OrionDuplicateStatus = http.StatusOK
+	config.OrionDuplicateBody = `{"result":"duplicate"}`
+	kapi, _, received, doRequest, tearDown := setUpOrion(t, http.StatusNoContent, config)
+	defer tearDown()
+
+	expectCheck(kapi, config, dedupKey("tenant", "", `tenant|/|/v2/entities|[{"id":"dev1","type":"","attrs":{}}]`), true)
+
+	r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: `{"id":"dev1"}`})
+	assert.Equal(http.StatusOK, r.StatusCode)
+	assert.Equal("application/json", r.Header.Get("Content-Type"))
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"duplicate"}`, string(b))
+	assert.Empty(*received)
+}
+
+func TestOrionProxyUpstreamError(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	kapi, _, received, doRequest, tearDown := setUpOrion(t, http.StatusServiceUnavailable, config)
+	defer tearDown()
+
+	key := dedupKey("tenant", "", `tenant|/|/v2/entities|[{"id":"dev1","type":"","attrs":{}}]`)
+	expectCheck(kapi, config, key, false)
+	kapi.EXPECT().Delete(context.Background(), "/data/"+key, nil).Return(nil, nil)
+
+	r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: `{"id":"dev1"}`})
+	assert.Equal(http.StatusServiceUnavailable, r.StatusCode)
+	assert.Len(*received, 1)
+}
+
+func TestOrionProxyUnreachable(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	kapi, upstream, _, doRequest, tearDown := setUpOrion(t, http.StatusCreated, config)
+	defer tearDown()
+	upstream.Close()
+
+	key := dedupKey("tenant", "", `tenant|/|/v2/entities|[{"id":"dev1","type":"","attrs":{}}]`)
+	expectCheck(kapi, config, key, false)
+	kapi.EXPECT().Delete(context.Background(), "/data/"+key, nil).Return(nil, nil)
+
+	r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: `{"id":"dev1"}`})
+	assert.Equal(http.StatusBadGateway, r.StatusCode)
+}
+
+func TestOrionProxyForgetFailed(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	kapi, _, _, doRequest, tearDown := setUpOrion(t, http.StatusServiceUnavailable, config)
+	defer tearDown()
+
+	key := dedupKey("tenant", "", `tenant|/|/v2/entities|[{"id":"dev1","type":"","attrs":{}}]`)
+	expectCheck(kapi, config, key, false)
+	kapi.EXPECT().Delete(context.Background(), "/data/"+key, nil).Return(nil, errors.New("etcd down"))
+
+	logs := captureLogs(t, "orionProxy", func() {
+		r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: `{"id":"dev1"}`})
+		assert.Equal(http.StatusServiceUnavailable, r.StatusCode)
+	})
+	if assert.Len(logs, 3) {
+		assert.Equal("error", logs[2]["level"])
+		assert.Equal("forget failed: etcd down", logs[2]["msg"])
+	}
+}
+
+func TestOrionProxyBadRequest(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	_, _, received, doRequest, tearDown := setUpOrion(t, http.StatusCreated, config)
+	defer tearDown()
+
+	for _, body := range []string{"", "invalid", `{"type":"Thing"}`, `{"entities":{}}`, `[]`} {
+		r := doRequest(orionRequest{path: "/v2/entities", servicePath: "/", body: body})
+		assert.Equal(http.StatusBadRequest, r.StatusCode, body)
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.Contains(string(b), "ParseError", body)
+	}
+	assert.Empty(*received)
+}
+
+func TestOrionProxyDisabled(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	r, err := doRequest("POST", "/v2/entities", "application/json", dedupKey("", "", "a"), `{"id":"dev1"}`, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, r.StatusCode)
+}
@@ -0,0 +1,234 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+const (
+	xAuthToken    = "X-Auth-Token"
+	xSubjectToken = "X-Subject-Token"
+)
+
+// idmTimeout : injection point to shorten the timeout of the requests to IdM in tests
+var idmTimeout = time.Second * 5
+
+// pepCacheMaxEntries : the maximum number of the cached tokens, which bounds the memory used by the random tokens
+var pepCacheMaxEntries = 10000
+
+// idmUnavailableError : IdM could not validate the token, which is not the fault of the client (503)
+type idmUnavailableError struct {
+	err error
+}
+
+func (e *idmUnavailableError) Error() string {
+	return "idm unavailable: " + e.err.Error()
+}
+
+type keystoneTokenType struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		User      struct {
+			Name string `json:"name"`
+		} `json:"user"`
+		Project *struct {
+			Name   string `json:"name"`
+			Domain struct {
+				Name string `json:"name"`
+			} `json:"domain"`
+		} `json:"project"`
+		Domain *struct {
+			Name string `json:"name"`
+		} `json:"domain"`
+	} `json:"token"`
+}
+
+type keyrockUserType struct {
+	Username      string `json:"username"`
+	ID            string `json:"id"`
+	Organizations []struct {
+		Name string `json:"name"`
+	} `json:"organizations"`
+}
+
+type pepCacheEntry struct {
+	identity *Identity
+	err      error
+	expires  time.Time
+}
+
+/*
+pepAuthenticator : authenticate X-Auth-Token header by IdM like PEP Proxy of FIWARE.
+	Keystone : the token is validated by GET /v3/auth/tokens, and the service is the domain of the token scope.
+	Keyrock  : the token is validated by GET /user, and the services are the organizations of the user.
+	The results (including the invalid tokens) are cached for PEP_CACHE_TTL seconds.
+*/
+type pepAuthenticator struct {
+	idmURL   string
+	scheme   string
+	validate func(r *http.Request, token string) (*Identity, time.Time, error)
+	client   *http.Client
+	ttl      time.Duration
+	mutex    sync.Mutex
+	cache    map[[sha256.Size]byte]*pepCacheEntry
+}
+
+func newPepAuthenticator(config *conf.Config) *pepAuthenticator {
+	a := &pepAuthenticator{
+		idmURL: config.PepIdMURL,
+		scheme: "Keystone uri=\"" + config.PepIdMURL + "\"",
+		client: &http.Client{Timeout: idmTimeout},
+		ttl:    time.Second * time.Duration(config.PepCacheTTL),
+		cache:  map[[sha256.Size]byte]*pepCacheEntry{},
+	}
+	if config.PepIdMType == conf.PepKeyrock {
+		a.scheme = "Keyrock uri=\"" + config.PepIdMURL + "\""
+		a.validate = a.validateKeyrock
+	} else {
+		a.validate = a.validateKeystone
+	}
+	return a
+}
+
+func (a *pepAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := r.Header.Get(xAuthToken)
+	if len(token) == 0 {
+		return nil, errNoCredentials
+	}
+	// the tokens are cached by their hashes, so a dump of the memory does not leak the tokens
+	key := sha256.Sum256([]byte(token))
+	if entry, ok := a.cached(key); ok {
+		return entry.identity, entry.err
+	}
+
+	identity, expires, err := a.validate(r, token)
+	if _, ok := err.(*idmUnavailableError); !ok {
+		a.store(key, &pepCacheEntry{identity: identity, err: err, expires: expires})
+	}
+	return identity, err
+}
+
+func (a *pepAuthenticator) Scheme() string {
+	return a.scheme
+}
+
+func (a *pepAuthenticator) cached(key [sha256.Size]byte) (*pepCacheEntry, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	entry, ok := a.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !now().Before(entry.expires) {
+		delete(a.cache, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// store caches the result until PEP_CACHE_TTL passes or the token expires.
+func (a *pepAuthenticator) store(key [sha256.Size]byte, entry *pepCacheEntry) {
+	if a.ttl <= 0 {
+		return
+	}
+	current := now()
+	if limit := current.Add(a.ttl); entry.expires.IsZero() || limit.Before(entry.expires) {
+		entry.expires = limit
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.cache) >= pepCacheMaxEntries {
+		for k, e := range a.cache {
+			if !current.Before(e.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= pepCacheMaxEntries {
+			return
+		}
+	}
+	a.cache[key] = entry
+}
+
+// validateKeystone validates the token by itself, so the token must be allowed to validate its own.
+func (a *pepAuthenticator) validateKeystone(r *http.Request, token string) (*Identity, time.Time, error) {
+	req, err := http.NewRequest("GET", a.idmURL+"/v3/auth/tokens", nil)
+	if err != nil {
+		return nil, time.Time{}, &idmUnavailableError{err}
+	}
+	req.Header.Set(xAuthToken, token)
+	req.Header.Set(xSubjectToken, token)
+
+	var body keystoneTokenType
+	if err := a.get(r, req, &body); err != nil {
+		return nil, time.Time{}, err
+	}
+	services := []string{}
+	if body.Token.Project != nil {
+		services = append(services, body.Token.Project.Domain.Name)
+	} else if body.Token.Domain != nil {
+		services = append(services, body.Token.Domain.Name)
+	}
+	return &Identity{Principal: body.Token.User.Name, Services: services}, body.Token.ExpiresAt, nil
+}
+
+func (a *pepAuthenticator) validateKeyrock(r *http.Request, token string) (*Identity, time.Time, error) {
+	req, err := http.NewRequest("GET", a.idmURL+"/user?access_token="+url.QueryEscape(token), nil)
+	if err != nil {
+		return nil, time.Time{}, &idmUnavailableError{err}
+	}
+
+	var body keyrockUserType
+	if err := a.get(r, req, &body); err != nil {
+		return nil, time.Time{}, err
+	}
+	principal := body.Username
+	if len(principal) == 0 {
+		principal = body.ID
+	}
+	services := []string{}
+	for _, organization := range body.Organizations {
+		services = append(services, organization.Name)
+	}
+	return &Identity{Principal: principal, Services: services}, time.Time{}, nil
+}
+
+// get sends the request to IdM, and decodes the response.
+// 401 and 404 mean the invalid token, and the other failures mean IdM is unavailable.
+func (a *pepAuthenticator) get(r *http.Request, req *http.Request, body interface{}) error {
+	resp, err := a.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return &idmUnavailableError{err}
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("invalid token: %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return &idmUnavailableError{fmt.Errorf("unexpected status: %d", resp.StatusCode)}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(body); err != nil {
+		return &idmUnavailableError{err}
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+// testIdM : the stand-in of Keystone and Keyrock, which knows the tokens below
+//
+//	"token1" : scoped to the project of "tenant1" domain by "user1"
+//	"token2" : scoped to "tenant2" domain by "user2"
+//	"token3" : the user of Keyrock in "tenant1" and "tenant3" organizations
+//	"broken" : IdM fails
+type testIdM struct {
+	server   *httptest.Server
+	requests int32
+}
+
+func newTestIdM(t *testing.T, expiresAt time.Time) *testIdM {
+	t.Helper()
+	idm := &testIdM{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/auth/tokens", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idm.requests, 1)
+		token := r.Header.Get(xSubjectToken)
+		if token != r.Header.Get(xAuthToken) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var body map[string]interface{}
+		switch token {
+		case "token1":
+			body = map[string]interface{}{
+				"expires_at": expiresAt.Format(time.RFC3339Nano),
+				"user":       map[string]interface{}{"name": "user1"},
+				"project":    map[string]interface{}{"name": "/path", "domain": map[string]interface{}{"name": "tenant1"}},
+			}
+		case "token2":
+			body = map[string]interface{}{
+				"expires_at": expiresAt.Format(time.RFC3339Nano),
+				"user":       map[string]interface{}{"name": "user2"},
+				"domain":     map[string]interface{}{"name": "tenant2"},
+			}
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(xSubjectToken, token)
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": body})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idm.requests, 1)
+		switch r.URL.Query().Get("access_token") {
+		case "token3":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":       "0123",
+				"username": "user3",
+				"organizations": []map[string]interface{}{
+					{"id": "o1", "name": "tenant1", "roles": []interface{}{}},
+					{"id": "o3", "name": "tenant3", "roles": []interface{}{}},
+				},
+			})
+		case "broken":
+			w.Write([]byte("{"))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	idm.server = httptest.NewServer(mux)
+	return idm
+}
+
+func (idm *testIdM) count() int {
+	return int(atomic.LoadInt32(&idm.requests))
+}
+
+func newPepConfig(idm *testIdM, idmType string) *conf.Config {
+	config := conf.NewConfig()
+	config.PepIdMURL = idm.server.URL
+	config.PepIdMType = idmType
+	return config
+}
+
+func authenticateToken(a *pepAuthenticator, token string) (*Identity, error) {
+	r := httptest.NewRequest("POST", "/distinct/", nil)
+	if len(token) != 0 {
+		r.Header.Set(xAuthToken, token)
+	}
+	return a.Authenticate(r)
+}
+
+func TestPepAuthenticatorKeystone(t *testing.T) {
+	assert := assert.New(t)
+	idm := newTestIdM(t, time.Now().Add(time.Hour))
+	defer idm.server.Close()
+	a := newPepAuthenticator(newPepConfig(idm, conf.PepKeystone))
+	assert.Equal(`Keystone uri="`+idm.server.URL+`"`, a.Scheme())
+
+	identity, err := authenticateToken(a, "token1")
+	assert.NoError(err)
+	assert.Equal(&Identity{Principal: "user1", Services: []string{"tenant1"}}, identity)
+	identity, err = authenticateToken(a, "token2")
+	assert.NoError(err)
+	assert.Equal(&Identity{Principal: "user2", Services: []string{"tenant2"}}, identity)
+
+	_, err = authenticateToken(a, "")
+	assert.Equal(errNoCredentials, err)
+	_, err = authenticateToken(a, "unknown")
+	assert.Error(err)
+	_, ok := err.(*idmUnavailableError)
+	assert.False(ok)
+	_, err = authenticateToken(a, "broken")
+	_, ok = err.(*idmUnavailableError)
+	assert.True(ok)
+}
+
+func TestPepAuthenticatorKeyrock(t *testing.T) {
+	assert := assert.New(t)
+	idm := newTestIdM(t, time.Now().Add(time.Hour))
+	defer idm.server.Close()
+	a := newPepAuthenticator(newPepConfig(idm, conf.PepKeyrock))
+	assert.Equal(`Keyrock uri="`+idm.server.URL+`"`, a.Scheme())
+
+	identity, err := authenticateToken(a, "token3")
+	assert.NoError(err)
+	assert.Equal(&Identity{Principal: "user3", Services: []string{"tenant1", "tenant3"}}, identity)
+
+	_, err = authenticateToken(a, "token1")
+	assert.Error(err)
+	_, err = authenticateToken(a, "broken")
+	_, ok := err.(*idmUnavailableError)
+	assert.True(ok)
+}
+
+func TestPepAuthenticatorCache(t *testing.T) {
+	assert := assert.New(t)
+	current := time.Now()
+	original := now
+	now = func() time.Time { return current }
+	defer func() { now = original }()
+
+	idm := newTestIdM(t, current.Add(time.Second*30))
+	defer idm.server.Close()
+	a := newPepAuthenticator(newPepConfig(idm, conf.PepKeystone))
+
+	// the valid and the invalid tokens are cached, but the failures of IdM are not
+	for i := 0; i < 3; i++ {
+		_, err := authenticateToken(a, "token1")
+		assert.NoError(err)
+		_, err = authenticateToken(a, "unknown")
+		assert.Error(err)
+		_, err = authenticateToken(a, "broken")
+		assert.Error(err)
+	}
+	assert.Equal(5, idm.count())
+	assert.Len(a.cache, 2)
+
+	// the token is validated again when it expires before PEP_CACHE_TTL
+	current = current.Add(time.Second * 30)
+	_, err := authenticateToken(a, "token1")
+	assert.NoError(err)
+	assert.Equal(6, idm.count())
+
+	// the invalid token is validated again after PEP_CACHE_TTL
+	current = current.Add(time.Second * 30)
+	_, err = authenticateToken(a, "unknown")
+	assert.Error(err)
+	assert.Equal(7, idm.count())
+
+	// the expired entries are removed when the cache is full
+	originalMax := pepCacheMaxEntries
+	pepCacheMaxEntries = 2
+	defer func() { pepCacheMaxEntries = originalMax }()
+	current = current.Add(time.Minute * 2)
+	_, err = authenticateToken(a, "token2")
+	assert.NoError(err)
+	assert.Len(a.cache, 1)
+
+	// the cache is disabled by PEP_CACHE_TTL=0
+	config := newPepConfig(idm, conf.PepKeystone)
+	config.PepCacheTTL = 0
+	a = newPepAuthenticator(config)
+	authenticateToken(a, "token1")
+	authenticateToken(a, "token1")
+	assert.Equal(10, idm.count())
+	assert.Len(a.cache, 0)
+}
+
+func TestAuthenticatePep(t *testing.T) {
+	assert := assert.New(t)
+	idm := newTestIdM(t, time.Now().Add(time.Hour))
+	defer idm.server.Close()
+	config, _, tearDown := setUpAuth(t)
+	defer tearDown()
+	config.PepIdMURL = idm.server.URL
+	engine := newAuthEngine(t, config)
+
+	testCases := []struct {
+		token   string
+		apiKey  string
+		service string
+		code    int
+	}{
+		{token: "token1", service: "tenant1", code: http.StatusOK},
+		{token: "token1", service: "tenant2", code: http.StatusForbidden},
+		{token: "token1", code: http.StatusForbidden},
+		{token: "token2", service: "tenant2", code: http.StatusOK},
+		{token: "unknown", service: "tenant1", code: http.StatusUnauthorized},
+		{token: "broken", service: "tenant1", code: http.StatusServiceUnavailable},
+		// the methods of AUTH_FILE are still available
+		{apiKey: "bridge-key", service: "tenant1", code: http.StatusOK},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("POST", "/distinct/", nil)
+		if len(testCase.token) != 0 {
+			r.Header.Set(xAuthToken, testCase.token)
+		}
+		if len(testCase.apiKey) != 0 {
+			r.Header.Set(xAPIKey, testCase.apiKey)
+		}
+		if len(testCase.service) != 0 {
+			r.Header.Set(fiwareService, testCase.service)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		assert.Equal(testCase.code, w.Code, "%v", testCase)
+		if testCase.code == http.StatusUnauthorized {
+			assert.Contains(w.Header()["Www-Authenticate"], `Keystone uri="`+idm.server.URL+`"`)
+		}
+	}
+
+	// PEP mode without AUTH_FILE
+	config = newPepConfig(idm, conf.PepKeystone)
+	a, err := newAuth(config)
+	assert.NoError(err)
+	assert.Len(a.authenticators, 1)
+	engine = newAuthEngine(t, config)
+	r := httptest.NewRequest("POST", "/distinct/", nil)
+	r.Header.Set(xAuthToken, "token1")
+	r.Header.Set(fiwareService, "tenant1")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("user1:", w.Body.String())
+}
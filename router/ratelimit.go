@@ -0,0 +1,211 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	rejectedRateLimit = "rate_limit"
+	rejectedQuota     = "quota"
+)
+
+var rejectedErrors = map[string]string{
+	rejectedRateLimit: "rate limit exceeded",
+	rejectedQuota:     "quota of live keys exceeded",
+}
+
+// maxBuckets : the maximum number of the token buckets, which bounds the memory used by the random clients
+var maxBuckets = 10000
+
+type limitSource interface {
+	Limits(service string) (int, int)
+	InstanceKeys(service string) (int, time.Time)
+}
+
+// bucket : the token bucket of a client and a service
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+/*
+limiter : the rate limits of each client and service, and the quotas of the live data keys of each service.
+	The client is the authenticated principal, or the IP address without authentication.
+	Both of them are counted by each instance, so the limits of the cluster are multiplied by the number of instances,
+	and the quotas count only the data keys created by this instance since it started.
+*/
+type limiter struct {
+	holder  *conf.Holder
+	source  limitSource
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newLimiter(holder *conf.Holder, source limitSource) *limiter {
+	return &limiter{
+		holder:  holder,
+		source:  source,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow returns the reason and the time to retry if the request of the client to the service is rejected.
+func (l *limiter) allow(client string, service string) (string, time.Duration) {
+	rateLimit, quota := l.source.Limits(service)
+	if rateLimit > 0 {
+		burst := l.holder.Get().RateLimitBurst
+		if burst == 0 {
+			burst = rateLimit
+		}
+		if wait, ok := l.take(client+"\n"+service, rateLimit, burst); !ok {
+			return rejectedRateLimit, wait
+		}
+	}
+	if quota > 0 {
+		if count, oldest := l.source.InstanceKeys(service); count >= quota {
+			return rejectedQuota, oldest.Sub(now())
+		}
+	}
+	return "", 0
+}
+
+// take takes a token from the bucket, or returns the time until a token is added.
+func (l *limiter) take(key string, rateLimit int, burst int) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	current := now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(current)
+		}
+		b = &bucket{tokens: float64(burst), last: current}
+		l.buckets[key] = b
+	}
+
+	rate := float64(rateLimit)
+	b.tokens = math.Min(float64(burst), b.tokens+current.Sub(b.last).Seconds()*rate)
+	b.last = current
+	defer func() {
+		b.full = current.Add(time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second)))
+	}()
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+}
+
+// prune removes the full buckets, which are the same as the new ones.
+// If no bucket is full, the bucket to be full first is removed, so that the buckets never exceed maxBuckets.
+func (l *limiter) prune(current time.Time) {
+	var nearest *bucket
+	nearestKey := ""
+	for key, b := range l.buckets {
+		if !current.Before(b.full) {
+			delete(l.buckets, key)
+		} else if nearest == nil || b.full.Before(nearest.full) {
+			nearest, nearestKey = b, key
+		}
+	}
+	if len(l.buckets) >= maxBuckets && nearest != nil {
+		delete(l.buckets, nearestKey)
+	}
+}
+
+// clientOf returns the client of the request, which is the authenticated principal or the address without authentication.
+func clientOf(context *gin.Context, config *conf.Config) string {
+	if principal := utils.FieldFromContext(context.Request.Context(), utils.FieldPrincipal); len(principal) != 0 {
+		return principal
+	}
+	return clientAddress(context.Request, config.TrustedProxies)
+}
+
+// clientAddress returns the address of the client of the request.
+// X-Forwarded-For is trusted only when the peer is one of TRUSTED_PROXIES (IP addresses or CIDRs),
+// and then the client is the last address in it which is not a trusted proxy.
+func clientAddress(r *http.Request, trustedProxies []string) string {
+	address, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		address = r.RemoteAddr
+	}
+	if !isTrustedProxy(address, trustedProxies) {
+		return address
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if len(hop) == 0 {
+			continue
+		}
+		address = hop
+		if !isTrustedProxy(address, trustedProxies) {
+			break
+		}
+	}
+	return address
+}
+
+func isTrustedProxy(address string, trustedProxies []string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitRequests rejects the requests over the rate limit or the quota by 429 before checking the duplication.
+// The requests for monitoring are not limited.
+func limitRequests(l *limiter) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if internalPaths[context.Request.URL.Path] {
+			context.Next()
+			return
+		}
+		ctx := context.Request.Context()
+		client := clientOf(context, l.holder.Get())
+		service := context.Request.Header.Get(fiwareService)
+
+		reason, wait := l.allow(client, service)
+		if len(reason) == 0 {
+			context.Next()
+			return
+		}
+		utils.NewLogger("limit").WithContext(ctx).Warnf("request rejected: %s, client=%s, service=%q", reason, client, service)
+		metrics.IncRejected(metrics.Tenant(l.holder.Get(), service), reason)
+		// Retry-After is in seconds, and 0 would make the clients retry immediately
+		context.Header("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+		context.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"result": "failure",
+			"error":  rejectedErrors[reason],
+		})
+	}
+}
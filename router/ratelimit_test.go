@@ -0,0 +1,206 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+type fakeLimits struct {
+	rateLimit    int
+	quota        int
+	instanceKeys int
+	oldest       time.Time
+}
+
+func (f *fakeLimits) Limits(service string) (int, int) {
+	return f.rateLimit, f.quota
+}
+
+func (f *fakeLimits) InstanceKeys(service string) (int, time.Time) {
+	return f.instanceKeys, f.oldest
+}
+
+func setUpLimiter(t *testing.T, limits *fakeLimits) (*gin.Engine, *conf.Config, *time.Time, func()) {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	current := time.Date(2018, 12, 31, 18, 0, 0, 0, time.UTC)
+	original := now
+	now = func() time.Time { return current }
+
+	config := conf.NewConfig()
+	engine := gin.New()
+	engine.Use(func(context *gin.Context) {
+		if principal := context.Request.Header.Get("X-Principal"); len(principal) != 0 {
+			ctx := utils.ContextWithField(context.Request.Context(), utils.FieldPrincipal, principal)
+			context.Request = context.Request.WithContext(ctx)
+		}
+	})
+	engine.Use(limitRequests(newLimiter(conf.NewHolder(config), limits)))
+	engine.POST("/distinct/", func(context *gin.Context) {
+		context.Status(http.StatusOK)
+	})
+	engine.GET("/metrics", func(context *gin.Context) {
+		context.Status(http.StatusOK)
+	})
+	return engine, config, &current, func() {
+		now = original
+	}
+}
+
+func postLimited(engine *gin.Engine, principal string, service string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/distinct/", nil)
+	if len(principal) != 0 {
+		r.Header.Set("X-Principal", principal)
+	}
+	r.Header.Set(fiwareService, service)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, r)
+	return w
+}
+
+func TestLimitRequestsRate(t *testing.T) {
+	assert := assert.New(t)
+	limits := &fakeLimits{rateLimit: 2}
+	engine, config, current, tearDown := setUpLimiter(t, limits)
+	defer tearDown()
+	config.RateLimitBurst = 3
+
+	// the burst is allowed, and then the requests are limited to the rate
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, postLimited(engine, "bridge", "tenant1").Code)
+	}
+	w := postLimited(engine, "bridge", "tenant1")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("1", w.Header().Get("Retry-After"))
+	assert.JSONEq(`{"result":"failure","error":"rate limit exceeded"}`, w.Body.String())
+
+	// the other clients and the other services have their own buckets
+	assert.Equal(http.StatusOK, postLimited(engine, "agent", "tenant1").Code)
+	assert.Equal(http.StatusOK, postLimited(engine, "bridge", "tenant2").Code)
+	// the clients without authentication are identified by their addresses
+	assert.Equal(http.StatusOK, postLimited(engine, "", "tenant1").Code)
+
+	*current = current.Add(time.Millisecond * 500)
+	assert.Equal(http.StatusOK, postLimited(engine, "bridge", "tenant1").Code)
+	assert.Equal(http.StatusTooManyRequests, postLimited(engine, "bridge", "tenant1").Code)
+
+	// the requests for monitoring are not limited
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Equal(http.StatusOK, w.Code)
+	}
+}
+
+func TestLimitRequestsQuota(t *testing.T) {
+	assert := assert.New(t)
+	limits := &fakeLimits{quota: 10, instanceKeys: 9}
+	engine, _, current, tearDown := setUpLimiter(t, limits)
+	defer tearDown()
+
+	assert.Equal(http.StatusOK, postLimited(engine, "bridge", "tenant1").Code)
+
+	limits.instanceKeys = 10
+	limits.oldest = current.Add(time.Second*42 + time.Millisecond)
+	w := postLimited(engine, "bridge", "tenant1")
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("43", w.Header().Get("Retry-After"))
+	assert.JSONEq(`{"result":"failure","error":"quota of live keys exceeded"}`, w.Body.String())
+
+	// 0 means unlimited
+	limits.quota = 0
+	assert.Equal(http.StatusOK, postLimited(engine, "bridge", "tenant1").Code)
+}
+
+func TestLimiterPrune(t *testing.T) {
+	assert := assert.New(t)
+	_, _, current, tearDown := setUpLimiter(t, &fakeLimits{})
+	defer tearDown()
+	original := maxBuckets
+	maxBuckets = 2
+	defer func() { maxBuckets = original }()
+
+	l := newLimiter(conf.NewHolder(conf.NewConfig()), &fakeLimits{})
+	_, ok := l.take("a", 1, 2)
+	assert.True(ok)
+	*current = current.Add(time.Millisecond * 500)
+	_, ok = l.take("b", 1, 2)
+	assert.True(ok)
+
+	// "a" is full again, but "b" is not
+	*current = current.Add(time.Millisecond * 600)
+	_, ok = l.take("c", 1, 2)
+	assert.True(ok)
+	assert.Len(l.buckets, 2)
+	assert.Contains(l.buckets, "b")
+	assert.Contains(l.buckets, "c")
+
+	// no bucket is full, and then "b" to be full first is evicted
+	_, ok = l.take("d", 1, 2)
+	assert.True(ok)
+	assert.Len(l.buckets, 2)
+	assert.Contains(l.buckets, "c")
+	assert.Contains(l.buckets, "d")
+}
+
+func TestLimitRequestsForwarded(t *testing.T) {
+	assert := assert.New(t)
+	engine, config, _, tearDown := setUpLimiter(t, &fakeLimits{rateLimit: 1})
+	defer tearDown()
+
+	post := func(forwarded string) int {
+		r := httptest.NewRequest("POST", "/distinct/", nil)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w.Code
+	}
+	// X-Forwarded-For is ignored without TRUSTED_PROXIES, so the forged addresses share the bucket of the peer
+	assert.Equal(http.StatusOK, post("203.0.113.1"))
+	assert.Equal(http.StatusTooManyRequests, post("203.0.113.2"))
+
+	config.TrustedProxies = []string{"192.0.2.0/24"}
+	assert.Equal(http.StatusOK, post("203.0.113.3"))
+	assert.Equal(http.StatusOK, post("203.0.113.4"))
+	assert.Equal(http.StatusTooManyRequests, post("203.0.113.4"))
+}
+
+func TestClientAddress(t *testing.T) {
+	assert := assert.New(t)
+	trusted := []string{"10.0.0.0/8", "192.0.2.1"}
+
+	testCases := []struct {
+		remote    string
+		forwarded string
+		expected  string
+	}{
+		{remote: "203.0.113.1:1234", forwarded: "198.51.100.1", expected: "203.0.113.1"},
+		{remote: "192.0.2.1:1234", forwarded: "", expected: "192.0.2.1"},
+		{remote: "192.0.2.1:1234", forwarded: "198.51.100.1", expected: "198.51.100.1"},
+		// the addresses added by the client itself are before the nearest untrusted one
+		{remote: "192.0.2.1:1234", forwarded: "1.1.1.1, 198.51.100.1, 10.0.0.2", expected: "198.51.100.1"},
+		{remote: "192.0.2.1:1234", forwarded: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3"},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("POST", "/distinct/", nil)
+		r.RemoteAddr = testCase.remote
+		if len(testCase.forwarded) != 0 {
+			r.Header.Set("X-Forwarded-For", testCase.forwarded)
+		}
+		assert.Equal(testCase.expected, clientAddress(r, trusted), testCase.forwarded)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	xRequestID       = "X-Request-Id"
+	fiwareCorrelator = "Fiware-Correlator"
+	requestIDKey     = "requestID"
+)
+
+// the request id from the client is used only if it is safe to be written in the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:;=/+-]{1,128}$`)
+
+// GenerateRequestID : injection point to mock the generated request id
+var GenerateRequestID = func() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	// UUID version 4
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// assignRequestID accepts X-Request-Id or Fiware-Correlator of the request or generates a new request id.
+// The request id is returned in both of the response headers, and attached to the logs of the request.
+func assignRequestID(context *gin.Context) {
+	id := ""
+	for _, header := range []string{xRequestID, fiwareCorrelator} {
+		if v := context.Request.Header.Get(header); validRequestID.MatchString(v) {
+			id = v
+			break
+		}
+	}
+	if len(id) == 0 {
+		id = GenerateRequestID()
+	}
+
+	context.Set(requestIDKey, id)
+	context.Header(xRequestID, id)
+	context.Header(fiwareCorrelator, id)
+	context.Request = context.Request.WithContext(utils.ContextWithField(context.Request.Context(), utils.FieldRequestID, id))
+	context.Next()
+}
@@ -0,0 +1,78 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+func TestGenerateRequestID(t *testing.T) {
+	assert := assert.New(t)
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	id := GenerateRequestID()
+	assert.Regexp(uuid, id)
+	assert.NotEqual(id, GenerateRequestID())
+}
+
+func TestAssignRequestID(t *testing.T) {
+	assert := assert.New(t)
+	original := GenerateRequestID
+	GenerateRequestID = func() string {
+		return "generated"
+	}
+	defer func() {
+		GenerateRequestID = original
+	}()
+
+	config := conf.NewConfig()
+	kapi, _, _, _, tearDown := setUpOrion(t, http.StatusCreated, config)
+	defer tearDown()
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+
+	testCases := []struct {
+		headers  map[string]string
+		expected string
+	}{
+		{headers: map[string]string{}, expected: "generated"},
+		{headers: map[string]string{xRequestID: "req-1"}, expected: "req-1"},
+		{headers: map[string]string{fiwareCorrelator: "corr-1"}, expected: "corr-1"},
+		{headers: map[string]string{xRequestID: "req-1", fiwareCorrelator: "corr-1"}, expected: "req-1"},
+		{headers: map[string]string{xRequestID: "invalid id"}, expected: "generated"},
+		{headers: map[string]string{xRequestID: strings.Repeat("a", 129)}, expected: "generated"},
+	}
+	for _, testCase := range testCases {
+		expectCheck(kapi, config, dedupKey("", "", "a"), false)
+		var w *httptest.ResponseRecorder
+		logs := captureLogs(t, "isDuplicate", func() {
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(`{"payload": "a"}`))
+			r.Header.Set("Content-Type", "application/json")
+			for k, v := range testCase.headers {
+				r.Header.Set(k, v)
+			}
+			handler.Engine.ServeHTTP(w, r)
+		})
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal(testCase.expected, w.Header().Get(xRequestID))
+		assert.Equal(testCase.expected, w.Header().Get(fiwareCorrelator))
+		if assert.NotEmpty(logs) {
+			assert.Equal(testCase.expected, logs[0][utils.FieldRequestID])
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/metrics"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	streamPath = "/distinct/stream"
+	mimeNDJSON = "application/x-ndjson"
+)
+
+// fullDuplex lets the stream write the verdicts while reading the request body,
+// because the HTTP/1.1 server discards the unread body when the response is written.
+func fullDuplex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == streamPath {
+			if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+				utils.NewLogger("fullDuplex").Warnf("full duplex not enabled: %s", err.Error())
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readLine reads a line without the newline.
+// The line longer than maxSize is discarded to the newline, and reported by tooLong so that the stream is continued.
+func readLine(r *bufio.Reader, maxSize int) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+			if maxSize != 0 && len(line) > maxSize {
+				line, tooLong = nil, true
+			}
+		}
+		if !isPrefix {
+			return line, tooLong, nil
+		}
+	}
+}
+
+/*
+distinctStream checks the newline-delimited JSON messages of a long-lived request, and writes a verdict line for each message in order.
+	Each line is the same as the body of /distinct/, and its verdict is the same as the response body.
+	The messages are checked by STREAM_CONCURRENCY at once, and each verdict is flushed as soon as the verdicts before it are written.
+	Each line is limited by MAX_BODY_SIZE and the rate limit, instead of the whole request.
+*/
+func distinctStream(context *gin.Context, holder *conf.Holder, c *checker.Checker, l *limiter) {
+	ctx := context.Request.Context()
+	logger := utils.NewLogger("distinctStream").WithContext(ctx)
+	config := holder.Get()
+
+	cType := context.Request.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(cType); err != nil || (mediaType != mimeNDJSON && mediaType != mimeJSON) {
+		logger.Errorf("header failed: Content-Type=%s", cType)
+		(&requestError{status: http.StatusBadRequest, message: "Content-Type not allowd: " + cType}).abort(context)
+		return
+	}
+	service := context.Request.Header.Get(fiwareService)
+	client := clientOf(context, config)
+
+	concurrency := config.StreamConcurrency
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	// the verdicts are queued in the order of the lines, and at most concurrency messages are checked at once
+	pending := make(chan chan gin.H, concurrency)
+	semaphore := make(chan struct{}, concurrency)
+	go func() {
+		defer close(pending)
+		reader := bufio.NewReader(context.Request.Body)
+		for {
+			line, tooLong, err := readLine(reader, config.MaxBodySize)
+			if err != nil {
+				if err != io.EOF {
+					logger.Warnf("read stream failed: %s", err.Error())
+				}
+				return
+			}
+			if !tooLong && len(line) == 0 {
+				continue
+			}
+			select {
+			case semaphore <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			verdict := make(chan gin.H, 1)
+			pending <- verdict
+			go func() {
+				defer func() { <-semaphore }()
+				if tooLong {
+					verdict <- (&requestError{
+						status:  http.StatusRequestEntityTooLarge,
+						code:    codeBodyTooLarge,
+						message: "line too large",
+						limit:   config.MaxBodySize,
+					}).body()
+					return
+				}
+				verdict <- checkLine(ctx, config, c, l, client, service, line)
+			}()
+		}
+	}()
+
+	context.Header("Content-Type", mimeNDJSON)
+	context.Status(http.StatusOK)
+	context.Writer.Flush()
+	encoder := json.NewEncoder(context.Writer)
+	failed := false
+	// the queue is drained even after the client is gone, so that the reader has finished when the handler returns
+	for verdict := range pending {
+		h := <-verdict
+		if failed {
+			continue
+		}
+		if err := encoder.Encode(h); err != nil {
+			logger.Warnf("write stream failed: %s", err.Error())
+			failed = true
+			continue
+		}
+		context.Writer.Flush()
+	}
+}
+
+// checkLine checks a line of the stream like distinctMessage, and returns its verdict.
+func checkLine(ctx context.Context, config *conf.Config, c *checker.Checker, l *limiter, client string, service string, line []byte) gin.H {
+	logger := utils.NewLogger("distinctStream").WithContext(ctx)
+	if reason, _ := l.allow(client, service); len(reason) != 0 {
+		logger.Warnf("line rejected: %s, client=%s, service=%q", reason, client, service)
+		metrics.IncRejected(metrics.Tenant(config, service), reason)
+		return gin.H{"result": "failure", "error": rejectedErrors[reason]}
+	}
+	if config.ValidateUTF8 && !utf8.Valid(line) {
+		return (&requestError{status: http.StatusBadRequest, code: codeInvalidEncoding, message: "line is not valid UTF-8"}).body()
+	}
+	body, e := decodeJSON(line)
+	if e == nil {
+		e = body.validate(config)
+	}
+	if e != nil {
+		logger.Errorf("validate failed: %s", e.Error())
+		return e.body()
+	}
+
+	message := checker.Message{
+		Service:     service,
+		Topic:       body.topic,
+		Payload:     string(body.payload),
+		PayloadType: body.payloadType,
+		Encoding:    body.encoding,
+	}
+	isDup, err := c.IsDuplicateContext(ctx, message)
+	if e, ok := err.(*payload.Error); ok {
+		logger.Errorf("validate failed: %s", e.Error())
+		return gin.H{"result": "failure", "error": e.Error()}
+	}
+	if isDup || err != nil {
+		logger.Infof("duplicate payload = %s", utils.Payload(message.Payload))
+		return body.jsonResult("duplicate")
+	}
+	logger.Infof("new payload = %s", utils.Payload(message.Payload))
+	return body.jsonResult("success")
+}
@@ -0,0 +1,155 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+func setUpStream(t *testing.T, config *conf.Config) (string, *mock.MockKeysAPI, func()) {
+	t.Helper()
+	gin.SetMode(gin.ReleaseMode)
+	ctrl := gomock.NewController(t)
+	kapi := mock.NewMockKeysAPI(ctrl)
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+	checker.GetMutexID = func(_ string) string {
+		return "mutexID"
+	}
+
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(t, err)
+	ts := httptest.NewServer(fullDuplex(handler.Engine))
+	return ts.URL + streamPath, kapi, func() {
+		ts.Close()
+		ctrl.Finish()
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	assert := assert.New(t)
+	reader := bufio.NewReaderSize(strings.NewReader("a\r\n\n"+strings.Repeat("b", 40)+"\n"+strings.Repeat("c", 20)+"\nd"), 16)
+
+	expected := []struct {
+		line    string
+		tooLong bool
+	}{
+		{line: "a"},
+		{line: ""},
+		{tooLong: true},
+		{line: strings.Repeat("c", 20)},
+		{line: "d"},
+	}
+	for _, e := range expected {
+		line, tooLong, err := readLine(reader, 32)
+		assert.NoError(err)
+		assert.Equal(e.line, string(line))
+		assert.Equal(e.tooLong, tooLong)
+	}
+	_, _, err := readLine(reader, 32)
+	assert.Equal(io.EOF, err)
+}
+
+func TestDistinctStream(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	config.MaxBodySize = 64
+	url, kapi, tearDown := setUpStream(t, config)
+	defer tearDown()
+
+	expectCheck(kapi, config, dedupKey("", "", "a"), false)
+	expectCheck(kapi, config, dedupKey("", "", "b"), true)
+	expectCheck(kapi, config, dedupKey("", "", "\x00\xff"), false)
+	body := strings.Join([]string{
+		`{"payload": "a"}`,
+		``,
+		`{"payload": "` + strings.Repeat("x", 64) + `"}`,
+		`payload=a`,
+		`{"payload": " "}`,
+		`{"payload": "b"}`,
+		`{"payloadBase64": "AP8="}`,
+		`{"payload": "|a", "payloadType": "ul"}`,
+	}, "\n")
+	r, err := http.Post(url, "application/x-ndjson", strings.NewReader(body))
+	assert.NoError(err)
+	defer r.Body.Close()
+	// the whole body is larger than MAX_BODY_SIZE, but each line is not
+	assert.Equal(http.StatusOK, r.StatusCode)
+	assert.Equal("application/x-ndjson", r.Header.Get("Content-Type"))
+
+	// the blank line has no verdict, and the others are in the same order as the lines
+	expected := []string{
+		`{"result":"success","payload":"a"}`,
+		`{"result":"failure","error":"line too large","code":"bodyTooLarge","limit":64}`,
+		`{"result":"failure","error":"invalid character 'p' looking for beginning of value"}`,
+		`{"result":"failure","error":"payload is empty","code":"emptyPayload"}`,
+		`{"result":"duplicate","payload":"b"}`,
+		`{"result":"success","payloadBase64":"AP8="}`,
+		`{"result":"failure","error":"invalid ul payload: empty measure name"}`,
+	}
+	scanner := bufio.NewScanner(r.Body)
+	for _, e := range expected {
+		if assert.True(scanner.Scan(), e) {
+			assert.JSONEq(e, scanner.Text())
+		}
+	}
+	assert.False(scanner.Scan())
+}
+
+func TestDistinctStreamFlush(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	url, kapi, tearDown := setUpStream(t, config)
+	defer tearDown()
+
+	// the next line is written after the verdict of the previous line is read over the same request
+	reader, writer := io.Pipe()
+	r, err := http.Post(url, "application/x-ndjson; charset=utf-8", reader)
+	assert.NoError(err)
+	defer r.Body.Close()
+	assert.Equal(http.StatusOK, r.StatusCode)
+	scanner := bufio.NewScanner(r.Body)
+	for _, payload := range []string{"a", "b", "c"} {
+		expectCheck(kapi, config, dedupKey("", "", payload), false)
+		_, err := writer.Write([]byte(`{"payload": "` + payload + `"}` + "\n"))
+		assert.NoError(err)
+		if assert.True(scanner.Scan(), payload) {
+			assert.JSONEq(`{"result":"success","payload":"`+payload+`"}`, scanner.Text())
+		}
+	}
+	writer.Close()
+	assert.False(scanner.Scan())
+}
+
+func TestDistinctStreamBadRequest(t *testing.T) {
+	assert := assert.New(t)
+	url, _, tearDown := setUpStream(t, conf.NewConfig())
+	defer tearDown()
+
+	for _, cType := range []string{"", "text/plain", "application/x-ndjson; charset"} {
+		r, err := http.Post(url, cType, bytes.NewBufferString(`{"payload": "a"}`))
+		assert.NoError(err)
+		assert.Equal(http.StatusBadRequest, r.StatusCode, cType)
+		r.Body.Close()
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+// tlsCheckInterval : the minimum interval to check whether the certificate files are changed
+var tlsCheckInterval = time.Second
+
+// certReloader : the TLS settings which are reloaded when the certificate, the key or the client CA file is changed.
+// The files are checked on the handshakes at most once per tlsCheckInterval.
+// When the changed files are invalid, the current settings are kept.
+type certReloader struct {
+	certFile   string
+	keyFile    string
+	caFile     string
+	clientAuth tls.ClientAuthType
+	nextProtos []string
+
+	mutex     sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+	logger    *utils.Logger
+}
+
+// newCertReloader loads the files, and nextProtos are the ALPN protocols of the handshakes (gRPC requires "h2").
+func newCertReloader(config *conf.Config, nextProtos ...string) (*certReloader, error) {
+	r := &certReloader{
+		certFile:   config.TLSCertFile,
+		keyFile:    config.TLSKeyFile,
+		caFile:     config.TLSClientCAFile,
+		clientAuth: tls.NoClientCert,
+		nextProtos: nextProtos,
+		logger:     utils.NewLogger("tls"),
+	}
+	if len(r.caFile) != 0 {
+		r.clientAuth = tls.RequireAndVerifyClientCert
+		if config.TLSClientAuth == conf.TLSClientAuthOptional {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+// tlsConfig is the tls.Config of the listener, which delegates every handshake to the current settings.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checkedAt) >= tlsCheckInterval {
+		r.checkedAt = time.Now()
+		if r.changed() {
+			if err := r.load(); err != nil {
+				r.logger.Errorf("reload rejected: %s", err.Error())
+			} else {
+				r.logger.Infof("certificates reloaded")
+			}
+		}
+	}
+	return r.config, nil
+}
+
+// load reads the files and replaces the current settings, which must be called with the mutex locked.
+func (r *certReloader) load() error {
+	// the modification times are updated even if the files are invalid, so that they are not read on every handshake
+	r.modTimes = r.stat()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		NextProtos:   r.nextProtos,
+	}
+	if len(r.caFile) != 0 {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate in " + r.caFile)
+		}
+		config.ClientCAs = pool
+	}
+	r.config = config
+	return nil
+}
+
+func (r *certReloader) changed() bool {
+	modTimes := r.stat()
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) stat() []time.Time {
+	modTimes := []time.Time{}
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		var t time.Time
+		if len(path) != 0 {
+			if info, err := os.Stat(path); err == nil {
+				t = info.ModTime()
+			}
+		}
+		modTimes = append(modTimes, t)
+	}
+	return modTimes
+}
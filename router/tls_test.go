@@ -0,0 +1,228 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{
+		cert: cert,
+		key:  key,
+		pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	t.Helper()
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	if len(keyFile) != 0 {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func setUpTLS(t *testing.T) (*conf.Config, *testCert, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+
+	ca := newTestCert(t, "ca", 1, nil)
+	newTestCert(t, "server", 2, ca).write(t, filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	ca.write(t, filepath.Join(dir, "ca.crt"), "")
+
+	config := conf.NewConfig()
+	config.TLSCertFile = filepath.Join(dir, "server.crt")
+	config.TLSKeyFile = filepath.Join(dir, "server.key")
+	return config, ca, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func newTLSClient(ca *testCert, cert *testCert) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{cert.pair}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		Timeout:   time.Second * 5,
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	assert := assert.New(t)
+	config, ca, tearDown := setUpTLS(t)
+	defer tearDown()
+	original := tlsCheckInterval
+	tlsCheckInterval = 0
+	defer func() { tlsCheckInterval = original }()
+
+	r, err := newCertReloader(config)
+	assert.NoError(err)
+	assert.Equal(tls.NoClientCert, r.clientAuth)
+	c, err := r.getConfigForClient(nil)
+	assert.NoError(err)
+	assert.Len(c.Certificates, 1)
+	assert.Nil(c.ClientCAs)
+
+	// the changed certificate is reloaded
+	newTestCert(t, "renewed", 3, ca).write(t, config.TLSCertFile, config.TLSKeyFile)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(config.TLSCertFile, future, future))
+	c, err = r.getConfigForClient(nil)
+	assert.NoError(err)
+	leaf, err := x509.ParseCertificate(c.Certificates[0].Certificate[0])
+	assert.NoError(err)
+	assert.Equal("renewed", leaf.Subject.CommonName)
+
+	// the invalid certificate is not reloaded
+	assert.NoError(ioutil.WriteFile(config.TLSCertFile, []byte("invalid"), 0600))
+	future = future.Add(time.Minute)
+	assert.NoError(os.Chtimes(config.TLSCertFile, future, future))
+	c2, err := r.getConfigForClient(nil)
+	assert.NoError(err)
+	assert.Equal(c, c2)
+
+	config.TLSClientCAFile = config.TLSCertFile
+	_, err = newCertReloader(config)
+	assert.Error(err)
+}
+
+func TestCertReloaderClientAuth(t *testing.T) {
+	assert := assert.New(t)
+	config, _, tearDown := setUpTLS(t)
+	defer tearDown()
+
+	config.TLSClientCAFile = filepath.Join(filepath.Dir(config.TLSCertFile), "ca.crt")
+	r, err := newCertReloader(config)
+	assert.NoError(err)
+	assert.Equal(tls.RequireAndVerifyClientCert, r.clientAuth)
+	assert.NotNil(r.config.ClientCAs)
+
+	config.TLSClientAuth = conf.TLSClientAuthOptional
+	r, err = newCertReloader(config)
+	assert.NoError(err)
+	assert.Equal(tls.VerifyClientCertIfGiven, r.clientAuth)
+
+	// the key file is not a CA bundle
+	config.TLSClientCAFile = config.TLSKeyFile
+	_, err = newCertReloader(config)
+	assert.Error(err)
+}
+
+func TestRunTLS(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDownHealth := setUpHealth(t)
+	defer tearDownHealth()
+	config, ca, tearDown := setUpTLS(t)
+	defer tearDown()
+
+	config.TLSClientCAFile = filepath.Join(filepath.Dir(config.TLSCertFile), "ca.crt")
+	handler.holder.Set(config)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	address := l.Addr().String()
+	l.Close()
+	finished := make(chan error)
+	go func() {
+		finished <- handler.Run(address)
+	}()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the client certificate is required
+	_, err = newTLSClient(ca, nil).Get("https://" + address + "/healthz")
+	assert.Error(err)
+	r, err := newTLSClient(ca, newTestCert(t, "client", 4, ca)).Get("https://" + address + "/healthz")
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	r.Body.Close()
+
+	// the client certificate must be signed by the CA
+	_, err = newTLSClient(ca, newTestCert(t, "self-signed", 5, nil)).Get("https://" + address + "/healthz")
+	assert.Error(err)
+
+	// plain HTTP is not served
+	r, err = http.Get("http://" + address + "/healthz")
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, r.StatusCode)
+	r.Body.Close()
+
+	assert.NoError(handler.Shutdown(context.Background()))
+	assert.NoError(<-finished)
+}
+
+func TestRunTLSInvalidCert(t *testing.T) {
+	assert := assert.New(t)
+	_, handler, tearDownHealth := setUpHealth(t)
+	defer tearDownHealth()
+
+	config := conf.NewConfig()
+	config.TLSCertFile = "/nonexistent/server.crt"
+	config.TLSKeyFile = "/nonexistent/server.key"
+	handler.holder.Set(config)
+	assert.Error(handler.Run("127.0.0.1:0"))
+}
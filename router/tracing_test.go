@@ -0,0 +1,71 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/tracing"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+func TestTraceRequest(t *testing.T) {
+	assert := assert.New(t)
+	_, err := tracing.Start(conf.NewConfig())
+	assert.NoError(err)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	config := conf.NewConfig()
+	config.TrustedProxies = []string{"192.0.2.1"}
+	kapi, _, _, _, tearDown := setUpOrion(t, http.StatusCreated, config)
+	defer tearDown()
+	expectCheck(kapi, config, dedupKey("", "", "a"), false)
+
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(`{"payload": "a"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("X-Forwarded-For", "203.0.113.5")
+	handler.Engine.ServeHTTP(w, r)
+	assert.Equal(http.StatusOK, w.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", s.SpanContext().TraceID().String(), s.Name())
+	}
+	for _, name := range []string{"HTTP POST /distinct/", "IsDuplicate", "mutex.Lock", "mutex.lock", "etcd.set", "etcd.get", "etcd.delete"} {
+		assert.Contains(spans, name)
+	}
+	assert.Equal("00f067aa0ba902b7", spans["HTTP POST /distinct/"].Parent().SpanID().String())
+	// the client behind the trusted proxy is recorded like the rate limits
+	assert.Contains(spans["HTTP POST /distinct/"].Attributes(), attribute.String("client.address", "203.0.113.5"))
+	assert.Equal(spans["HTTP POST /distinct/"].SpanContext().SpanID(), spans["IsDuplicate"].Parent().SpanID())
+	assert.Equal(spans["IsDuplicate"].SpanContext().SpanID(), spans["mutex.Lock"].Parent().SpanID())
+	assert.Equal(spans["mutex.Lock"].SpanContext().SpanID(), spans["mutex.lock"].Parent().SpanID())
+	assert.Equal(spans["IsDuplicate"].SpanContext().SpanID(), spans["etcd.get"].Parent().SpanID())
+
+	// the keys containing the payload are recorded as their hashes
+	key := dedupKey("", "", "a")
+	assert.Contains(spans["mutex.Lock"].Attributes(), attribute.String("lock.key_hash", utils.HashKey("/lock/"+key)))
+	assert.Contains(spans["etcd.get"].Attributes(), attribute.String("etcd.key_hash", utils.HashKey("/data/"+key)))
+}
@@ -0,0 +1,178 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	codeBodyTooLarge    = "bodyTooLarge"
+	codePayloadTooLarge = "payloadTooLarge"
+	codeEmptyPayload    = "emptyPayload"
+	codeInvalidEncoding = "invalidEncoding"
+	codeInvalidBody     = "invalidBody"
+)
+
+// requestError : the structured error of the invalid request
+type requestError struct {
+	status  int
+	code    string
+	message string
+	limit   int
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// body is the JSON response of the error, which is also a line of /distinct/stream.
+func (e *requestError) body() gin.H {
+	h := gin.H{
+		"result": "failure",
+		"error":  e.message,
+	}
+	if len(e.code) != 0 {
+		h["code"] = e.code
+	}
+	if e.limit != 0 {
+		h["limit"] = e.limit
+	}
+	return h
+}
+
+// abort responds the error and stops the handlers after the current one.
+func (e *requestError) abort(context *gin.Context) {
+	context.AbortWithStatusJSON(e.status, e.body())
+}
+
+// limitBody rejects the requests whose body is larger than MAX_BODY_SIZE by 413.
+// The body is read here, so the handlers never read more than MAX_BODY_SIZE bytes.
+func limitBody(holder *conf.Holder) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		maxSize := holder.Get().MaxBodySize
+		// the lines of the stream are limited by distinctStream instead
+		path := context.Request.URL.Path
+		if maxSize == 0 || context.Request.Body == nil || internalPaths[path] || path == streamPath {
+			context.Next()
+			return
+		}
+		logger := utils.NewLogger("limitBody").WithContext(context.Request.Context())
+		tooLarge := bodyTooLarge(maxSize)
+		if context.Request.ContentLength > int64(maxSize) {
+			logger.Warnf("body too large: Content-Length=%d", context.Request.ContentLength)
+			tooLarge.abort(context)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(context.Request.Body, int64(maxSize)+1))
+		context.Request.Body.Close()
+		if err != nil {
+			logger.Errorf("read body failed: %s", err.Error())
+			(&requestError{status: http.StatusBadRequest, code: codeInvalidBody, message: err.Error()}).abort(context)
+			return
+		}
+		if len(body) > maxSize {
+			logger.Warnf("body too large: over %d bytes", maxSize)
+			tooLarge.abort(context)
+			return
+		}
+		context.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		context.Next()
+	}
+}
+
+// bodyTooLarge is the error of the body larger than maxSize bytes.
+func bodyTooLarge(maxSize int) *requestError {
+	return &requestError{
+		status:  http.StatusRequestEntityTooLarge,
+		code:    codeBodyTooLarge,
+		message: "request body too large",
+		limit:   maxSize,
+	}
+}
+
+// validatePayload rejects the payload longer than MAX_PAYLOAD_LENGTH, the empty or whitespace-only payload,
+// and the payload of invalid UTF-8 when VALIDATE_UTF8 is true.
+// The binary payload is rejected only when it is empty, because it is not a text.
+func validatePayload(config *conf.Config, payload []byte, binary bool) *requestError {
+	if config.MaxPayloadLength != 0 && len(payload) > config.MaxPayloadLength {
+		return &requestError{
+			status:  http.StatusRequestEntityTooLarge,
+			code:    codePayloadTooLarge,
+			message: "payload too large",
+			limit:   config.MaxPayloadLength,
+		}
+	}
+	if len(payload) == 0 || (!binary && len(bytes.TrimSpace(payload)) == 0) {
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    codeEmptyPayload,
+			message: "payload is empty",
+		}
+	}
+	if !binary && config.ValidateUTF8 && !utf8.Valid(payload) {
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    codeInvalidEncoding,
+			message: "payload is not valid UTF-8",
+		}
+	}
+	return nil
+}
+
+// validate validates the payload of the envelope.
+// The payload encoded in base64 is decoded first, and validated as binary.
+func (e *envelope) validate(config *conf.Config) *requestError {
+	if e.encoding != checker.EncodingBase64 {
+		return validatePayload(config, e.payload, e.binary)
+	}
+	raw, err := base64.StdEncoding.DecodeString(string(e.payload))
+	if err != nil {
+		// the same error as Checker responds
+		return &requestError{
+			status:  http.StatusBadRequest,
+			message: (&payload.Error{PayloadType: checker.EncodingBase64, Reason: err.Error()}).Error(),
+		}
+	}
+	return validatePayload(config, raw, true)
+}
+
+// validateBodyEncoding rejects the body of invalid UTF-8 when VALIDATE_UTF8 is true,
+// because the JSON decoder replaces the invalid bytes of the payload silently.
+func validateBodyEncoding(config *conf.Config, r *http.Request) *requestError {
+	if !config.ValidateUTF8 {
+		return nil
+	}
+	body, err := readBody(r, config.MaxBodySize)
+	if e, ok := err.(*requestError); ok {
+		return e
+	}
+	if err != nil {
+		return &requestError{status: http.StatusBadRequest, code: codeInvalidBody, message: err.Error()}
+	}
+	if !utf8.Valid(body) {
+		return &requestError{
+			status:  http.StatusBadRequest,
+			code:    codeInvalidEncoding,
+			message: "request body is not valid UTF-8",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+func TestLimitBody(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	config := conf.NewConfig()
+	config.MaxBodySize = 16
+
+	engine := gin.New()
+	engine.Use(limitBody(conf.NewHolder(config)))
+	handle := func(context *gin.Context) {
+		body, _ := ioutil.ReadAll(context.Request.Body)
+		context.String(http.StatusOK, "%s", body)
+	}
+	engine.POST("/distinct/", handle)
+	engine.POST("/metrics", handle)
+
+	post := func(path string, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		if chunked {
+			// the length of the chunked body is unknown until it is read
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/distinct/", strings.Repeat("a", 16), false)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(strings.Repeat("a", 16), w.Body.String())
+	w = post("/distinct/", strings.Repeat("a", 16), true)
+	assert.Equal(http.StatusOK, w.Code)
+
+	w = post("/distinct/", strings.Repeat("a", 17), false)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	assert.JSONEq(`{"result":"failure","error":"request body too large","code":"bodyTooLarge","limit":16}`, w.Body.String())
+	w = post("/distinct/", strings.Repeat("a", 17), true)
+	assert.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	// the requests for monitoring are not limited
+	assert.Equal(http.StatusOK, post("/metrics", strings.Repeat("a", 17), false).Code)
+
+	// 0 means unlimited
+	config.MaxBodySize = 0
+	assert.Equal(http.StatusOK, post("/distinct/", strings.Repeat("a", 17), false).Code)
+}
+
+func TestValidatePayload(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	config.MaxPayloadLength = 8
+
+	assert.Nil(validatePayload(config, []byte("a"), false))
+	assert.Nil(validatePayload(config, []byte(" a \n"), false))
+	assert.Nil(validatePayload(config, []byte("\xff\xfe"), false))
+
+	testCases := []struct {
+		payload string
+		status  int
+		code    string
+	}{
+		{payload: "", status: http.StatusBadRequest, code: codeEmptyPayload},
+		{payload: " \t\r\n", status: http.StatusBadRequest, code: codeEmptyPayload},
+		{payload: "123456789", status: http.StatusRequestEntityTooLarge, code: codePayloadTooLarge},
+	}
+	for _, testCase := range testCases {
+		e := validatePayload(config, []byte(testCase.payload), false)
+		if assert.NotNil(e, testCase.payload) {
+			assert.Equal(testCase.status, e.status, testCase.payload)
+			assert.Equal(testCase.code, e.code, testCase.payload)
+		}
+	}
+
+	config.ValidateUTF8 = true
+	e := validatePayload(config, []byte("\xff\xfe"), false)
+	if assert.NotNil(e) {
+		assert.Equal(codeInvalidEncoding, e.code)
+	}
+	assert.Nil(validatePayload(config, []byte("温度"), false))
+
+	config.MaxPayloadLength = 0
+	assert.Nil(validatePayload(config, []byte(strings.Repeat("a", 65537)), false))
+}
+
+func TestEnvelopeValidate(t *testing.T) {
+	assert := assert.New(t)
+	config := conf.NewConfig()
+	config.MaxPayloadLength = 2
+	config.ValidateUTF8 = true
+
+	// the payload encoded in base64 is validated after decoded, as binary
+	assert.Nil((&envelope{payload: []byte("AP8="), encoding: checker.EncodingBase64}).validate(config))
+	assert.Nil((&envelope{payload: []byte("ICA="), encoding: checker.EncodingBase64}).validate(config))
+	testCases := []struct {
+		payload string
+		status  int
+		code    string
+	}{
+		{payload: "AP8A", status: http.StatusRequestEntityTooLarge, code: codePayloadTooLarge},
+		{payload: "", status: http.StatusBadRequest, code: codeEmptyPayload},
+		{payload: "AP8", status: http.StatusBadRequest},
+	}
+	for _, testCase := range testCases {
+		e := (&envelope{payload: []byte(testCase.payload), encoding: checker.EncodingBase64}).validate(config)
+		if assert.NotNil(e, testCase.payload) {
+			assert.Equal(testCase.status, e.status, testCase.payload)
+			assert.Equal(testCase.code, e.code, testCase.payload)
+		}
+	}
+
+	// the other payloads are validated as they are
+	e := (&envelope{payload: []byte("abc")}).validate(config)
+	if assert.NotNil(e) {
+		assert.Equal(codePayloadTooLarge, e.code)
+	}
+}
+
+func TestDistinctValidation(t *testing.T) {
+	assert := assert.New(t)
+	_, _, tearDown := setUpHealth(t)
+	defer tearDown()
+	config := conf.NewConfig()
+	config.MaxPayloadLength = 4
+	config.ValidateUTF8 = true
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+
+	testCases := []struct {
+		body     string
+		status   int
+		expected string
+	}{
+		{body: `{"payload": "  "}`, status: http.StatusBadRequest, expected: `{"result":"failure","error":"payload is empty","code":"emptyPayload"}`},
+		{body: `{"topic": "/ul/key/dev1/attrs"}`, status: http.StatusBadRequest, expected: `{"result":"failure","error":"payload is empty","code":"emptyPayload"}`},
+		{body: `{"payload": "12345"}`, status: http.StatusRequestEntityTooLarge, expected: `{"result":"failure","error":"payload too large","code":"payloadTooLarge","limit":4}`},
+		{body: `{"payloadBase64": "AP8AAP8="}`, status: http.StatusRequestEntityTooLarge, expected: `{"result":"failure","error":"payload too large","code":"payloadTooLarge","limit":4}`},
+		{body: "{\"payload\": \"\xff\"}", status: http.StatusBadRequest, expected: `{"result":"failure","error":"request body is not valid UTF-8","code":"invalidEncoding"}`},
+	}
+	for _, testCase := range testCases {
+		r := httptest.NewRequest("POST", "/distinct/", bytes.NewBufferString(testCase.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.Engine.ServeHTTP(w, r)
+		assert.Equal(testCase.status, w.Code, testCase.body)
+		assert.JSONEq(testCase.expected, w.Body.String(), testCase.body)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/base64"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/payload"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/utils"
+)
+
+const (
+	hookResultOK        = "ok"
+	hookErrorDuplicate  = "duplicate"
+	hookErrorBadRequest = "bad_request"
+)
+
+// hookBodyType : the body of auth_on_publish webhook called by MQTT Broker (e.g. VerneMQ).
+type hookBodyType struct {
+	Username   string `json:"username"`
+	ClientID   string `json:"client_id"`
+	Mountpoint string `json:"mountpoint"`
+	Topic      string `json:"topic" binding:"required"`
+	Payload    string `json:"payload"`
+	QoS        int    `json:"qos"`
+	Retain     bool   `json:"retain"`
+}
+
+// authOnPublish allows MQTT Broker to publish the message only when the message is not duplicated.
+// The rejected message is dropped by MQTT Broker.
+func authOnPublish(context *gin.Context, c *checker.Checker) {
+	logger := utils.NewLogger("authOnPublish").WithContext(context.Request.Context())
+	var body hookBodyType
+
+	if err := context.ShouldBindWith(&body, binding.JSON); err != nil {
+		logger.Errorf("validate failed: %s", err.Error())
+		context.JSON(http.StatusBadRequest, gin.H{
+			"result": gin.H{"error": hookErrorBadRequest},
+		})
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body.Payload)
+	if err != nil {
+		logger.Errorf("decode payload failed: %s", err.Error())
+		context.JSON(http.StatusBadRequest, gin.H{
+			"result": gin.H{"error": hookErrorBadRequest},
+		})
+		return
+	}
+
+	message := checker.Message{
+		Topic:   body.Topic,
+		Payload: string(decoded),
+		Service: context.GetHeader(fiwareService),
+	}
+	isDup, err := c.IsDuplicateContext(context.Request.Context(), message)
+	context.Set(verdictKey, checker.Verdict(isDup, err))
+	if e, ok := err.(*payload.Error); ok {
+		logger.Errorf("validate failed: %s", e.Error())
+		context.JSON(http.StatusBadRequest, gin.H{
+			"result": gin.H{"error": hookErrorBadRequest},
+		})
+		return
+	}
+	if isDup || err != nil {
+		logger.Infof("duplicate payload = %s, client_id=%s, topic=%s", utils.Payload(message.Payload), body.ClientID, body.Topic)
+		context.JSON(http.StatusOK, gin.H{
+			"result": gin.H{"error": hookErrorDuplicate},
+		})
+	} else {
+		logger.Infof("new payload = %s, client_id=%s, topic=%s", utils.Payload(message.Payload), body.ClientID, body.Topic)
+		context.JSON(http.StatusOK, gin.H{
+			"result": hookResultOK,
+		})
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Package router : routing http request and check message duplication using Checker.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coreos/etcd/client"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/checker"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
+)
+
+func TestAuthOnPublishOK(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	// "dDF8MjUuMw==" is base64 encoded "t1|25.3"
+	body := `{"username":"user","client_id":"dev1","mountpoint":"","qos":1,"topic":"/ul/key/dev1/attrs","payload":"dDF8MjUuMw==","retain":false}`
+	r, err := doRequest("POST", "/webhook/auth_on_publish", "application/json", dedupKey("", "/ul/key/dev1/attrs", "t1|25.3"), body, false)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":"ok"}`, string(b))
+}
+
+func TestAuthOnPublishDuplicate(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	body := `{"username":"user","client_id":"dev1","mountpoint":"","qos":1,"topic":"/ul/key/dev1/attrs","payload":"dDF8MjUuMw==","retain":false}`
+	r, err := doRequest("POST", "/webhook/auth_on_publish", "application/json", dedupKey("", "/ul/key/dev1/attrs", "t1|25.3"), body, true)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, r.StatusCode)
+	b, _ := ioutil.ReadAll(r.Body)
+	assert.JSONEq(`{"result":{"error":"duplicate"}}`, string(b))
+}
+
+func TestAuthOnPublishBadRequest(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	for _, body := range []string{
+		"",
+		"payload=a",
+		`{"client_id":"dev1","payload":"YQ=="}`,
+		`{"client_id":"dev1","topic":"/ul/key/dev1/attrs","payload":"not base64"}`,
+	} {
+		r, err := doRequest("POST", "/webhook/auth_on_publish", "application/json", dedupKey("", "", "a"), body, false)
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, r.StatusCode)
+		b, _ := ioutil.ReadAll(r.Body)
+		assert.JSONEq(`{"result":{"error":"bad_request"}}`, string(b))
+	}
+}
+
+func TestAuthOnPublishScopedPrincipal(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	_, _, tearDownHealth := setUpHealth(t)
+	defer tearDownHealth()
+	config, _, tearDown := setUpAuth(t)
+	defer tearDown()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	kapi := mock.NewMockKeysAPI(ctrl)
+	checker.GetNewKeysAPI = func(c client.Client) client.KeysAPI {
+		return kapi
+	}
+	checker.GetMutexID = func(_ string) string {
+		return "mutexID"
+	}
+	handler, err := NewHandler(conf.NewHolder(config))
+	assert.NoError(err)
+
+	body := `{"username":"user","client_id":"dev1","mountpoint":"","qos":1,"topic":"/ul/key/dev1/attrs","payload":"dDF8MjUuMw==","retain":false}`
+	doRequest := func(service string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/webhook/auth_on_publish", bytes.NewBufferString(body))
+		r.Header.Set("content-type", "application/json")
+		r.Header.Set(xAPIKey, "bridge-key")
+		r.Header.Set(fiwareService, service)
+		w := httptest.NewRecorder()
+		handler.Engine.ServeHTTP(w, r)
+		return w
+	}
+
+	// the message is checked under the Fiware-Service of the principal
+	expectCheck(kapi, config, dedupKey("tenant1", "/ul/key/dev1/attrs", "t1|25.3"), false)
+	w := doRequest("tenant1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"result":"ok"}`, w.Body.String())
+
+	// the principal is not allowed to publish to the other Fiware-Service
+	w = doRequest("tenant2")
+	assert.Equal(http.StatusForbidden, w.Code)
+}
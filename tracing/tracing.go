@@ -0,0 +1,90 @@
+/*
+Package tracing : trace the duplication check by OpenTelemetry.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package tracing
+
+import (
+	"context"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+const (
+	tracerName = "github.com/tech-sketch/fiware-mqtt-msgfilter"
+)
+
+/*
+Tracer : the tracer of this service.
+	The spans are not exported until Start is called with TRACING_EXPORTER.
+*/
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+/*
+Start : set up the exporter of TRACING_EXPORTER and W3C trace context propagation.
+	The returned function flushes the remaining spans and stops the exporter.
+*/
+func Start(config *conf.Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter(config)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", config.TracingServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter(config *conf.Config) (sdktrace.SpanExporter, error) {
+	switch config.TracingExporter {
+	case conf.TracingStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case conf.TracingOTLP:
+		// without TRACING_ENDPOINT, the exporter follows OTEL_EXPORTER_OTLP_* environment variables
+		opts := []otlptracehttp.Option{}
+		if len(config.TracingEndpoint) != 0 {
+			u, err := url.Parse(config.TracingEndpoint)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithEndpoint(u.Host))
+			if u.Scheme == "http" {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			if len(u.Path) != 0 {
+				opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+			}
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	}
+	return nil, nil
+}
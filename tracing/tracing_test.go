@@ -0,0 +1,43 @@
+/*
+Package tracing : trace the duplication check by OpenTelemetry.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+
+	"github.com/tech-sketch/fiware-mqtt-msgfilter/conf"
+)
+
+func TestStart(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		exporter string
+		endpoint string
+	}{
+		{exporter: ""},
+		{exporter: conf.TracingStdout},
+		{exporter: conf.TracingOTLP},
+		{exporter: conf.TracingOTLP, endpoint: "http://127.0.0.1:4318/custom/v1/traces"},
+	}
+	for _, testCase := range testCases {
+		config := conf.NewConfig()
+		config.TracingExporter = testCase.exporter
+		config.TracingEndpoint = testCase.endpoint
+
+		shutdown, err := Start(config)
+		assert.NoError(err, testCase.exporter)
+		assert.NotNil(shutdown, testCase.exporter)
+		assert.Contains(otel.GetTextMapPropagator().Fields(), "traceparent")
+		assert.NotNil(Tracer())
+		assert.NoError(shutdown(context.Background()), testCase.exporter)
+	}
+}
@@ -7,16 +7,105 @@ Package utils : utilities.
 package utils
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
+const (
+	// LogFormatText : "[APP] 2018/12/31 - 18:00:17 |info | [name] message key=value"
+	LogFormatText = "text"
+	// LogFormatJSON : {"time":"2018-12-31T18:00:17Z","level":"info","logger":"name","msg":"message","key":"value"}
+	LogFormatJSON = "json"
+
+	// LogLevelDebug : output all logs
+	LogLevelDebug = "debug"
+	// LogLevelInfo : output info, warn and error logs
+	LogLevelInfo = "info"
+	// LogLevelWarn : output warn and error logs
+	LogLevelWarn = "warn"
+	// LogLevelError : output error logs only
+	LogLevelError = "error"
+
+	// PayloadFull : payloads are logged as they are
+	PayloadFull = "full"
+	// PayloadTruncate : payloads are logged up to PayloadMaxLength bytes
+	PayloadTruncate = "truncate"
+	// PayloadRedact : payloads are replaced by their length and hash
+	PayloadRedact = "redact"
+
+	// FieldRequestID : the field of the request id
+	FieldRequestID = "request_id"
+	// FieldTenant : the field of Fiware-Service
+	FieldTenant = "tenant"
+	// FieldKeyHash : the field of the hash of the duplication key, which never leaks the payload
+	FieldKeyHash = "key_hash"
+	// FieldPrincipal : the field of the authenticated client
+	FieldPrincipal = "principal"
+)
+
+var levels = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+/*
+LogOptions : options shared by all Loggers
+	Format           : LogFormatText or LogFormatJSON
+	Level            : the minimum level to output
+	Payload          : how to log the payloads (PayloadFull, PayloadTruncate or PayloadRedact)
+	PayloadMaxLength : max bytes of the truncated payloads
+*/
+type LogOptions struct {
+	Format           string
+	Level            string
+	Payload          string
+	PayloadMaxLength int
+}
+
+var logOptions atomic.Value
+
+func init() {
+	SetLogOptions(LogOptions{
+		Format:           LogFormatText,
+		Level:            LogLevelDebug,
+		Payload:          PayloadRedact,
+		PayloadMaxLength: 32,
+	})
+}
+
+/*
+SetLogOptions : replace the options of all Loggers.
+*/
+func SetLogOptions(opts LogOptions) {
+	logOptions.Store(opts)
+}
+
+func getLogOptions() LogOptions {
+	return logOptions.Load().(LogOptions)
+}
+
 type iWriter interface {
 	Printf(format string, v ...interface{})
 }
 
+type field struct {
+	key   string
+	value string
+}
+
 /*
 Logger : simple Logger
 */
@@ -24,6 +113,7 @@ type Logger struct {
 	Name   string
 	writer iWriter
 	now    func() time.Time
+	fields []field
 }
 
 /*
@@ -37,6 +127,27 @@ func NewLogger(name string) *Logger {
 	}
 }
 
+/*
+With : create a Logger which outputs the argument field with every log.
+*/
+func (l *Logger) With(key string, value string) *Logger {
+	child := *l
+	child.fields = append(append([]field{}, l.fields...), field{key: key, value: value})
+	return &child
+}
+
+/*
+WithContext : create a Logger which outputs the fields attached to the argument context by ContextWithField.
+*/
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	child := l
+	fields, _ := ctx.Value(fieldsKey{}).([]field)
+	for _, f := range fields {
+		child = child.With(f.key, f.value)
+	}
+	return child
+}
+
 /*
 Debugf : output debug log
 */
@@ -66,6 +177,113 @@ func (l *Logger) Errorf(msg string, args ...interface{}) {
 }
 
 func (l *Logger) logf(level string, msg string, args ...interface{}) {
+	opts := getLogOptions()
+	if levels[strings.TrimSpace(level)] < levels[opts.Level] {
+		return
+	}
+	if opts.Format == LogFormatJSON {
+		l.writer.Printf("%s", l.encodeJSON(strings.TrimSpace(level), fmt.Sprintf(msg, args...)))
+		return
+	}
 	baseMsg := fmt.Sprintf("[APP] %s |%s| [%s] %s", l.now().Format("2006/01/02 - 15:04:05"), level, l.Name, msg)
+	for _, f := range l.fields {
+		// the fields must not be interpreted as the format
+		baseMsg += " " + f.key + "=" + strings.Replace(quoteIfNeeded(f.value), "%", "%%", -1)
+	}
 	l.writer.Printf(baseMsg, args...)
 }
+
+func (l *Logger) encodeJSON(level string, msg string) string {
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	writeJSONField(&buf, "time", l.now().Format(time.RFC3339Nano))
+	buf.WriteString(",")
+	writeJSONField(&buf, "level", level)
+	buf.WriteString(",")
+	writeJSONField(&buf, "logger", l.Name)
+	buf.WriteString(",")
+	writeJSONField(&buf, "msg", msg)
+	for _, f := range l.fields {
+		buf.WriteString(",")
+		writeJSONField(&buf, f.key, f.value)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value string) {
+	k, _ := json.Marshal(key)
+	v, _ := json.Marshal(value)
+	buf.Write(k)
+	buf.WriteString(":")
+	buf.Write(v)
+}
+
+func quoteIfNeeded(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+type fieldsKey struct{}
+
+/*
+ContextWithField : attach the field to the context, which is output by the Loggers created by WithContext.
+	The field already attached is replaced in place, so that each field is output only once.
+*/
+func ContextWithField(ctx context.Context, key string, value string) context.Context {
+	fields, _ := ctx.Value(fieldsKey{}).([]field)
+	fields = append([]field{}, fields...)
+	for i := range fields {
+		if fields[i].key == key {
+			fields[i].value = value
+			return context.WithValue(ctx, fieldsKey{}, fields)
+		}
+	}
+	fields = append(fields, field{key: key, value: value})
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+/*
+FieldFromContext : the value of the field attached to the context by ContextWithField, or "" if not attached.
+*/
+func FieldFromContext(ctx context.Context, key string) string {
+	fields, _ := ctx.Value(fieldsKey{}).([]field)
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].key == key {
+			return fields[i].value
+		}
+	}
+	return ""
+}
+
+/*
+HashKey : the short hash of the duplication key, which identifies the key in the logs without the payload.
+*/
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+/*
+Payload : the loggable form of the payload according to LogOptions.Payload.
+*/
+func Payload(payload string) string {
+	opts := getLogOptions()
+	switch opts.Payload {
+	case PayloadFull:
+		return payload
+	case PayloadTruncate:
+		if len(payload) <= opts.PayloadMaxLength {
+			return payload
+		}
+		// do not cut a multibyte character
+		end := opts.PayloadMaxLength
+		for end > 0 && !utf8.RuneStart(payload[end]) {
+			end--
+		}
+		return fmt.Sprintf("%s...(%d bytes)", payload[:end], len(payload))
+	}
+	return fmt.Sprintf("[REDACTED %d bytes sha256:%s]", len(payload), HashKey(payload))
+}
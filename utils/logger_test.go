@@ -7,10 +7,12 @@ Package utils : utilities.
 package utils
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
 
 	"github.com/tech-sketch/fiware-mqtt-msgfilter/mock"
 )
@@ -65,3 +67,95 @@ func TestLogger(t *testing.T) {
 	mockWriter.EXPECT().Printf("[APP] 2018/12/31 - 18:00:17 |error| [test] foo %s:%d", "HOGE", 1)
 	logger.Errorf("foo %s:%d", "HOGE", 1)
 }
+
+func setUpLogger(t *testing.T, opts LogOptions) (*mock.MockiWriter, *Logger, func()) {
+	t.Helper()
+	ctrl := gomock.NewController(t)
+	mockWriter := mock.NewMockiWriter(ctrl)
+	logger := &Logger{
+		Name:   "test",
+		writer: mockWriter,
+		now: func() time.Time {
+			return time.Date(2018, 12, 31, 18, 0, 17, 987, time.UTC)
+		},
+	}
+	original := getLogOptions()
+	SetLogOptions(opts)
+	tearDown := func() {
+		SetLogOptions(original)
+		ctrl.Finish()
+	}
+	return mockWriter, logger, tearDown
+}
+
+func TestLoggerLevel(t *testing.T) {
+	mockWriter, logger, tearDown := setUpLogger(t, LogOptions{Format: LogFormatText, Level: LogLevelWarn})
+	defer tearDown()
+
+	logger.Debugf("foo")
+	logger.Infof("foo")
+	mockWriter.EXPECT().Printf("[APP] 2018/12/31 - 18:00:17 |warn | [test] foo")
+	logger.Warnf("foo")
+	mockWriter.EXPECT().Printf("[APP] 2018/12/31 - 18:00:17 |error| [test] foo")
+	logger.Errorf("foo")
+}
+
+func TestLoggerFields(t *testing.T) {
+	mockWriter, logger, tearDown := setUpLogger(t, LogOptions{Format: LogFormatText, Level: LogLevelDebug})
+	defer tearDown()
+
+	ctx := ContextWithField(context.Background(), FieldRequestID, "req-1")
+	ctx = ContextWithField(ctx, FieldTenant, "")
+	child := logger.WithContext(ctx).With(FieldKeyHash, "100%")
+
+	mockWriter.EXPECT().Printf(`[APP] 2018/12/31 - 18:00:17 |info | [test] foo %s request_id=req-1 tenant="" key_hash=100%%`, "HOGE")
+	child.Infof("foo %s", "HOGE")
+
+	// the field attached again is output once with the new value
+	mockWriter.EXPECT().Printf(`[APP] 2018/12/31 - 18:00:17 |info | [test] foo request_id=req-1 tenant=t`)
+	logger.WithContext(ContextWithField(ctx, FieldTenant, "t")).Infof("foo")
+
+	// the parent logger is not changed
+	mockWriter.EXPECT().Printf("[APP] 2018/12/31 - 18:00:17 |info | [test] foo")
+	logger.Infof("foo")
+}
+
+func TestFieldFromContext(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("", FieldFromContext(context.Background(), FieldRequestID))
+	ctx := ContextWithField(context.Background(), FieldRequestID, "req-1")
+	ctx = ContextWithField(ctx, FieldTenant, "t")
+	assert.Equal("req-1", FieldFromContext(ctx, FieldRequestID))
+	assert.Equal("t", FieldFromContext(ctx, FieldTenant))
+	assert.Equal("", FieldFromContext(ctx, FieldKeyHash))
+	assert.Equal("u", FieldFromContext(ContextWithField(ctx, FieldTenant, "u"), FieldTenant))
+}
+
+func TestLoggerJSON(t *testing.T) {
+	mockWriter, logger, tearDown := setUpLogger(t, LogOptions{Format: LogFormatJSON, Level: LogLevelInfo})
+	defer tearDown()
+
+	logger.Debugf("foo")
+	mockWriter.EXPECT().Printf("%s", `{"time":"2018-12-31T18:00:17.000000987Z","level":"info","logger":"test","msg":"foo \"HOGE\"","request_id":"req-1"}`)
+	logger.With(FieldRequestID, "req-1").Infof("foo %q", "HOGE")
+}
+
+func TestPayload(t *testing.T) {
+	assert := assert.New(t)
+	original := getLogOptions()
+	defer SetLogOptions(original)
+
+	SetLogOptions(LogOptions{Payload: PayloadFull})
+	assert.Equal("t|25.3|h|40", Payload("t|25.3|h|40"))
+
+	SetLogOptions(LogOptions{Payload: PayloadTruncate, PayloadMaxLength: 4})
+	assert.Equal("t|25", Payload("t|25"))
+	assert.Equal("t|25...(11 bytes)", Payload("t|25.3|h|40"))
+	assert.Equal("あ...(9 bytes)", Payload("あいう"))
+
+	SetLogOptions(LogOptions{Payload: PayloadRedact})
+	assert.Equal("[REDACTED 11 bytes sha256:"+HashKey("t|25.3|h|40")+"]", Payload("t|25.3|h|40"))
+	assert.Len(HashKey("t|25.3|h|40"), 16)
+	assert.NotEqual(HashKey("a"), HashKey("b"))
+}
@@ -0,0 +1,65 @@
+/*
+Package utils : utilities.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package utils
+
+import (
+	"strings"
+)
+
+/*
+MatchTopic : check whether the MQTT topic matches the MQTT topic filter.
+	MatchTopic returns the topic levels matched with the wildcards ('+' and '#') of the filter in order.
+	The levels matched with '#' are joined with '/'.
+*/
+func MatchTopic(filter string, topic string) ([]string, bool) {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	matched := []string{}
+
+	for i, f := range fs {
+		switch {
+		case f == "#" && i == len(fs)-1:
+			// '#' does not match the topic starting with '$' at the first level
+			if i == 0 && strings.HasPrefix(topic, "$") {
+				return nil, false
+			}
+			return append(matched, strings.Join(ts[i:], "/")), true
+		case i >= len(ts):
+			return nil, false
+		case f == "+":
+			if i == 0 && strings.HasPrefix(ts[i], "$") {
+				return nil, false
+			}
+			matched = append(matched, ts[i])
+		case f != ts[i]:
+			return nil, false
+		}
+	}
+	if len(fs) != len(ts) {
+		return nil, false
+	}
+	return matched, true
+}
+
+/*
+ValidTopicFilter : check whether the argument is a valid MQTT topic filter.
+*/
+func ValidTopicFilter(filter string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	for i, f := range fs {
+		if strings.Contains(f, "#") && (f != "#" || i != len(fs)-1) {
+			return false
+		}
+		if strings.Contains(f, "+") && f != "+" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+/*
+Package utils : utilities.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		filter   string
+		topic    string
+		ok       bool
+		expected []string
+	}{
+		{filter: "/ul/key/dev1/attrs", topic: "/ul/key/dev1/attrs", ok: true, expected: []string{}},
+		{filter: "/ul/+/+/attrs", topic: "/ul/key/dev1/attrs", ok: true, expected: []string{"key", "dev1"}},
+		{filter: "/ul/#", topic: "/ul/key/dev1/attrs", ok: true, expected: []string{"key/dev1/attrs"}},
+		{filter: "/ul/+/#", topic: "/ul/key/dev1/attrs", ok: true, expected: []string{"key", "dev1/attrs"}},
+		{filter: "/ul/#", topic: "/ul", ok: true, expected: []string{""}},
+		{filter: "#", topic: "/ul/key", ok: true, expected: []string{"/ul/key"}},
+		{filter: "+/+", topic: "/ul", ok: true, expected: []string{"", "ul"}},
+		{filter: "/ul/+", topic: "/ul/", ok: true, expected: []string{""}},
+		{filter: "/ul/+/+/attrs", topic: "/ul/key/dev1/cmd", ok: false},
+		{filter: "/ul/+/+/attrs", topic: "/ul/key/attrs", ok: false},
+		{filter: "/ul/+", topic: "/ul/key/dev1", ok: false},
+		{filter: "/ul/key", topic: "/ul", ok: false},
+		{filter: "#", topic: "$SYS/broker", ok: false},
+		{filter: "+/broker", topic: "$SYS/broker", ok: false},
+		{filter: "$SYS/#", topic: "$SYS/broker", ok: true, expected: []string{"broker"}},
+	}
+	for _, testCase := range testCases {
+		matched, ok := MatchTopic(testCase.filter, testCase.topic)
+		assert.Equal(testCase.ok, ok, "%s %s", testCase.filter, testCase.topic)
+		assert.Equal(testCase.expected, matched, "%s %s", testCase.filter, testCase.topic)
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, filter := range []string{"#", "+", "/", "/ul/+/+/attrs", "/ul/#", "+/+/#"} {
+		assert.True(ValidTopicFilter(filter), filter)
+	}
+	for _, filter := range []string{"", "/ul/#/attrs", "/ul/a#", "/ul/a+/attrs", "/ul/++"} {
+		assert.False(ValidTopicFilter(filter), filter)
+	}
+}